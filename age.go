@@ -2,34 +2,65 @@ package keycloak
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"strings"
 
 	"filippo.io/age"
+	"filippo.io/age/agessh"
+	"golang.org/x/crypto/ssh"
 )
 
-func newAgeEncryptionFunction(pubKey string) (encryptionFunc, error) {
-	recipient, err := age.ParseX25519Recipient(pubKey)
-	if err != nil {
-		return nil, err
+// SSHKeyPassphrase is called for the passphrase of an encrypted SSH private
+// key once the key is needed for decryption. check reports whether a
+// passphrase decrypts the key, so that only correct passphrases are remembered.
+var SSHKeyPassphrase func(check func([]byte) bool) ([]byte, error)
+
+// scryptWorkFactor is the work factor of passphrase-wrapped keys.
+// Tests lower it to keep them fast.
+var scryptWorkFactor = 18
+
+// newAgeWrapFunction returns an encryptionFunc that encrypts data
+// for all given recipients with age. Recipients are either age X25519
+// recipients or SSH public keys.
+func newAgeWrapFunction(pubKeys ...string) (encryptionFunc, error) {
+	if len(pubKeys) == 0 {
+		return nil, fmt.Errorf("no recipients")
+	}
+
+	recipients := make([]age.Recipient, len(pubKeys))
+	for idx := range pubKeys {
+		recipient, err := parseRecipient(pubKeys[idx])
+		if err != nil {
+			return nil, err
+		}
+		recipients[idx] = recipient
 	}
 
-	aesFunc, err := newAESEncryptionFunction()
+	return newWrapFunction(recipients...), nil
+}
+
+// newPassphraseWrapFunction returns an encryptionFunc that encrypts data
+// with a key derived from the passphrase with scrypt.
+func newPassphraseWrapFunction(passphrase string) (encryptionFunc, error) {
+	recipient, err := age.NewScryptRecipient(passphrase)
 	if err != nil {
 		return nil, err
 	}
 
+	recipient.SetWorkFactor(scryptWorkFactor)
+	return newWrapFunction(recipient), nil
+}
+
+func newWrapFunction(recipients ...age.Recipient) encryptionFunc {
 	return func(bites []byte) ([]byte, error) {
 		var buf bytes.Buffer
 		var w io.WriteCloser
 		var err error
 
-		bites, err = aesFunc(bites)
-		if err != nil {
-			return nil, err
-		}
-
-		w, err = age.Encrypt(&buf, recipient)
+		w, err = age.Encrypt(&buf, recipients...)
 		if err != nil {
 			return nil, err
 		}
@@ -46,25 +77,30 @@ func newAgeEncryptionFunction(pubKey string) (encryptionFunc, error) {
 		}
 
 		return buf.Bytes(), nil
-	}, nil
+	}
 }
 
 func newAgeDecryptionFunction(privKey string) (decryptionFunc, error) {
-	identity, err := age.ParseX25519Identity(privKey)
+	unwrapFunc, err := newAgeUnwrapFunction(privKey)
 	if err != nil {
 		return nil, err
 	}
 
+	return newPerValueDecryptionFunction(unwrapFunc), nil
+}
+
+// newPerValueDecryptionFunction returns a decryptionFunc for values that
+// were encrypted with their own AES key which was then wrapped together with
+// the ciphertext by the counterpart of unwrapFunc.
+func newPerValueDecryptionFunction(unwrapFunc decryptionFunc) decryptionFunc {
 	return func(bites []byte) ([]byte, error) {
-		buf := bytes.NewBuffer(bites)
-		r, err := age.Decrypt(buf, identity)
+		bites, err := unwrapFunc(bites)
 		if err != nil {
 			return nil, err
 		}
 
-		bites, err = ioutil.ReadAll(r)
-		if err != nil {
-			return nil, err
+		if len(bites) < 32 {
+			return nil, fmt.Errorf("malformed ciphertext")
 		}
 
 		aesKey := bites[:32]
@@ -75,5 +111,128 @@ func newAgeDecryptionFunction(privKey string) (decryptionFunc, error) {
 		}
 
 		return f(bites)
-	}, nil
+	}
+}
+
+// newAgeUnwrapFunction is the counterpart of newAgeWrapFunction.
+// privKeys may contain several identities, see parseIdentities.
+// Each of them is tried until one matches.
+func newAgeUnwrapFunction(privKeys string) (decryptionFunc, error) {
+	identities, err := parseIdentities(privKeys)
+	if err != nil {
+		return nil, err
+	}
+
+	return newUnwrapFunction(identities...), nil
+}
+
+// newPassphraseUnwrapFunction is the counterpart of newPassphraseWrapFunction.
+func newPassphraseUnwrapFunction(passphrase string) (decryptionFunc, error) {
+	identity, err := age.NewScryptIdentity(passphrase)
+	if err != nil {
+		return nil, err
+	}
+
+	return newUnwrapFunction(identity), nil
+}
+
+func newUnwrapFunction(identities ...age.Identity) decryptionFunc {
+	return func(bites []byte) ([]byte, error) {
+		buf := bytes.NewBuffer(bites)
+		r, err := age.Decrypt(buf, identities...)
+		if err != nil {
+			return nil, err
+		}
+
+		return ioutil.ReadAll(r)
+	}
+}
+
+// parseRecipient parses an age X25519 recipient or
+// an ssh-ed25519 or ssh-rsa public key.
+func parseRecipient(s string) (age.Recipient, error) {
+	if strings.HasPrefix(s, "ssh-") {
+		return agessh.ParseRecipient(s)
+	}
+	return age.ParseX25519Recipient(s)
+}
+
+// parseIdentities parses age X25519 identities (one per line, '#' starts a
+// comment) and PEM encoded SSH private keys. This allows to pass the contents
+// of several key files at once.
+func parseIdentities(s string) ([]age.Identity, error) {
+	var identities []age.Identity
+	var ageLines []string
+	var hasAgeIdentities bool
+	var pemLines []string
+	for _, line := range strings.Split(s, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case pemLines != nil:
+			pemLines = append(pemLines, line)
+			if strings.HasPrefix(trimmed, "-----END ") {
+				identity, err := parseSSHIdentity(strings.Join(pemLines, "\n"))
+				if err != nil {
+					return nil, err
+				}
+				identities = append(identities, identity)
+				pemLines = nil
+			}
+
+		case strings.HasPrefix(trimmed, "-----BEGIN ") && strings.HasSuffix(trimmed, "PRIVATE KEY-----"):
+			pemLines = []string{line}
+
+		default:
+			ageLines = append(ageLines, line)
+			if trimmed != "" && !strings.HasPrefix(trimmed, "#") {
+				hasAgeIdentities = true
+			}
+		}
+	}
+
+	if pemLines != nil {
+		return nil, fmt.Errorf("malformed SSH private key")
+	}
+
+	if hasAgeIdentities {
+		ageIdentities, err := age.ParseIdentities(strings.NewReader(strings.Join(ageLines, "\n")))
+		if err != nil {
+			return nil, err
+		}
+		identities = append(identities, ageIdentities...)
+	}
+
+	if len(identities) == 0 {
+		return nil, fmt.Errorf("no identities found")
+	}
+	return identities, nil
+}
+
+// parseSSHIdentity parses a PEM encoded SSH private key. Encrypted
+// keys ask SSHKeyPassphrase for their passphrase.
+func parseSSHIdentity(s string) (age.Identity, error) {
+	identity, err := agessh.ParseIdentity([]byte(s))
+	var missing *ssh.PassphraseMissingError
+	if !errors.As(err, &missing) {
+		return identity, err
+	}
+
+	if missing.PublicKey == nil {
+		return nil, fmt.Errorf("encrypted SSH key doesn't contain its public key")
+	}
+	return agessh.NewEncryptedSSHIdentity(missing.PublicKey, []byte(s), sshKeyPassphrase([]byte(s)))
+}
+
+// sshKeyPassphrase returns the passphrase callback of an encrypted SSH key.
+func sshKeyPassphrase(pemBytes []byte) func() ([]byte, error) {
+	return func() ([]byte, error) {
+		if SSHKeyPassphrase == nil {
+			return nil, fmt.Errorf("SSH key is encrypted")
+		}
+
+		return SSHKeyPassphrase(func(passphrase []byte) bool {
+			_, err := ssh.ParseRawPrivateKeyWithPassphrase(pemBytes, passphrase)
+			return err == nil
+		})
+	}
 }
@@ -0,0 +1,163 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"path/filepath"
+
+	kk "github.com/mhelmich/keycloak"
+	"github.com/spf13/cobra"
+)
+
+var (
+	decryptFileParam         string
+	decryptKeyFileParam      []string
+	decryptPassphraseParam   bool
+	decryptJsonPathParam     string
+	decryptOutputFormatParam string
+	decryptSubtreeOnlyParam  bool
+)
+
+// decryptCmd represents the decrypt command
+var decryptCmd = &cobra.Command{
+	Use:   "decrypt",
+	Short: "Print a decrypted secrets file to stdout.",
+	Long: `Decrypts the subtree at the given json path and prints either the whole
+document or just the decrypted subtree to stdout. The file itself is not modified.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, err := cmd.Flags().GetString("file")
+		if err != nil {
+			return err
+		}
+
+		keyFiles, err := cmd.Flags().GetStringArray("key")
+		if err != nil {
+			return err
+		}
+
+		usePassphrase, err := cmd.Flags().GetBool("passphrase")
+		if err != nil {
+			return err
+		}
+
+		jsonPath, err := cmd.Flags().GetString("json-path")
+		if err != nil {
+			return err
+		}
+
+		outputFormat, err := cmd.Flags().GetString("output-format")
+		if err != nil {
+			return err
+		}
+
+		subtreeOnly, err := cmd.Flags().GetBool("subtree-only")
+		if err != nil {
+			return err
+		}
+
+		return decrypt(cmd.OutOrStdout(), file, keyFiles, usePassphrase, jsonPath, outputFormat, subtreeOnly)
+	},
+}
+
+func decrypt(w io.Writer, filePath string, keyFiles []string, usePassphrase bool, jsonPath string, outputFormat string, subtreeOnly bool) error {
+	decrypt, err := getDecrypter(keyFiles, usePassphrase, false)
+	if err != nil {
+		return err
+	}
+
+	jsonPathParts := parseJsonPath(jsonPath)
+	store, err := decryptStore(filePath, decrypt, jsonPathParts)
+	if err != nil {
+		return err
+	}
+
+	var st map[string]interface{}
+	if subtreeOnly {
+		st, err = store.Subtree(jsonPathParts...)
+	} else {
+		st, err = store.Subtree()
+	}
+	if err != nil {
+		return err
+	}
+
+	if outputFormat == "" {
+		outputFormat = outputFormatForFile(filePath)
+	}
+
+	bites, err := marshalWithFormat(st, outputFormat)
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(bites)
+	return err
+}
+
+func outputFormatForFile(filePath string) string {
+	switch filepath.Ext(filePath) {
+	case ".yaml", ".yml":
+		return "yaml"
+	case ".toml":
+		return "toml"
+	case ".env":
+		return "dotenv"
+	case ".ini", ".cfg":
+		return "ini"
+	case ".properties":
+		return "properties"
+	default:
+		return "json"
+	}
+}
+
+func marshalWithFormat(v interface{}, format string) ([]byte, error) {
+	switch format {
+	case "json":
+		bites, err := json.MarshalIndent(v, "", "  ")
+		if err != nil {
+			return nil, err
+		}
+		return append(bites, '\n'), nil
+	case "yaml", "yml":
+		return kk.MarshalYAML(v)
+	case "toml":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("only documents can be written as toml")
+		}
+		return kk.MarshalTOML(m)
+	case "dotenv", "env":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("only documents can be written as dotenv")
+		}
+		return kk.MarshalDotenv(m)
+	case "ini":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("only documents can be written as ini")
+		}
+		return kk.MarshalINI(m)
+	case "properties":
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("only documents can be written as properties")
+		}
+		return kk.MarshalProperties(m)
+	default:
+		return nil, fmt.Errorf("unsupported output format: %s", format)
+	}
+}
+
+func init() {
+	rootCmd.AddCommand(decryptCmd)
+	decryptCmd.Flags().StringVarP(&decryptFileParam, "file", "f", "", "the secrets file to read (required)")
+	_ = decryptCmd.MarkFlagRequired("file")
+	decryptCmd.Flags().StringArrayVarP(&decryptKeyFileParam, "key", "k", []string{}, "a private key file to read (can be repeated)")
+	decryptCmd.Flags().BoolVar(&decryptPassphraseParam, "passphrase", false, "decrypt with a passphrase instead of a private key (read from $KEYCLOAK_PASSPHRASE or prompted for)")
+	decryptCmd.Flags().StringVarP(&decryptJsonPathParam, "json-path", "p", "", "the json path to the subtree to decrypt")
+	decryptCmd.Flags().StringVarP(&decryptOutputFormatParam, "output-format", "o", "", "json, yaml, toml, dotenv, ini or properties (defaults to the format of the file)")
+	decryptCmd.Flags().BoolVarP(&decryptSubtreeOnlyParam, "subtree-only", "s", false, "only print the decrypted subtree instead of the whole document")
+}
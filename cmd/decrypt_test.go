@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	k8syaml "sigs.k8s.io/yaml"
+)
+
+func TestDecryptWholeDocument(t *testing.T) {
+	var buf bytes.Buffer
+	err := decrypt(&buf, "../testdata/creds1.enc.yaml", []string{"../testdata/keys.age"}, false, "secrets", "", false)
+	assert.Nil(t, err)
+
+	m := make(map[string]interface{})
+	err = k8syaml.Unmarshal(buf.Bytes(), &m)
+	assert.Nil(t, err)
+	assert.Equal(t, "some-service", m["name"])
+	secrets, ok := m["secrets"].(map[string]interface{})
+	assert.True(t, ok)
+	assert.Equal(t, 3, len(secrets))
+	assert.Equal(t, "super-secret-password1", secrets["secret-name1"])
+}
+
+func TestDecryptSubtreeAsJSON(t *testing.T) {
+	var buf bytes.Buffer
+	err := decrypt(&buf, "../testdata/creds1.enc.yaml", []string{"../testdata/keys.age"}, false, "secrets", "json", true)
+	assert.Nil(t, err)
+
+	m := make(map[string]interface{})
+	err = json.Unmarshal(buf.Bytes(), &m)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(m))
+	assert.Equal(t, "super-secret-password3", m["secret-name3"])
+}
+
+func TestDecryptErrors(t *testing.T) {
+	var buf bytes.Buffer
+	err := decrypt(&buf, "does/not/exist.yaml", []string{"../testdata/keys.age"}, false, "secrets", "", false)
+	assert.NotNil(t, err)
+	err = decrypt(&buf, "../testdata/creds1.enc.yaml", []string{"../testdata/keys.age"}, false, "secrets", "xml", false)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, buf.Len())
+}
+
+func TestDecryptTOML(t *testing.T) {
+	dir, file := copyToTempDir(t, "../testdata/config.toml")
+	defer os.RemoveAll(dir)
+
+	err := encrypt(file, []string{testRecipient}, "", false, "database", "")
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	err = decrypt(&buf, file, []string{"../testdata/keys.age"}, false, "database", "", true)
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), "port = 5432\n")
+	assert.Contains(t, buf.String(), "rotated = 2021-11-02\n")
+	assert.Contains(t, buf.String(), "[[replicas]]\n")
+}
+
+func TestDecryptINI(t *testing.T) {
+	dir, file := copyToTempDir(t, "../testdata/app.ini")
+	defer os.RemoveAll(dir)
+
+	err := encrypt(file, []string{testRecipient}, "", false, "database", "")
+	assert.Nil(t, err)
+
+	var buf bytes.Buffer
+	err = decrypt(&buf, file, []string{"../testdata/keys.age"}, false, "database", "", false)
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), "name = keycloak\n")
+	assert.Contains(t, buf.String(), "\n[database]\nhost = db1.example.com\npassword = super-secret-password1\n")
+
+	buf.Reset()
+	err = decrypt(&buf, file, []string{"../testdata/keys.age"}, false, "database", "properties", true)
+	assert.Nil(t, err)
+	assert.Equal(t, "host=db1.example.com\npassword=super-secret-password1\nuser=admin\n", buf.String())
+}
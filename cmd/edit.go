@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+
+	kk "github.com/mhelmich/keycloak"
+	"github.com/spf13/cobra"
+)
+
+var (
+	editFileParam           string
+	editKeyFileParam        []string
+	editPassphraseParam     bool
+	editJsonPathParam       string
+	editRecipientsParam     []string
+	editRecipientsFileParam string
+)
+
+// editCmd represents the edit command
+var editCmd = &cobra.Command{
+	Use:   "edit",
+	Short: "Edit a secrets file in $EDITOR.",
+	Long: `Decrypts the subtree at the given json path into a private temporary file and opens it in $EDITOR.
+After the editor exits, only the values that changed are re-encrypted and the file is written back in place.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, err := cmd.Flags().GetString("file")
+		if err != nil {
+			return err
+		}
+
+		file, err = filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+
+		keyFiles, err := cmd.Flags().GetStringArray("key")
+		if err != nil {
+			return err
+		}
+
+		usePassphrase, err := cmd.Flags().GetBool("passphrase")
+		if err != nil {
+			return err
+		}
+
+		jsonPath, err := cmd.Flags().GetString("json-path")
+		if err != nil {
+			return err
+		}
+
+		recipients, err := cmd.Flags().GetStringArray("recipient")
+		if err != nil {
+			return err
+		}
+
+		recipientsFile, err := cmd.Flags().GetString("recipients-file")
+		if err != nil {
+			return err
+		}
+
+		return edit(file, keyFiles, usePassphrase, jsonPath, recipients, recipientsFile, runEditor, os.Stdin, os.Stderr)
+	},
+}
+
+func edit(filePath string, keyFiles []string, usePassphrase bool, jsonPath string, recipients []string, recipientsFile string, editor func(string) error, in io.Reader, out io.Writer) error {
+	// without recipients the ones recorded in the file are used
+	var rs []string
+	var err error
+	if len(recipients) > 0 || recipientsFile != "" {
+		rs, err = getRecipients(recipients, recipientsFile)
+		if err != nil {
+			return err
+		}
+	}
+
+	decrypt, err := getDecrypter(keyFiles, usePassphrase, false)
+	if err != nil {
+		return err
+	}
+
+	jsonPathParts := parseJsonPath(jsonPath)
+	store, err := decryptStore(filePath, decrypt, jsonPathParts)
+	if err != nil {
+		return err
+	}
+
+	doc, err := store.Subtree()
+	if err != nil {
+		return err
+	}
+
+	plaintext, err := marshalWithFormat(doc, outputFormatForFile(filePath))
+	if err != nil {
+		return err
+	}
+
+	// the temp dir is only accessible by the current user
+	// and the plaintext file itself is only readable by the current user
+	dir, err := ioutil.TempDir("", "keycloak-edit-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	tmpFile := filepath.Join(dir, filepath.Base(filePath))
+	err = ioutil.WriteFile(tmpFile, plaintext, 0600)
+	if err != nil {
+		return err
+	}
+
+	edited, err := editUntilValid(tmpFile, editor, in, out)
+	if err != nil {
+		return err
+	}
+
+	editedBites, err := ioutil.ReadFile(tmpFile)
+	if err != nil {
+		return err
+	}
+
+	if bytes.Equal(plaintext, editedBites) {
+		fmt.Fprintln(out, "no changes")
+		return nil
+	}
+
+	editedDoc, err := edited.Subtree()
+	if err != nil {
+		return err
+	}
+
+	err = store.Set(editedDoc)
+	if err != nil {
+		return err
+	}
+
+	// only re-encrypt the values that changed
+	err = store.UpdateSubtree(rs, jsonPathParts...)
+	if err != nil {
+		return err
+	}
+
+	return store.ToFile(filePath)
+}
+
+// editUntilValid opens the editor until the edited file can be parsed again.
+func editUntilValid(tmpFile string, editor func(string) error, in io.Reader, out io.Writer) (kk.Store, error) {
+	r := bufio.NewReader(in)
+	for {
+		err := editor(tmpFile)
+		if err != nil {
+			return nil, err
+		}
+
+		store, err := kk.GetStoreForFile(tmpFile)
+		if err == nil {
+			return store, nil
+		}
+
+		fmt.Fprintf(out, "the edited file is invalid: %s\n", err.Error())
+		fmt.Fprintln(out, "press enter to return to the editor or ctrl+c to abort")
+		_, err = r.ReadString('\n')
+		if err != nil {
+			return nil, fmt.Errorf("aborted editing")
+		}
+	}
+}
+
+func runEditor(path string) error {
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = "vi"
+	}
+
+	// run the editor through the shell to support editors with arguments (e.g. "code --wait")
+	cmd := exec.Command("/bin/sh", "-c", editor+` "$1"`, "sh", path)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func init() {
+	rootCmd.AddCommand(editCmd)
+	editCmd.Flags().StringVarP(&editFileParam, "file", "f", "", "the secrets file to edit (required)")
+	_ = editCmd.MarkFlagRequired("file")
+	editCmd.Flags().StringArrayVarP(&editKeyFileParam, "key", "k", []string{}, "a private key file to read (can be repeated)")
+	editCmd.Flags().BoolVar(&editPassphraseParam, "passphrase", false, "decrypt and re-encrypt with a passphrase instead of a private key (read from $KEYCLOAK_PASSPHRASE or prompted for)")
+	editCmd.Flags().StringVarP(&editJsonPathParam, "json-path", "p", "", "the json path to the subtree to edit")
+	editCmd.Flags().StringArrayVarP(&editRecipientsParam, "recipient", "r", []string{}, "the public key of a recipient (can be repeated, defaults to the recipients recorded in the file)")
+	editCmd.Flags().StringVarP(&editRecipientsFileParam, "recipients-file", "R", "", "a file containing one recipient per line")
+}
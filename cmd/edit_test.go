@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	kk "github.com/mhelmich/keycloak"
+	"github.com/stretchr/testify/assert"
+)
+
+func copyToTempDir(t *testing.T, src string) (string, string) {
+	dir, err := ioutil.TempDir("", "keycloak-test-")
+	assert.Nil(t, err)
+
+	bites, err := ioutil.ReadFile(src)
+	assert.Nil(t, err)
+	file := filepath.Join(dir, filepath.Base(src))
+	err = ioutil.WriteFile(file, bites, 0600)
+	assert.Nil(t, err)
+	return dir, file
+}
+
+func replacingEditor(t *testing.T, old string, new string) func(string) error {
+	return func(path string) error {
+		info, err := os.Stat(path)
+		assert.Nil(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+		bites, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		return ioutil.WriteFile(path, bytes.ReplaceAll(bites, []byte(old), []byte(new)), 0600)
+	}
+}
+
+func TestEditChangedValuesOnly(t *testing.T) {
+	dir, file := copyToTempDir(t, "../testdata/creds1.yaml")
+	defer os.RemoveAll(dir)
+	err := encrypt(file, []string{testRecipient}, "", false, "secrets", "")
+	assert.Nil(t, err)
+	before, err := kk.GetStoreForFile(file)
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	editor := replacingEditor(t, "super-secret-password2", "changed-password2")
+	err = edit(file, []string{"../testdata/keys.age"}, false, "secrets", []string{testRecipient}, "", editor, strings.NewReader(""), &out)
+	assert.Nil(t, err)
+
+	m, err := decryptSubtree(file, []string{"../testdata/keys.age"}, false, []string{"secrets"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password1", m["secret-name1"])
+	assert.Equal(t, "changed-password2", m["secret-name2"])
+
+	// unchanged values keep their ciphertext
+	after, err := kk.GetStoreForFile(file)
+	assert.Nil(t, err)
+	stBefore, err := before.Subtree("secrets")
+	assert.Nil(t, err)
+	stAfter, err := after.Subtree("secrets")
+	assert.Nil(t, err)
+	assert.Equal(t, stBefore["secret-name1"], stAfter["secret-name1"])
+	assert.NotEqual(t, stBefore["secret-name2"], stAfter["secret-name2"])
+	assert.Equal(t, stBefore["secret-name3"], stAfter["secret-name3"])
+}
+
+func TestEditNoChanges(t *testing.T) {
+	dir, file := copyToTempDir(t, "../testdata/creds1.enc.yaml")
+	defer os.RemoveAll(dir)
+
+	var out bytes.Buffer
+	editor := func(string) error { return nil }
+	err := edit(file, []string{"../testdata/keys.age"}, false, "secrets", []string{testRecipient}, "", editor, strings.NewReader(""), &out)
+	assert.Nil(t, err)
+	assert.Equal(t, "no changes\n", out.String())
+
+	before, err := ioutil.ReadFile("../testdata/creds1.enc.yaml")
+	assert.Nil(t, err)
+	after, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestEditReopensEditorOnInvalidFile(t *testing.T) {
+	dir, file := copyToTempDir(t, "../testdata/creds1.enc.yaml")
+	defer os.RemoveAll(dir)
+
+	calls := 0
+	editor := func(path string) error {
+		calls++
+		if calls == 1 {
+			return ioutil.WriteFile(path, []byte("secrets: [broken"), 0600)
+		}
+		return ioutil.WriteFile(path, []byte("name: some-service\nsecrets:\n  secret-name1: new\n"), 0600)
+	}
+
+	var out bytes.Buffer
+	err := edit(file, []string{"../testdata/keys.age"}, false, "secrets", []string{testRecipient}, "", editor, strings.NewReader("\n"), &out)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, calls)
+	assert.Contains(t, out.String(), "the edited file is invalid")
+
+	m, err := decryptSubtree(file, []string{"../testdata/keys.age"}, false, []string{"secrets"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(m))
+	assert.Equal(t, "new", m["secret-name1"])
+}
+
+func TestEditAbortOnInvalidFile(t *testing.T) {
+	dir, file := copyToTempDir(t, "../testdata/creds1.enc.yaml")
+	defer os.RemoveAll(dir)
+
+	editor := func(path string) error {
+		return ioutil.WriteFile(path, []byte("secrets: [broken"), 0600)
+	}
+
+	var out bytes.Buffer
+	err := edit(file, []string{"../testdata/keys.age"}, false, "secrets", []string{testRecipient}, "", editor, strings.NewReader(""), &out)
+	assert.NotNil(t, err)
+
+	before, err := ioutil.ReadFile("../testdata/creds1.enc.yaml")
+	assert.Nil(t, err)
+	after, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestEditRecordedRecipients(t *testing.T) {
+	dir, file := copyToTempDir(t, "../testdata/creds1.yaml")
+	defer os.RemoveAll(dir)
+
+	err := encrypt(file, []string{testRecipient}, "", false, "secrets", "")
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	editor := replacingEditor(t, "super-secret-password3", "changed-password3")
+	err = edit(file, []string{"../testdata/keys.age"}, false, "secrets", []string{}, "", editor, strings.NewReader(""), &out)
+	assert.Nil(t, err)
+
+	m, err := decryptSubtree(file, []string{"../testdata/keys.age"}, false, []string{"secrets"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "changed-password3", m["secret-name3"])
+
+	// legacy files don't record their recipients
+	dir2, file2 := copyToTempDir(t, "../testdata/creds1.enc.yaml")
+	defer os.RemoveAll(dir2)
+	err = edit(file2, []string{"../testdata/keys.age"}, false, "secrets", []string{}, "", editor, strings.NewReader(""), &out)
+	assert.NotNil(t, err)
+}
+
+func TestEditCommand(t *testing.T) {
+	defer func(editor string) {
+		os.Setenv("EDITOR", editor)
+	}(os.Getenv("EDITOR"))
+	defer rootCmd.SetArgs(nil)
+
+	// without --passphrase
+	dir, file := copyToTempDir(t, "../testdata/creds1.enc.yaml")
+	defer os.RemoveAll(dir)
+	os.Setenv("EDITOR", "true")
+	rootCmd.SetArgs([]string{"edit", "--file", file, "--key", "../testdata/keys.age", "--json-path", "secrets"})
+	err := rootCmd.Execute()
+	assert.Nil(t, err)
+
+	// with --passphrase
+	dir2, file2 := copyToTempDir(t, "../testdata/creds1.yaml")
+	defer os.RemoveAll(dir2)
+	os.Setenv(passphraseEnv, "correct horse battery staple")
+	defer os.Unsetenv(passphraseEnv)
+	err = encrypt(file2, nil, "", true, "secrets", "")
+	assert.Nil(t, err)
+
+	os.Setenv("EDITOR", "sed -i -e s/super-secret-password2/changed-password2/")
+	rootCmd.SetArgs([]string{"edit", "--file", file2, "--passphrase", "--json-path", "secrets"})
+	err = rootCmd.Execute()
+	assert.Nil(t, err)
+
+	m, err := decryptSubtree(file2, nil, true, []string{"secrets"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password1", m["secret-name1"])
+	assert.Equal(t, "changed-password2", m["secret-name2"])
+}
@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+
+	kk "github.com/mhelmich/keycloak"
+	"github.com/spf13/cobra"
+)
+
+var (
+	encryptFileParam           string
+	encryptRecipientsParam     []string
+	encryptRecipientsFileParam string
+	encryptPassphraseParam     bool
+	encryptJsonPathParam       string
+	encryptOutputParam         string
+)
+
+// encryptCmd represents the encrypt command
+var encryptCmd = &cobra.Command{
+	Use:   "encrypt",
+	Short: "Encrypt a subtree of a secrets file.",
+	Long: `Encrypts the subtree at the given json path for all given recipients.
+The file is encrypted in place unless an output file is provided.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, err := cmd.Flags().GetString("file")
+		if err != nil {
+			return err
+		}
+
+		file, err = filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+
+		recipients, err := cmd.Flags().GetStringArray("recipient")
+		if err != nil {
+			return err
+		}
+
+		recipientsFile, err := cmd.Flags().GetString("recipients-file")
+		if err != nil {
+			return err
+		}
+
+		usePassphrase, err := cmd.Flags().GetBool("passphrase")
+		if err != nil {
+			return err
+		}
+
+		jsonPath, err := cmd.Flags().GetString("json-path")
+		if err != nil {
+			return err
+		}
+
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+
+		return encrypt(file, recipients, recipientsFile, usePassphrase, jsonPath, output)
+	},
+}
+
+func encrypt(filePath string, recipients []string, recipientsFile string, usePassphrase bool, jsonPath string, outputPath string) error {
+	store, err := kk.GetStoreForFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	if usePassphrase {
+		if len(recipients) > 0 || recipientsFile != "" {
+			return fmt.Errorf("recipients cannot be combined with a passphrase")
+		}
+
+		passphrase, err := getPassphrase(true)
+		if err != nil {
+			return err
+		}
+
+		err = store.EncryptSubtreeWithPassphrase(passphrase, parseJsonPath(jsonPath)...)
+		if err != nil {
+			return err
+		}
+	} else {
+		rs, err := getRecipients(recipients, recipientsFile)
+		if err != nil {
+			return err
+		}
+
+		err = store.EncryptSubtreeForRecipients(rs, parseJsonPath(jsonPath)...)
+		if err != nil {
+			return err
+		}
+	}
+
+	if outputPath == "" {
+		outputPath = filePath
+	}
+	return store.ToFile(outputPath)
+}
+
+// getRecipients merges the recipients given on the command line with the
+// recipients listed in the recipients file (one per line, '#' starts a comment).
+func getRecipients(recipients []string, recipientsFile string) ([]string, error) {
+	rs := make([]string, 0, len(recipients))
+	for _, r := range recipients {
+		rs = append(rs, strings.TrimSpace(r))
+	}
+
+	if recipientsFile != "" {
+		bites, err := ioutil.ReadFile(recipientsFile)
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(bytes.NewBuffer(bites))
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			rs = append(rs, line)
+		}
+
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(rs) == 0 {
+		return nil, fmt.Errorf("at least one recipient is required")
+	}
+	return rs, nil
+}
+
+func init() {
+	rootCmd.AddCommand(encryptCmd)
+	encryptCmd.Flags().StringVarP(&encryptFileParam, "file", "f", "", "the secrets file to encrypt (required)")
+	_ = encryptCmd.MarkFlagRequired("file")
+	encryptCmd.Flags().StringArrayVarP(&encryptRecipientsParam, "recipient", "r", []string{}, "the public key of a recipient (can be repeated)")
+	encryptCmd.Flags().StringVarP(&encryptRecipientsFileParam, "recipients-file", "R", "", "a file containing one recipient per line")
+	encryptCmd.Flags().BoolVar(&encryptPassphraseParam, "passphrase", false, "encrypt with a passphrase instead of recipients (read from $KEYCLOAK_PASSPHRASE or prompted for)")
+	encryptCmd.Flags().StringVarP(&encryptJsonPathParam, "json-path", "p", "", "the json path to the subtree to encrypt")
+	encryptCmd.Flags().StringVarP(&encryptOutputParam, "output", "o", "", "the file to write the encrypted secrets to (defaults to the input file)")
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	kk "github.com/mhelmich/keycloak"
+	"github.com/stretchr/testify/assert"
+)
+
+const testRecipient = "age133p5vy8lw48dw59jdl7rrlpm50dslc6m6kpjc3slaq2edmqayyas5pv8se"
+
+func TestEncryptBasic(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestEncryptBasic-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	output := filepath.Join(dir, "creds1.yaml")
+	err = encrypt("../testdata/creds1.yaml", []string{testRecipient}, "", false, "secrets", output)
+	assert.Nil(t, err)
+
+	m, err := decryptSubtree(output, []string{"../testdata/keys.age"}, false, []string{"secrets"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(m))
+	assert.Equal(t, "super-secret-password1", m["secret-name1"])
+}
+
+func TestEncryptInPlace(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestEncryptInPlace-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	bites, err := ioutil.ReadFile("../testdata/creds2.json")
+	assert.Nil(t, err)
+	file := filepath.Join(dir, "creds2.json")
+	err = ioutil.WriteFile(file, bites, 0600)
+	assert.Nil(t, err)
+
+	recipientsFile := filepath.Join(dir, "recipients.txt")
+	err = ioutil.WriteFile(recipientsFile, []byte("# the test key\n"+testRecipient+"\n\n"), 0600)
+	assert.Nil(t, err)
+
+	err = encrypt(file, []string{}, recipientsFile, false, "secrets.prod", "")
+	assert.Nil(t, err)
+
+	m, err := decryptSubtree(file, []string{"../testdata/keys.age"}, false, []string{"secrets", "prod"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, 3, len(m))
+	assert.Equal(t, "super-secret-password7", m["secret-name7"])
+}
+
+func TestEncryptNoRecipients(t *testing.T) {
+	err := encrypt("../testdata/creds1.yaml", []string{}, "", false, "secrets", "")
+	assert.NotNil(t, err)
+}
+
+func TestEncryptTwice(t *testing.T) {
+	dir, file := copyToTempDir(t, "../testdata/creds1.yaml")
+	defer os.RemoveAll(dir)
+
+	err := encrypt(file, []string{testRecipient}, "", false, "secrets", "")
+	assert.Nil(t, err)
+	before, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+
+	err = encrypt(file, []string{testRecipient}, "", false, "secrets", "")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "already encrypted")
+	err = encrypt(file, []string{testRecipient}, "", false, "", "")
+	assert.NotNil(t, err)
+
+	after, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Equal(t, before, after)
+
+	m, err := decryptSubtree(file, []string{"../testdata/keys.age"}, false, []string{"secrets"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password1", m["secret-name1"])
+}
+
+func TestEncryptSSHRecipients(t *testing.T) {
+	dir, file := copyToTempDir(t, "../testdata/creds1.yaml")
+	defer os.RemoveAll(dir)
+
+	recipientsFile := filepath.Join(dir, "recipients")
+	var recipients []byte
+	for _, pub := range []string{"../testdata/id_ed25519.pub", "../testdata/id_ed25519_encrypted.pub"} {
+		bites, err := ioutil.ReadFile(pub)
+		assert.Nil(t, err)
+		recipients = append(recipients, bites...)
+	}
+	err := ioutil.WriteFile(recipientsFile, recipients, 0600)
+	assert.Nil(t, err)
+
+	err = encrypt(file, nil, recipientsFile, false, "secrets", "")
+	assert.Nil(t, err)
+
+	m, err := decryptSubtree(file, []string{"../testdata/id_ed25519"}, false, []string{"secrets"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password1", m["secret-name1"])
+
+	defer func(f func(func([]byte) bool) ([]byte, error)) {
+		kk.SSHKeyPassphrase = f
+	}(kk.SSHKeyPassphrase)
+	kk.SSHKeyPassphrase = func(func([]byte) bool) ([]byte, error) {
+		return []byte("keycloak"), nil
+	}
+	m, err = decryptSubtree(file, []string{"../testdata/id_ed25519_encrypted"}, false, []string{"secrets"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password2", m["secret-name2"])
+}
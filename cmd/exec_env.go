@@ -1,15 +1,13 @@
 package main
 
 import (
-	"bufio"
-	"bytes"
+	"encoding/json"
 	"errors"
 	"fmt"
-	"io"
-	"io/ioutil"
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	kk "github.com/mhelmich/keycloak"
@@ -18,7 +16,8 @@ import (
 
 var (
 	fileParam                string
-	keyFileParam             string
+	keyFileParam             []string
+	passphraseParam          bool
 	jsonPathParam            string
 	deletePrivateKeyAfterUse bool
 )
@@ -39,7 +38,12 @@ var execEnvCmd = &cobra.Command{
 			return err
 		}
 
-		keyFile, err := cmd.Flags().GetString("key")
+		keyFiles, err := cmd.Flags().GetStringArray("key")
+		if err != nil {
+			return err
+		}
+
+		usePassphrase, err := cmd.Flags().GetBool("passphrase")
 		if err != nil {
 			return err
 		}
@@ -49,7 +53,7 @@ var execEnvCmd = &cobra.Command{
 			return err
 		}
 
-		return execEnv(file, keyFile, jsonPath, deletePrivateKeyAfterUse, args...)
+		return execEnv(file, keyFiles, usePassphrase, jsonPath, deletePrivateKeyAfterUse, args...)
 	},
 }
 
@@ -60,8 +64,8 @@ func parseJsonPath(jsonPath string) []string {
 	return strings.Split(jsonPath, ".")
 }
 
-func execEnv(filePath string, keyFile string, jsonPath string, deletePrivateKeyAfterUse bool, command ...string) error {
-	cmd, err := buildCommandForExecEnv(filePath, keyFile, jsonPath, deletePrivateKeyAfterUse, command...)
+func execEnv(filePath string, keyFiles []string, usePassphrase bool, jsonPath string, deletePrivateKeyAfterUse bool, command ...string) error {
+	cmd, err := buildCommandForExecEnv(filePath, keyFiles, usePassphrase, jsonPath, deletePrivateKeyAfterUse, command...)
 	if err != nil {
 		return err
 	}
@@ -69,16 +73,17 @@ func execEnv(filePath string, keyFile string, jsonPath string, deletePrivateKeyA
 	return cmd.Run()
 }
 
-func buildCommandForExecEnv(filePath string, keyFile string, jsonPath string, deletePrivateKeyAfterUse bool, command ...string) (*exec.Cmd, error) {
+func buildCommandForExecEnv(filePath string, keyFiles []string, usePassphrase bool, jsonPath string, deletePrivateKeyAfterUse bool, command ...string) (*exec.Cmd, error) {
 	jsonPathParts := parseJsonPath(jsonPath)
 	// decrypt subtree in file
-	st, err := decryptSubtree(filePath, keyFile, jsonPathParts, deletePrivateKeyAfterUse)
+	st, err := decryptSubtree(filePath, keyFiles, usePassphrase, jsonPathParts, deletePrivateKeyAfterUse)
 	if err != nil {
 		return nil, err
 	}
 
 	// set secrets into env
-	env, err := getEnvWithSecrets(st)
+	// the keys of dotenv files are used as they are
+	env, err := getEnvWithSecrets(st, outputFormatForFile(filePath) == "dotenv")
 	if err != nil {
 		return nil, err
 	}
@@ -87,8 +92,8 @@ func buildCommandForExecEnv(filePath string, keyFile string, jsonPath string, de
 	return prepareCommand(command, env), nil
 }
 
-func decryptSubtree(filePath string, keyFile string, jsonPath []string, deletePrivateKeyAfterUse bool) (map[string]interface{}, error) {
-	key, err := getKey(keyFile, deletePrivateKeyAfterUse)
+func decryptSubtree(filePath string, keyFiles []string, usePassphrase bool, jsonPath []string, deletePrivateKeyAfterUse bool) (map[string]interface{}, error) {
+	decrypt, err := getDecrypter(keyFiles, usePassphrase, deletePrivateKeyAfterUse)
 	if err != nil {
 		return nil, err
 	}
@@ -104,27 +109,48 @@ func decryptSubtree(filePath string, keyFile string, jsonPath []string, deletePr
 		return nil, err
 	}
 
+	store, err := decryptStore(filePath, decrypt, jsonPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return store.Subtree(jsonPath...)
+}
+
+func decryptStore(filePath string, decrypt decrypter, jsonPath []string) (kk.Store, error) {
 	store, err := kk.GetStoreForFile(filePath)
-	if err != nil && !os.IsNotExist(err) {
+	if err != nil {
 		return nil, err
 	}
 
-	err = store.DecryptSubtree(key, jsonPath...)
+	err = decrypt(store, jsonPath...)
 	if err != nil {
 		return nil, err
 	}
 
-	return store.Subtree(jsonPath...)
+	return store, nil
 }
 
-func getEnvWithSecrets(st map[string]interface{}) ([]string, error) {
+func getEnvWithSecrets(st map[string]interface{}, rawKeys bool) ([]string, error) {
 	env := os.Environ()
 	for key, value := range st {
+		if !rawKeys {
+			key = toScreamingSnake(key)
+		}
+
 		switch v := value.(type) {
 		case string:
-			env = append(env, fmt.Sprintf("%s=%s", toScreamingSnake(key), v))
+			env = append(env, fmt.Sprintf("%s=%s", key, v))
+		case kk.Datetime:
+			env = append(env, fmt.Sprintf("%s=%s", key, v))
+		case json.Number:
+			env = append(env, fmt.Sprintf("%s=%s", key, v.String()))
 		case float64:
-			env = append(env, fmt.Sprintf("%s=%f", toScreamingSnake(key), v))
+			env = append(env, fmt.Sprintf("%s=%s", key, strconv.FormatFloat(v, 'f', -1, 64)))
+		case bool:
+			env = append(env, fmt.Sprintf("%s=%t", key, v))
+		case nil:
+			env = append(env, fmt.Sprintf("%s=", key))
 		default:
 			return nil, fmt.Errorf("invalid type")
 		}
@@ -145,52 +171,6 @@ func prepareCommand(command []string, env []string) *exec.Cmd {
 	return cmd
 }
 
-func getKey(path string, deletePrivateKeyAfterUse bool) (string, error) {
-	var bites []byte
-	var err error
-
-	if deletePrivateKeyAfterUse {
-		defer func() {
-			if path != "" {
-				_ = os.Remove(path)
-			}
-			_ = os.Setenv("AGE_KEY", "")
-		}()
-	}
-
-	if path != "" {
-		// try given path
-		bites, err = ioutil.ReadFile(path)
-		if err == nil {
-			r := bufio.NewReader(bytes.NewBuffer(bites))
-			var line string
-
-			for {
-				line, err = r.ReadString('\n')
-				if err != nil && err != io.EOF {
-					return "", err
-				}
-
-				if strings.HasPrefix(line, "AGE-SECRET-KEY-1") {
-					return strings.TrimSpace(line), nil
-				}
-
-				if err == io.EOF {
-					return "", fmt.Errorf("did not find a suitable private key")
-				}
-			}
-		}
-	}
-
-	// TODO: try default file location
-	// try env var
-	v := os.Getenv("AGE_KEY")
-	if v != "" {
-		return v, nil
-	}
-	return "", fmt.Errorf("cannot find age key")
-}
-
 // taken from: https://github.com/iancoleman/strcase/blob/a61ebb85b34d7b831590cd8fa7faafadc161a652/snake.go#L66
 // ToScreamingSnake converts a string to SCREAMING_SNAKE_CASE
 func toScreamingSnake(s string) string {
@@ -256,7 +236,8 @@ func init() {
 	rootCmd.AddCommand(execEnvCmd)
 	execEnvCmd.Flags().StringVarP(&fileParam, "file", "f", "", "the secrets file to read (required)")
 	_ = execEnvCmd.MarkFlagRequired("file")
-	execEnvCmd.Flags().StringVarP(&keyFileParam, "key", "k", "", "the private key file to read")
+	execEnvCmd.Flags().StringArrayVarP(&keyFileParam, "key", "k", []string{}, "a private key file to read (can be repeated)")
+	execEnvCmd.Flags().BoolVar(&passphraseParam, "passphrase", false, "decrypt with a passphrase instead of a private key (read from $KEYCLOAK_PASSPHRASE or prompted for)")
 	execEnvCmd.Flags().StringVarP(&jsonPathParam, "json-path", "p", "", "the json path to the subtree to decrypt")
 	execEnvCmd.Flags().BoolVarP(&deletePrivateKeyAfterUse, "delete-private-key-after-use", "d", false, "deletes the private key locally after use")
 }
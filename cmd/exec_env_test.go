@@ -1,19 +1,22 @@
 package main
 
 import (
+	"encoding/json"
+	"io/ioutil"
 	"os"
+	"path/filepath"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
 func TestExecEnvBasic(t *testing.T) {
-	m, err := decryptSubtree("../testdata/creds1.enc.yaml", "../testdata/keys.age", []string{"secrets"}, false)
+	m, err := decryptSubtree("../testdata/creds1.enc.yaml", []string{"../testdata/keys.age"}, false, []string{"secrets"}, false)
 	assert.Nil(t, err)
 	assert.Equal(t, 3, len(m))
 
 	envBefore := os.Environ()
-	env, err := getEnvWithSecrets(m)
+	env, err := getEnvWithSecrets(m, false)
 	assert.Nil(t, err)
 	assert.Equal(t, len(envBefore)+3, len(env))
 
@@ -23,20 +26,76 @@ func TestExecEnvBasic(t *testing.T) {
 }
 
 func TestExecEnvNoSecretFile(t *testing.T) {
-	m, err := decryptSubtree("does/not/exist", "../testdata/keys.age", []string{}, false)
+	m, err := decryptSubtree("does/not/exist", []string{"../testdata/keys.age"}, false, []string{}, false)
 	assert.Nil(t, err)
 	assert.Equal(t, 0, len(m))
 }
 
 func TestExecEnvPathIsDir(t *testing.T) {
-	m, err := decryptSubtree("../testdata", "../testdata/keys.age", []string{}, false)
+	m, err := decryptSubtree("../testdata", []string{"../testdata/keys.age"}, false, []string{}, false)
 	assert.NotNil(t, err)
 	assert.Nil(t, m)
 }
 
 func TestExecEnvNoJsonPath(t *testing.T) {
 	envBefore := os.Environ()
-	cmd, err := buildCommandForExecEnv("../testdata/creds2.enc.yaml", "../testdata/keys.age", "", false)
+	cmd, err := buildCommandForExecEnv("../testdata/creds2.enc.yaml", []string{"../testdata/keys.age"}, false, "", false)
 	assert.Nil(t, err)
 	assert.Equal(t, len(envBefore)+2, len(cmd.Env))
 }
+
+func TestExecEnvBoolAndNull(t *testing.T) {
+	env, err := getEnvWithSecrets(map[string]interface{}{
+		"enabled": true,
+		"token":   nil,
+	}, false)
+	assert.Nil(t, err)
+	assert.Contains(t, env, "ENABLED=true")
+	assert.Contains(t, env, "TOKEN=")
+}
+
+func TestExecEnvNumbers(t *testing.T) {
+	env, err := getEnvWithSecrets(map[string]interface{}{
+		"port":  json.Number("5432"),
+		"id":    json.Number("12345678901234567890123"),
+		"ratio": 0.5,
+		"count": float64(3),
+	}, false)
+	assert.Nil(t, err)
+	assert.Contains(t, env, "PORT=5432")
+	assert.Contains(t, env, "ID=12345678901234567890123")
+	assert.Contains(t, env, "RATIO=0.5")
+	assert.Contains(t, env, "COUNT=3")
+}
+
+func TestExecEnvDotenv(t *testing.T) {
+	dir, file := copyToTempDir(t, "../testdata/app.env")
+	defer os.RemoveAll(dir)
+
+	err := encrypt(file, []string{testRecipient}, "", false, "", "")
+	assert.Nil(t, err)
+
+	envBefore := os.Environ()
+	cmd, err := buildCommandForExecEnv(file, []string{"../testdata/keys.age"}, false, "", false)
+	assert.Nil(t, err)
+	assert.Equal(t, len(envBefore)+5, len(cmd.Env))
+	assert.Contains(t, cmd.Env, "API_KEY2=super-secret-key")
+	assert.Contains(t, cmd.Env, "GREETING=hello world")
+}
+
+func TestExecEnvTOMLDates(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keycloak-test-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "config.toml")
+	err = ioutil.WriteFile(file, []byte("[database]\npassword = \"super-secret-password1\"\nrotated = 2021-11-02\n"), 0600)
+	assert.Nil(t, err)
+
+	err = encrypt(file, []string{testRecipient}, "", false, "database", "")
+	assert.Nil(t, err)
+
+	cmd, err := buildCommandForExecEnv(file, []string{"../testdata/keys.age"}, false, "database", false)
+	assert.Nil(t, err)
+	assert.Contains(t, cmd.Env, "PASSWORD=super-secret-password1")
+	assert.Contains(t, cmd.Env, "ROTATED=2021-11-02")
+}
@@ -0,0 +1,105 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"filippo.io/age"
+	"github.com/spf13/cobra"
+)
+
+var (
+	keygenOutputParam string
+	keygenAppendParam bool
+)
+
+// keygenCmd represents the keygen command
+var keygenCmd = &cobra.Command{
+	Use:   "keygen",
+	Short: "Generate a new private key.",
+	Long: `Generates a new age private key, writes it to the key file and prints the corresponding public key.
+Without an output file the key is written to $XDG_CONFIG_HOME/keycloak/keys.txt where it's found by all other commands.
+Existing key files are never overwritten, use --append to add the new key to them.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		output, err := cmd.Flags().GetString("output")
+		if err != nil {
+			return err
+		}
+
+		appendKey, err := cmd.Flags().GetBool("append")
+		if err != nil {
+			return err
+		}
+
+		if output == "" {
+			paths := defaultKeyFiles()
+			if len(paths) == 0 {
+				return fmt.Errorf("cannot find default key file location, pass --output")
+			}
+			output = paths[0]
+		}
+
+		return keygen(cmd.OutOrStdout(), output, appendKey)
+	},
+}
+
+func keygen(w io.Writer, outputPath string, appendKey bool) error {
+	identity, err := age.GenerateX25519Identity()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(outputPath), 0700)
+	if err != nil {
+		return err
+	}
+
+	flags := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	var prefix string
+	if appendKey {
+		flags = os.O_WRONLY | os.O_CREATE | os.O_APPEND
+		bites, err := ioutil.ReadFile(outputPath)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+
+		// start the new key on its own line
+		if len(bites) > 0 && !bytes.HasSuffix(bites, []byte("\n")) {
+			prefix = "\n"
+		}
+	}
+
+	fd, err := os.OpenFile(outputPath, flags, 0600)
+	if errors.Is(err, os.ErrExist) {
+		return fmt.Errorf("%s already exists, use --append to add the key to it", outputPath)
+	} else if err != nil {
+		return err
+	}
+
+	recipient := identity.Recipient().String()
+	_, err = fmt.Fprintf(fd, "%s# public key: %s\n%s\n", prefix, recipient, identity.String())
+	if err != nil {
+		fd.Close()
+		return err
+	}
+
+	err = fd.Close()
+	if err != nil {
+		return err
+	}
+
+	logVerbose("wrote key to %s", outputPath)
+	_, err = fmt.Fprintln(w, recipient)
+	return err
+}
+
+func init() {
+	rootCmd.AddCommand(keygenCmd)
+	keygenCmd.Flags().StringVarP(&keygenOutputParam, "output", "o", "", "the key file to write (defaults to $XDG_CONFIG_HOME/keycloak/keys.txt)")
+	keygenCmd.Flags().BoolVarP(&keygenAppendParam, "append", "a", false, "append the key to an existing key file")
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestKeygen(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keycloak-keygen-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "keycloak", "keys.txt")
+	var out bytes.Buffer
+	err = keygen(&out, keyFile, false)
+	assert.Nil(t, err)
+	recipient := strings.TrimSpace(out.String())
+	_, err = age.ParseX25519Recipient(recipient)
+	assert.Nil(t, err)
+
+	info, err := os.Stat(keyFile)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+
+	bites, err := ioutil.ReadFile(keyFile)
+	assert.Nil(t, err)
+	lines := strings.Split(strings.TrimSpace(string(bites)), "\n")
+	assert.Equal(t, 2, len(lines))
+	assert.Equal(t, "# public key: "+recipient, lines[0])
+	identity, err := age.ParseX25519Identity(lines[1])
+	assert.Nil(t, err)
+	assert.Equal(t, recipient, identity.Recipient().String())
+
+	// the generated key works with the other commands
+	dir2, file := copyToTempDir(t, "../testdata/creds1.yaml")
+	defer os.RemoveAll(dir2)
+	err = encrypt(file, []string{recipient}, "", false, "secrets", "")
+	assert.Nil(t, err)
+	m, err := decryptSubtree(file, []string{keyFile}, false, []string{"secrets"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password1", m["secret-name1"])
+}
+
+func TestKeygenAppend(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keycloak-keygen-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	keyFile := filepath.Join(dir, "keys.txt")
+	err = ioutil.WriteFile(keyFile, []byte("AGE-SECRET-KEY-1C2JYKATVQLH8LLLZRNCS02SH457T9GLVYJ9KQ6DL9MGL7HD8QH4SJCS3CP"), 0600)
+	assert.Nil(t, err)
+
+	// existing key files aren't overwritten
+	var out bytes.Buffer
+	err = keygen(&out, keyFile, false)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, out.Len())
+
+	err = keygen(&out, keyFile, true)
+	assert.Nil(t, err)
+	key, err := getKey([]string{keyFile}, false)
+	assert.Nil(t, err)
+	keys := strings.Split(key, "\n")
+	assert.Equal(t, 2, len(keys))
+	assert.Equal(t, "AGE-SECRET-KEY-1C2JYKATVQLH8LLLZRNCS02SH457T9GLVYJ9KQ6DL9MGL7HD8QH4SJCS3CP", keys[0])
+	identity, err := age.ParseX25519Identity(keys[1])
+	assert.Nil(t, err)
+	assert.Equal(t, strings.TrimSpace(out.String()), identity.Recipient().String())
+}
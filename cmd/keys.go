@@ -0,0 +1,144 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	keyFileEnv = "KEYCLOAK_KEY_FILE"
+	ageKeyEnv  = "AGE_KEY"
+)
+
+// verboseOut receives the output of --verbose
+var verboseOut io.Writer = os.Stderr
+
+func logVerbose(format string, args ...interface{}) {
+	if verbose {
+		fmt.Fprintf(verboseOut, format+"\n", args...)
+	}
+}
+
+// getKey returns the private keys of the first of these sources that is set:
+//  1. the key files passed with --key
+//  2. the key file in $KEYCLOAK_KEY_FILE
+//  3. the keys in $AGE_KEY
+//  4. $XDG_CONFIG_HOME/keycloak/keys.txt (~/.config/keycloak/keys.txt by default)
+//  5. ~/.config/sops/age/keys.txt
+//
+// All identities are returned together, separated by newlines.
+func getKey(paths []string, deletePrivateKeyAfterUse bool) (string, error) {
+	if deletePrivateKeyAfterUse {
+		// only keys that were passed explicitly are deleted
+		defer func() {
+			for _, path := range paths {
+				_ = os.Remove(path)
+			}
+			_ = os.Setenv(ageKeyEnv, "")
+		}()
+	}
+
+	if len(paths) > 0 {
+		logVerbose("using keys from --key %s", strings.Join(paths, ", "))
+		return readKeyFiles(paths)
+	}
+
+	path := os.Getenv(keyFileEnv)
+	if path != "" {
+		logVerbose("using keys from $%s (%s)", keyFileEnv, path)
+		return readKeyFiles([]string{path})
+	}
+
+	v := os.Getenv(ageKeyEnv)
+	if v != "" {
+		logVerbose("using keys from $%s", ageKeyEnv)
+		return v, nil
+	}
+
+	for _, path := range defaultKeyFiles() {
+		_, err := os.Stat(path)
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+
+		logVerbose("using keys from %s", path)
+		return readKeyFiles([]string{path})
+	}
+	return "", fmt.Errorf("cannot find age key (pass --key or set $%s or $%s)", keyFileEnv, ageKeyEnv)
+}
+
+// defaultKeyFiles returns the key files that are tried
+// if no key was passed explicitly.
+func defaultKeyFiles() []string {
+	var paths []string
+	home, err := os.UserHomeDir()
+	configDir := os.Getenv("XDG_CONFIG_HOME")
+	if configDir == "" && err == nil {
+		configDir = filepath.Join(home, ".config")
+	}
+
+	if configDir != "" {
+		paths = append(paths, filepath.Join(configDir, "keycloak", "keys.txt"))
+	}
+
+	// sops keeps its age keys here
+	if err == nil {
+		paths = append(paths, filepath.Join(home, ".config", "sops", "age", "keys.txt"))
+	}
+	return paths
+}
+
+func readKeyFiles(paths []string) (string, error) {
+	keys := make([]string, len(paths))
+	for idx, path := range paths {
+		bites, err := ioutil.ReadFile(path)
+		if err != nil {
+			return "", err
+		}
+
+		keys[idx], err = readKeyFile(bites)
+		if err != nil {
+			return "", fmt.Errorf("%s: %s", path, err.Error())
+		}
+	}
+	return strings.Join(keys, "\n"), nil
+}
+
+// readKeyFile returns all age identities in a key file.
+// Other lines, e.g. comments and public keys, are skipped.
+func readKeyFile(bites []byte) (string, error) {
+	// SSH private keys are passed on as a whole
+	if bytes.Contains(bites, []byte("PRIVATE KEY-----")) {
+		return string(bites), nil
+	}
+
+	var keys []string
+	r := bufio.NewReader(bytes.NewBuffer(bites))
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "AGE-SECRET-KEY-1") {
+			keys = append(keys, line)
+		}
+
+		if err == io.EOF {
+			break
+		}
+	}
+
+	if len(keys) == 0 {
+		return "", fmt.Errorf("did not find a suitable private key")
+	}
+	return strings.Join(keys, "\n"), nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGetKeyMultipleFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "keycloak-keys-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	other, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	personal := filepath.Join(dir, "personal.txt")
+	err = ioutil.WriteFile(personal, []byte("# created: today\n# public key: "+other.Recipient().String()+"\n"+other.String()+"\n"), 0600)
+	assert.Nil(t, err)
+
+	key, err := getKey([]string{personal, "../testdata/keys.age"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, other.String()+"\nAGE-SECRET-KEY-1C2JYKATVQLH8LLLZRNCS02SH457T9GLVYJ9KQ6DL9MGL7HD8QH4SJCS3CP", key)
+
+	// the second key file decrypts the file
+	m, err := decryptSubtree("../testdata/creds1.enc.yaml", []string{personal, "../testdata/keys.age"}, false, []string{"secrets"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password1", m["secret-name1"])
+
+	// key files can be mixed with SSH keys
+	dir2, file := copyToTempDir(t, "../testdata/creds1.yaml")
+	defer os.RemoveAll(dir2)
+	err = encrypt(file, []string{other.Recipient().String()}, "", false, "secrets", "")
+	assert.Nil(t, err)
+	m, err = decryptSubtree(file, []string{"../testdata/id_ed25519", personal}, false, []string{"secrets"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password2", m["secret-name2"])
+
+	empty := filepath.Join(dir, "empty.txt")
+	err = ioutil.WriteFile(empty, []byte("# nothing here\n"), 0600)
+	assert.Nil(t, err)
+	_, err = getKey([]string{empty}, false)
+	assert.NotNil(t, err)
+}
+
+// isolateKeyLookup points the default key locations into an empty
+// directory and unsets all environment variables that hold keys.
+func isolateKeyLookup(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "keycloak-home-")
+	assert.Nil(t, err)
+
+	env := make(map[string]string)
+	for _, name := range []string{"HOME", "XDG_CONFIG_HOME", keyFileEnv, ageKeyEnv} {
+		env[name] = os.Getenv(name)
+		os.Unsetenv(name)
+	}
+	os.Setenv("HOME", dir)
+
+	return dir, func() {
+		for name, v := range env {
+			os.Setenv(name, v)
+		}
+		os.RemoveAll(dir)
+	}
+}
+
+func writeKeyFile(t *testing.T, path string) string {
+	identity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	err = os.MkdirAll(filepath.Dir(path), 0700)
+	assert.Nil(t, err)
+	err = ioutil.WriteFile(path, []byte(identity.String()+"\n"), 0600)
+	assert.Nil(t, err)
+	return identity.String()
+}
+
+func TestGetKeyLookupOrder(t *testing.T) {
+	home, restore := isolateKeyLookup(t)
+	defer restore()
+
+	var out bytes.Buffer
+	verbose = true
+	verboseOut = &out
+	defer func() {
+		verbose = false
+		verboseOut = os.Stderr
+	}()
+
+	_, err := getKey(nil, false)
+	assert.NotNil(t, err)
+
+	sopsKey := writeKeyFile(t, filepath.Join(home, ".config", "sops", "age", "keys.txt"))
+	key, err := getKey(nil, false)
+	assert.Nil(t, err)
+	assert.Equal(t, sopsKey, key)
+	assert.Contains(t, out.String(), "sops/age/keys.txt")
+
+	defaultKey := writeKeyFile(t, filepath.Join(home, ".config", "keycloak", "keys.txt"))
+	key, err = getKey(nil, false)
+	assert.Nil(t, err)
+	assert.Equal(t, defaultKey, key)
+
+	os.Setenv("XDG_CONFIG_HOME", filepath.Join(home, "xdg"))
+	xdgKey := writeKeyFile(t, filepath.Join(home, "xdg", "keycloak", "keys.txt"))
+	key, err = getKey(nil, false)
+	assert.Nil(t, err)
+	assert.Equal(t, xdgKey, key)
+
+	os.Setenv(ageKeyEnv, "AGE-SECRET-KEY-1C2JYKATVQLH8LLLZRNCS02SH457T9GLVYJ9KQ6DL9MGL7HD8QH4SJCS3CP")
+	out.Reset()
+	key, err = getKey(nil, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "AGE-SECRET-KEY-1C2JYKATVQLH8LLLZRNCS02SH457T9GLVYJ9KQ6DL9MGL7HD8QH4SJCS3CP", key)
+	assert.Equal(t, "using keys from $AGE_KEY\n", out.String())
+
+	envFile := filepath.Join(home, "env-keys.txt")
+	envKey := writeKeyFile(t, envFile)
+	os.Setenv(keyFileEnv, envFile)
+	key, err = getKey(nil, false)
+	assert.Nil(t, err)
+	assert.Equal(t, envKey, key)
+
+	out.Reset()
+	key, err = getKey([]string{"../testdata/keys.age"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "AGE-SECRET-KEY-1C2JYKATVQLH8LLLZRNCS02SH457T9GLVYJ9KQ6DL9MGL7HD8QH4SJCS3CP", key)
+	assert.Equal(t, "using keys from --key ../testdata/keys.age\n", out.String())
+
+	// explicitly given key files must exist
+	_, err = getKey([]string{filepath.Join(home, "does-not-exist")}, false)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	kk "github.com/mhelmich/keycloak"
+	"golang.org/x/term"
+)
+
+// passphraseEnv is read before prompting for a passphrase.
+const passphraseEnv = "KEYCLOAK_PASSPHRASE"
+
+// readPassphrase and readSSHKeyPassphrase are replaced in tests
+var (
+	readPassphrase       = promptPassphrase
+	readSSHKeyPassphrase = readPassword
+)
+
+// decrypter decrypts a subtree of a store either with a private key or a passphrase.
+type decrypter func(store kk.Store, path ...string) error
+
+// getDecrypter reads the private key or the passphrase
+// depending on usePassphrase.
+func getDecrypter(keyFiles []string, usePassphrase bool, deletePrivateKeyAfterUse bool) (decrypter, error) {
+	if usePassphrase {
+		passphrase, err := getPassphrase(false)
+		if err != nil {
+			return nil, err
+		}
+
+		return func(store kk.Store, path ...string) error {
+			return store.DecryptSubtreeWithPassphrase(passphrase, path...)
+		}, nil
+	}
+
+	key, err := getKey(keyFiles, deletePrivateKeyAfterUse)
+	if err != nil {
+		return nil, err
+	}
+
+	return func(store kk.Store, path ...string) error {
+		return store.DecryptSubtree(key, path...)
+	}, nil
+}
+
+// getPassphrase reads the passphrase from the environment
+// or prompts for it on the terminal.
+func getPassphrase(confirm bool) (string, error) {
+	v := os.Getenv(passphraseEnv)
+	if v != "" {
+		return v, nil
+	}
+
+	return readPassphrase(confirm)
+}
+
+func promptPassphrase(confirm bool) (string, error) {
+	passphrase, err := readPassword("Enter passphrase: ")
+	if err != nil {
+		return "", fmt.Errorf("%s (set %s instead)", err.Error(), passphraseEnv)
+	}
+
+	if len(passphrase) == 0 {
+		return "", fmt.Errorf("passphrase must not be empty")
+	}
+
+	if confirm {
+		again, err := readPassword("Confirm passphrase: ")
+		if err != nil {
+			return "", err
+		}
+
+		if string(again) != string(passphrase) {
+			return "", fmt.Errorf("passphrases don't match")
+		}
+	}
+	return string(passphrase), nil
+}
+
+// promptSSHKeyPassphrase asks for the passphrase of an encrypted SSH key.
+// Passphrases that decrypted a key are remembered for subtrees that are
+// decrypted later on. A wrong passphrase is forgotten right away.
+func promptSSHKeyPassphrase() func(check func([]byte) bool) ([]byte, error) {
+	var passphrases [][]byte
+	return func(check func([]byte) bool) ([]byte, error) {
+		for _, passphrase := range passphrases {
+			if check(passphrase) {
+				return passphrase, nil
+			}
+		}
+
+		passphrase, err := readSSHKeyPassphrase("Enter passphrase for SSH key: ")
+		if err != nil {
+			return nil, err
+		}
+
+		if !check(passphrase) {
+			return nil, fmt.Errorf("incorrect passphrase for SSH key")
+		}
+		passphrases = append(passphrases, passphrase)
+		return passphrase, nil
+	}
+}
+
+// readPassword prompts for a password on the terminal without echoing it.
+func readPassword(prompt string) ([]byte, error) {
+	fd := int(os.Stdin.Fd())
+	if !term.IsTerminal(fd) {
+		return nil, fmt.Errorf("cannot prompt for passphrase, stdin is not a terminal")
+	}
+
+	fmt.Fprint(os.Stderr, prompt)
+	bites, err := term.ReadPassword(fd)
+	fmt.Fprintln(os.Stderr)
+	return bites, err
+}
+
+func init() {
+	kk.SSHKeyPassphrase = promptSSHKeyPassphrase()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func stubPassphrase(passphrase string) func() {
+	readPassphrase = func(confirm bool) (string, error) {
+		return passphrase, nil
+	}
+	return func() {
+		readPassphrase = promptPassphrase
+	}
+}
+
+func TestPassphraseFromEnv(t *testing.T) {
+	dir, file := copyToTempDir(t, "../testdata/creds1.yaml")
+	defer os.RemoveAll(dir)
+
+	os.Setenv(passphraseEnv, "correct horse battery staple")
+	defer os.Unsetenv(passphraseEnv)
+	err := encrypt(file, nil, "", true, "secrets", "")
+	assert.Nil(t, err)
+
+	m, err := decryptSubtree(file, nil, true, []string{"secrets"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password1", m["secret-name1"])
+
+	// the private key doesn't help
+	_, err = decryptSubtree(file, []string{"../testdata/keys.age"}, false, []string{"secrets"}, false)
+	assert.NotNil(t, err)
+}
+
+func TestPassphrasePrompt(t *testing.T) {
+	dir, file := copyToTempDir(t, "../testdata/creds1.yaml")
+	defer os.RemoveAll(dir)
+
+	restore := stubPassphrase("correct horse battery staple")
+	defer restore()
+	err := encrypt(file, nil, "", true, "secrets", "")
+	assert.Nil(t, err)
+
+	stubPassphrase("wrong passphrase")
+	_, err = decryptSubtree(file, nil, true, []string{"secrets"}, false)
+	assert.NotNil(t, err)
+
+	stubPassphrase("correct horse battery staple")
+	m, err := decryptSubtree(file, nil, true, []string{"secrets"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password3", m["secret-name3"])
+}
+
+func TestPassphraseWithRecipients(t *testing.T) {
+	dir, file := copyToTempDir(t, "../testdata/creds1.yaml")
+	defer os.RemoveAll(dir)
+
+	restore := stubPassphrase("correct horse battery staple")
+	defer restore()
+	err := encrypt(file, []string{testRecipient}, "", true, "secrets", "")
+	assert.NotNil(t, err)
+}
+
+func TestSSHKeyPassphraseCache(t *testing.T) {
+	answers := []string{"wrong", "keycloak", "unused"}
+	readSSHKeyPassphrase = func(prompt string) ([]byte, error) {
+		answer := answers[0]
+		answers = answers[1:]
+		return []byte(answer), nil
+	}
+	defer func() {
+		readSSHKeyPassphrase = readPassword
+	}()
+
+	check := func(passphrase []byte) bool {
+		return string(passphrase) == "keycloak"
+	}
+	prompt := promptSSHKeyPassphrase()
+
+	// a wrong passphrase isn't remembered
+	_, err := prompt(check)
+	assert.NotNil(t, err)
+
+	passphrase, err := prompt(check)
+	assert.Nil(t, err)
+	assert.Equal(t, "keycloak", string(passphrase))
+
+	passphrase, err = prompt(check)
+	assert.Nil(t, err)
+	assert.Equal(t, "keycloak", string(passphrase))
+	assert.Equal(t, []string{"unused"}, answers)
+}
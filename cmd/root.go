@@ -15,7 +15,15 @@ var rootCmd = &cobra.Command{
 	Use:   "keycloak",
 	Short: "keycloak is a tool that enables a gitops approach for secrets.",
 	Long: `keycloak is a tool that enables a gitops approach for secrets.
-	This tool takes in a private key, a secrets file, decrypts the secrets using the private key and starts a child process with the secrets in the environment.`,
+	This tool takes in a private key, a secrets file, decrypts the secrets using the private key and starts a child process with the secrets in the environment.
+
+	Private keys are taken from the first of these sources that is set:
+	  1. the key files passed with --key
+	  2. the key file in $KEYCLOAK_KEY_FILE
+	  3. the keys in $AGE_KEY
+	  4. $XDG_CONFIG_HOME/keycloak/keys.txt (~/.config/keycloak/keys.txt by default)
+	  5. ~/.config/sops/age/keys.txt
+	Use --verbose to print which source was used.`,
 }
 
 // execute adds all child commands to the root command and sets flags appropriately.
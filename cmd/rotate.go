@@ -0,0 +1,84 @@
+package main
+
+import (
+	"path/filepath"
+
+	kk "github.com/mhelmich/keycloak"
+	"github.com/spf13/cobra"
+)
+
+var (
+	rotateFileParam       string
+	rotateKeyFileParam    []string
+	rotatePassphraseParam bool
+)
+
+// rotateCmd represents the rotate command
+var rotateCmd = &cobra.Command{
+	Use:   "rotate",
+	Short: "Re-encrypt all secrets in a file with fresh keys.",
+	Long: `Decrypts every encrypted subtree in the file in memory and encrypts it again with fresh keys
+for the recipients recorded in the file. The file is replaced atomically.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, err := cmd.Flags().GetString("file")
+		if err != nil {
+			return err
+		}
+
+		file, err = filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+
+		keyFiles, err := cmd.Flags().GetStringArray("key")
+		if err != nil {
+			return err
+		}
+
+		usePassphrase, err := cmd.Flags().GetBool("passphrase")
+		if err != nil {
+			return err
+		}
+
+		return rotate(file, keyFiles, usePassphrase)
+	},
+}
+
+func rotate(filePath string, keyFiles []string, usePassphrase bool) error {
+	store, err := kk.GetStoreForFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	if usePassphrase {
+		passphrase, err := getPassphrase(false)
+		if err != nil {
+			return err
+		}
+
+		err = store.RotateWithPassphrase(passphrase)
+		if err != nil {
+			return err
+		}
+	} else {
+		key, err := getKey(keyFiles, false)
+		if err != nil {
+			return err
+		}
+
+		err = store.Rotate(key)
+		if err != nil {
+			return err
+		}
+	}
+
+	return store.ToFile(filePath)
+}
+
+func init() {
+	rootCmd.AddCommand(rotateCmd)
+	rotateCmd.Flags().StringVarP(&rotateFileParam, "file", "f", "", "the secrets file to rotate (required)")
+	_ = rotateCmd.MarkFlagRequired("file")
+	rotateCmd.Flags().StringArrayVarP(&rotateKeyFileParam, "key", "k", []string{}, "a private key file to read (can be repeated)")
+	rotateCmd.Flags().BoolVar(&rotatePassphraseParam, "passphrase", false, "rotate subtrees encrypted with a passphrase instead of a private key (read from $KEYCLOAK_PASSPHRASE or prompted for)")
+}
@@ -0,0 +1,82 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	kk "github.com/mhelmich/keycloak"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotateBasic(t *testing.T) {
+	dir, file := copyToTempDir(t, "../testdata/creds2.json")
+	defer os.RemoveAll(dir)
+
+	err := encrypt(file, []string{testRecipient}, "", false, "secrets.dev", "")
+	assert.Nil(t, err)
+	err = encrypt(file, []string{testRecipient}, "", false, "secrets.prod", "")
+	assert.Nil(t, err)
+
+	before, err := kk.GetStoreForFile(file)
+	assert.Nil(t, err)
+	dev, err := before.Subtree("secrets", "dev")
+	assert.Nil(t, err)
+
+	err = rotate(file, []string{"../testdata/keys.age"}, false)
+	assert.Nil(t, err)
+
+	after, err := kk.GetStoreForFile(file)
+	assert.Nil(t, err)
+	dev2, err := after.Subtree("secrets", "dev")
+	assert.Nil(t, err)
+	assert.NotEqual(t, dev["secret-name1"], dev2["secret-name1"])
+
+	m, err := decryptSubtree(file, []string{"../testdata/keys.age"}, false, []string{"secrets", "prod"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password7", m["secret-name7"])
+
+	// no temporary files are left behind
+	files, err := ioutil.ReadDir(dir)
+	assert.Nil(t, err)
+	assert.Equal(t, 1, len(files))
+}
+
+func TestRotateLegacyFile(t *testing.T) {
+	dir, file := copyToTempDir(t, "../testdata/creds1.enc.yaml")
+	defer os.RemoveAll(dir)
+
+	err := rotate(file, []string{"../testdata/keys.age"}, false)
+	assert.NotNil(t, err)
+
+	before, err := ioutil.ReadFile("../testdata/creds1.enc.yaml")
+	assert.Nil(t, err)
+	after, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	assert.Equal(t, before, after)
+}
+
+func TestRotatePassphrase(t *testing.T) {
+	dir, file := copyToTempDir(t, "../testdata/creds1.yaml")
+	defer os.RemoveAll(dir)
+
+	os.Setenv(passphraseEnv, "correct horse battery staple")
+	defer os.Unsetenv(passphraseEnv)
+	err := encrypt(file, nil, "", true, "secrets", "")
+	assert.Nil(t, err)
+
+	before, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	err = rotate(file, []string{"../testdata/keys.age"}, false)
+	assert.NotNil(t, err)
+
+	err = rotate(file, nil, true)
+	assert.Nil(t, err)
+	after, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	assert.NotEqual(t, before, after)
+
+	m, err := decryptSubtree(file, nil, true, []string{"secrets"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password1", m["secret-name1"])
+}
@@ -0,0 +1,152 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+
+	kk "github.com/mhelmich/keycloak"
+	"github.com/spf13/cobra"
+)
+
+var (
+	updateRecipientsFileParam           string
+	updateRecipientsKeyFileParam        []string
+	updateRecipientsPassphraseParam     bool
+	updateRecipientsRecipientsParam     []string
+	updateRecipientsRecipientsFileParam string
+	updateRecipientsRotateParam         bool
+)
+
+// updateRecipientsCmd represents the update-recipients command
+var updateRecipientsCmd = &cobra.Command{
+	Use:     "update-recipients",
+	Aliases: []string{"updatekeys"},
+	Short:   "Change who can decrypt a secrets file.",
+	Long: `Makes all encrypted subtrees in the file readable by exactly the given recipients.
+The keys of all values are re-wrapped in memory, no plaintext is written to disk.
+
+Re-wrapping keeps the existing data keys. A removed recipient who kept a copy of the file
+can still unwrap them and decrypt the current values as well as values that are edited later.
+Pass --rotate to re-encrypt all values with fresh keys before re-wrapping them.`,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		file, err := cmd.Flags().GetString("file")
+		if err != nil {
+			return err
+		}
+
+		file, err = filepath.Abs(file)
+		if err != nil {
+			return err
+		}
+
+		keyFiles, err := cmd.Flags().GetStringArray("key")
+		if err != nil {
+			return err
+		}
+
+		recipients, err := cmd.Flags().GetStringArray("recipient")
+		if err != nil {
+			return err
+		}
+
+		recipientsFile, err := cmd.Flags().GetString("recipients-file")
+		if err != nil {
+			return err
+		}
+
+		usePassphrase, err := cmd.Flags().GetBool("passphrase")
+		if err != nil {
+			return err
+		}
+
+		rotateKeys, err := cmd.Flags().GetBool("rotate")
+		if err != nil {
+			return err
+		}
+
+		return updateRecipients(cmd.OutOrStdout(), file, keyFiles, usePassphrase, recipients, recipientsFile, rotateKeys)
+	},
+}
+
+func updateRecipients(w io.Writer, filePath string, keyFiles []string, usePassphrase bool, recipients []string, recipientsFile string, rotateKeys bool) error {
+	rs, err := getRecipients(recipients, recipientsFile)
+	if err != nil {
+		return err
+	}
+
+	store, err := kk.GetStoreForFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	var added []string
+	var removed []string
+	if usePassphrase {
+		passphrase, err := getPassphrase(false)
+		if err != nil {
+			return err
+		}
+
+		// rotate while the old recipients can still decrypt the file
+		if rotateKeys {
+			err = store.RotateWithPassphrase(passphrase)
+			if err != nil {
+				return err
+			}
+		}
+
+		added, removed, err = store.UpdateRecipientsWithPassphrase(passphrase, rs)
+		if err != nil {
+			return err
+		}
+	} else {
+		key, err := getKey(keyFiles, false)
+		if err != nil {
+			return err
+		}
+
+		if rotateKeys {
+			err = store.Rotate(key)
+			if err != nil {
+				return err
+			}
+		}
+
+		added, removed, err = store.UpdateRecipients(key, rs)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = store.ToFile(filePath)
+	if err != nil {
+		return err
+	}
+
+	if len(added) == 0 && len(removed) == 0 {
+		fmt.Fprintln(w, "no changes")
+		return nil
+	}
+	for _, r := range added {
+		fmt.Fprintf(w, "added: %s\n", r)
+	}
+	for _, r := range removed {
+		fmt.Fprintf(w, "removed: %s\n", r)
+	}
+	if len(removed) > 0 && !rotateKeys {
+		fmt.Fprintln(w, "warning: removed recipients can still decrypt the file with the keys they had, use --rotate to re-encrypt it with fresh keys")
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(updateRecipientsCmd)
+	updateRecipientsCmd.Flags().StringVarP(&updateRecipientsFileParam, "file", "f", "", "the secrets file to update (required)")
+	_ = updateRecipientsCmd.MarkFlagRequired("file")
+	updateRecipientsCmd.Flags().StringArrayVarP(&updateRecipientsKeyFileParam, "key", "k", []string{}, "a private key file to read (can be repeated)")
+	updateRecipientsCmd.Flags().BoolVar(&updateRecipientsPassphraseParam, "passphrase", false, "re-wrap subtrees encrypted with a passphrase instead of a private key (read from $KEYCLOAK_PASSPHRASE or prompted for)")
+	updateRecipientsCmd.Flags().StringArrayVarP(&updateRecipientsRecipientsParam, "recipient", "r", []string{}, "the public key of a recipient (can be repeated)")
+	updateRecipientsCmd.Flags().StringVarP(&updateRecipientsRecipientsFileParam, "recipients-file", "R", "", "a file containing one recipient per line")
+	updateRecipientsCmd.Flags().BoolVar(&updateRecipientsRotateParam, "rotate", false, "re-encrypt all values with fresh keys so that removed recipients can't decrypt them anymore")
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"bytes"
+	"os"
+	"testing"
+
+	"filippo.io/age"
+	kk "github.com/mhelmich/keycloak"
+	"github.com/stretchr/testify/assert"
+)
+
+const rotateWarning = "warning: removed recipients can still decrypt the file with the keys they had, use --rotate to re-encrypt it with fresh keys\n"
+
+func TestUpdateRecipientsBasic(t *testing.T) {
+	dir, file := copyToTempDir(t, "../testdata/creds1.yaml")
+	defer os.RemoveAll(dir)
+
+	other, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	err = encrypt(file, []string{other.Recipient().String()}, "", false, "secrets", "")
+	assert.Nil(t, err)
+
+	// only the other identity can decrypt the file
+	_, err = decryptSubtree(file, []string{"../testdata/keys.age"}, false, []string{"secrets"}, false)
+	assert.NotNil(t, err)
+
+	os.Setenv("AGE_KEY", other.String())
+	defer os.Unsetenv("AGE_KEY")
+	var out bytes.Buffer
+	err = updateRecipients(&out, file, nil, false, []string{testRecipient}, "", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "added: "+testRecipient+"\nremoved: "+other.Recipient().String()+"\n"+rotateWarning, out.String())
+
+	m, err := decryptSubtree(file, []string{"../testdata/keys.age"}, false, []string{"secrets"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password1", m["secret-name1"])
+}
+
+func TestUpdateRecipientsPassphrase(t *testing.T) {
+	dir, file := copyToTempDir(t, "../testdata/creds1.yaml")
+	defer os.RemoveAll(dir)
+
+	os.Setenv(passphraseEnv, "correct horse battery staple")
+	defer os.Unsetenv(passphraseEnv)
+	err := encrypt(file, nil, "", true, "secrets", "")
+	assert.Nil(t, err)
+
+	var out bytes.Buffer
+	err = updateRecipients(&out, file, nil, true, []string{testRecipient}, "", false)
+	assert.Nil(t, err)
+	assert.Equal(t, "added: "+testRecipient+"\nremoved: scrypt\n"+rotateWarning, out.String())
+
+	m, err := decryptSubtree(file, []string{"../testdata/keys.age"}, false, []string{"secrets"}, false)
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password1", m["secret-name1"])
+}
+
+func TestUpdateRecipientsRotate(t *testing.T) {
+	other, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	os.Setenv("AGE_KEY", other.String())
+	defer os.Unsetenv("AGE_KEY")
+
+	for _, rotateKeys := range []bool{false, true} {
+		dir, file := copyToTempDir(t, "../testdata/creds1.yaml")
+		defer os.RemoveAll(dir)
+		err = encrypt(file, []string{other.Recipient().String()}, "", false, "secrets", "")
+		assert.Nil(t, err)
+		before, err := kk.GetStoreForFile(file)
+		assert.Nil(t, err)
+
+		var out bytes.Buffer
+		err = updateRecipients(&out, file, nil, false, []string{testRecipient}, "", rotateKeys)
+		assert.Nil(t, err)
+
+		m, err := decryptSubtree(file, []string{"../testdata/keys.age"}, false, []string{"secrets"}, false)
+		assert.Nil(t, err)
+		assert.Equal(t, "super-secret-password1", m["secret-name1"])
+
+		// without --rotate the values keep their ciphertext and the removed recipient is warned about
+		after, err := kk.GetStoreForFile(file)
+		assert.Nil(t, err)
+		stBefore, err := before.Subtree("secrets")
+		assert.Nil(t, err)
+		stAfter, err := after.Subtree("secrets")
+		assert.Nil(t, err)
+		if rotateKeys {
+			assert.NotEqual(t, stBefore["secret-name1"], stAfter["secret-name1"])
+			assert.NotContains(t, out.String(), "warning")
+		} else {
+			assert.Equal(t, stBefore["secret-name1"], stAfter["secret-name1"])
+			assert.Contains(t, out.String(), rotateWarning)
+		}
+	}
+}
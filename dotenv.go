@@ -0,0 +1,389 @@
+package keycloak
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+var dotenvKey = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// dotenvLine is a line of a dotenv file. Comments and blank lines have no key.
+// A double quoted value can span several lines.
+type dotenvLine struct {
+	raw    string
+	key    string
+	value  string
+	export bool
+	quote  byte
+	// comment is whatever followed the value
+	comment string
+	// crlf is set if the line ended with \r\n
+	crlf bool
+}
+
+// newDotenvStore reads a file of KEY=value lines. Keys can only be defined
+// once.
+func newDotenvStore(bites []byte) (*dotenvStore, error) {
+	rawLines, trailingNewline := splitLines(bites)
+
+	// lines are parsed without their carriage returns
+	texts := make([]string, len(rawLines))
+	for idx, line := range rawLines {
+		texts[idx] = strings.TrimSuffix(line, "\r")
+	}
+
+	root := make(map[string]interface{})
+	defined := make(map[string]int)
+	var lines []*dotenvLine
+	for idx := 0; idx < len(texts); idx++ {
+		line, consumed, err := parseDotenvLine(texts[idx:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", idx+1, err.Error())
+		}
+		line.raw = strings.Join(rawLines[idx:idx+consumed], "\n")
+		line.crlf = strings.HasSuffix(line.raw, "\r")
+		lines = append(lines, line)
+
+		if line.key != "" {
+			if first, ok := defined[line.key]; ok {
+				return nil, fmt.Errorf("line %d: %s is already defined in line %d", idx+1, line.key, first)
+			}
+			defined[line.key] = idx + 1
+
+			v, err := parseFlatValue(line.key, line.value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", idx+1, err.Error())
+			}
+			root[line.key] = v
+		}
+		idx += consumed - 1
+	}
+
+	return &dotenvStore{
+		js: &jsonStore{
+			root:     root,
+			subtrees: make(map[string]*subtreeState),
+		},
+		lines:           lines,
+		trailingNewline: trailingNewline,
+		crlf:            len(rawLines) > 0 && strings.HasSuffix(rawLines[0], "\r"),
+	}, nil
+}
+
+type dotenvStore struct {
+	js *jsonStore
+	// lines are the lines of the file as it was read
+	lines           []*dotenvLine
+	trailingNewline bool
+	// crlf is set if new lines end with \r\n
+	crlf bool
+}
+
+func (s *dotenvStore) EncryptSubtree(recipient string, path ...string) error {
+	return s.js.EncryptSubtree(recipient, path...)
+}
+
+func (s *dotenvStore) EncryptSubtreeForRecipients(recipients []string, path ...string) error {
+	return s.js.EncryptSubtreeForRecipients(recipients, path...)
+}
+
+func (s *dotenvStore) EncryptSubtreeWithPassphrase(passphrase string, path ...string) error {
+	return s.js.EncryptSubtreeWithPassphrase(passphrase, path...)
+}
+
+func (s *dotenvStore) UpdateSubtree(recipients []string, path ...string) error {
+	return s.js.UpdateSubtree(recipients, path...)
+}
+
+func (s *dotenvStore) DecryptSubtree(identity string, path ...string) error {
+	return s.js.DecryptSubtree(identity, path...)
+}
+
+func (s *dotenvStore) DecryptSubtreeWithPassphrase(passphrase string, path ...string) error {
+	return s.js.DecryptSubtreeWithPassphrase(passphrase, path...)
+}
+
+func (s *dotenvStore) Rotate(identity string) error {
+	return s.js.Rotate(identity)
+}
+
+func (s *dotenvStore) RotateWithPassphrase(passphrase string) error {
+	return s.js.RotateWithPassphrase(passphrase)
+}
+
+func (s *dotenvStore) UpdateRecipients(identity string, recipients []string) ([]string, []string, error) {
+	return s.js.UpdateRecipients(identity, recipients)
+}
+
+func (s *dotenvStore) UpdateRecipientsWithPassphrase(passphrase string, recipients []string) ([]string, []string, error) {
+	return s.js.UpdateRecipientsWithPassphrase(passphrase, recipients)
+}
+
+func (s *dotenvStore) Subtree(path ...string) (map[string]interface{}, error) {
+	return s.js.Subtree(path...)
+}
+
+func (s *dotenvStore) Get(path ...string) (interface{}, error) {
+	return s.js.Get(path...)
+}
+
+func (s *dotenvStore) Set(value interface{}, path ...string) error {
+	return s.js.Set(value, path...)
+}
+
+func (s *dotenvStore) Delete(path ...string) error {
+	return s.js.Delete(path...)
+}
+
+func (s *dotenvStore) backingStore() *jsonStore {
+	return s.js
+}
+
+func (s *dotenvStore) ToFile(path string) error {
+	bites, err := s.bytes()
+	if err != nil {
+		return err
+	}
+
+	return writeFile(path, bites)
+}
+
+// bytes writes unchanged lines as they were read. Values that changed keep
+// their quoting and new values are appended in sorted order.
+func (s *dotenvStore) bytes() ([]byte, error) {
+	root, ok := s.js.root.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid document")
+	}
+
+	var out []string
+	written := make(map[string]bool, len(root))
+	for _, line := range s.lines {
+		if line.key == "" {
+			out = append(out, line.raw)
+			continue
+		}
+
+		v, ok := root[line.key]
+		if !ok {
+			continue
+		}
+
+		value, err := flatValue(line.key, v)
+		if err != nil {
+			return nil, err
+		}
+
+		written[line.key] = true
+		if value == line.value {
+			out = append(out, line.raw)
+			continue
+		}
+
+		prefix := ""
+		if line.export {
+			prefix = "export "
+		}
+		text := prefix + line.key + "=" + quoteDotenvValue(value, line.quote, true) + line.comment
+		out = append(out, dotenvLineEnding(text, line.crlf))
+	}
+
+	appended := false
+	for _, key := range sortedKeys(root) {
+		if written[key] {
+			continue
+		}
+
+		line, err := dotenvEntry(key, root[key])
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, dotenvLineEnding(line, s.crlf))
+		appended = true
+	}
+
+	return joinLines(out, s.trailingNewline || appended), nil
+}
+
+// MarshalDotenv encodes a document as returned by Store.Subtree as a dotenv
+// file. The document must not contain nested values.
+func MarshalDotenv(v map[string]interface{}) ([]byte, error) {
+	var sb strings.Builder
+	for _, key := range sortedKeys(v) {
+		line, err := dotenvEntry(key, v[key])
+		if err != nil {
+			return nil, err
+		}
+		sb.WriteString(line)
+		sb.WriteByte('\n')
+	}
+	return []byte(sb.String()), nil
+}
+
+func dotenvEntry(key string, v interface{}) (string, error) {
+	if !dotenvKey.MatchString(key) {
+		return "", fmt.Errorf("invalid key for a dotenv file: %s", key)
+	}
+
+	value, err := flatValue(key, v)
+	if err != nil {
+		return "", err
+	}
+	return key + "=" + quoteDotenvValue(value, 0, false), nil
+}
+
+// dotenvLineEnding adds the carriage returns of a file with \r\n line endings.
+func dotenvLineEnding(text string, crlf bool) string {
+	if !crlf {
+		return text
+	}
+	return strings.Replace(text, "\n", "\r\n", -1) + "\r"
+}
+
+// quoteDotenvValue quotes a value with the given quote if it needs to be
+// quoted or was quoted before. Values of existing lines that weren't quoted
+// stay unquoted as long as they can be read back, new values are only left
+// unquoted if they are safe to use in a shell. Single quotes are preferred for
+// new values because they don't need escaping. Double quoted values keep their
+// newlines.
+func quoteDotenvValue(value string, quote byte, existing bool) string {
+	needsQuotes := value != strings.TrimSpace(value) || strings.ContainsAny(value, " \t\r\n#'\"\\")
+	if existing {
+		needsQuotes = value != strings.TrimSpace(value) || strings.ContainsAny(value, "\r\n") ||
+			strings.IndexAny(value, "#'\"") == 0 || strings.Contains(value, " #")
+	}
+	if quote == 0 && !needsQuotes {
+		return value
+	}
+
+	singleQuotable := !strings.ContainsAny(value, "'\r\n")
+	if singleQuotable && (quote == '\'' || quote == 0) {
+		return "'" + value + "'"
+	}
+
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range value {
+		switch r {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\r':
+			sb.WriteString(`\r`)
+		case '\t':
+			sb.WriteString(`\t`)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// parseDotenvLine parses the first line and returns how many lines it consumed.
+func parseDotenvLine(lines []string) (*dotenvLine, int, error) {
+	text := strings.TrimLeft(lines[0], " \t")
+	if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+		return &dotenvLine{raw: lines[0]}, 1, nil
+	}
+
+	line := &dotenvLine{}
+	if strings.HasPrefix(text, "export ") {
+		line.export = true
+		text = strings.TrimLeft(strings.TrimPrefix(text, "export "), " \t")
+	}
+
+	idx := strings.IndexByte(text, '=')
+	if idx < 0 {
+		return nil, 0, fmt.Errorf("expected KEY=value")
+	}
+
+	line.key = strings.TrimSpace(text[:idx])
+	if !dotenvKey.MatchString(line.key) {
+		return nil, 0, fmt.Errorf("invalid key: %s", line.key)
+	}
+
+	rest := strings.TrimLeft(text[idx+1:], " \t")
+	consumed := 1
+	switch {
+	case strings.HasPrefix(rest, `"`):
+		// a double quoted value continues until the closing quote
+		line.quote = '"'
+		value, remainder, ok := unquoteDotenvValue(rest[1:])
+		for !ok && consumed < len(lines) {
+			rest += "\n" + lines[consumed]
+			consumed++
+			value, remainder, ok = unquoteDotenvValue(rest[1:])
+		}
+		if !ok {
+			return nil, 0, fmt.Errorf("unterminated quoted value")
+		}
+		line.value = value
+		rest = remainder
+
+	case strings.HasPrefix(rest, "'"):
+		line.quote = '\''
+		end := strings.IndexByte(rest[1:], '\'')
+		if end < 0 {
+			return nil, 0, fmt.Errorf("unterminated quoted value")
+		}
+		line.value = rest[1 : end+1]
+		rest = rest[end+2:]
+
+	default:
+		// an unquoted value ends at a comment
+		value := rest
+		rest = ""
+		if idx := strings.Index(value, " #"); idx >= 0 {
+			value, rest = value[:idx], value[idx:]
+		}
+		line.value = strings.TrimSpace(value)
+	}
+
+	if strings.TrimSpace(rest) != "" && !strings.HasPrefix(strings.TrimSpace(rest), "#") {
+		return nil, 0, fmt.Errorf("unexpected characters after value")
+	}
+	line.comment = strings.TrimRight(rest, " \t")
+
+	line.raw = strings.Join(lines[:consumed], "\n")
+	return line, consumed, nil
+}
+
+// unquoteDotenvValue reads a double quoted value up to its closing quote and
+// returns the value and whatever follows the closing quote.
+func unquoteDotenvValue(s string) (string, string, bool) {
+	var sb strings.Builder
+	for idx := 0; idx < len(s); idx++ {
+		switch s[idx] {
+		case '"':
+			return sb.String(), s[idx+1:], true
+
+		case '\\':
+			if idx+1 == len(s) {
+				sb.WriteByte('\\')
+				continue
+			}
+
+			idx++
+			switch s[idx] {
+			case 'n':
+				sb.WriteByte('\n')
+			case 'r':
+				sb.WriteByte('\r')
+			case 't':
+				sb.WriteByte('\t')
+			case '"', '\\':
+				sb.WriteByte(s[idx])
+			default:
+				sb.WriteByte('\\')
+				sb.WriteByte(s[idx])
+			}
+
+		default:
+			sb.WriteByte(s[idx])
+		}
+	}
+	return "", "", false
+}
@@ -0,0 +1,102 @@
+package keycloak
+
+import (
+	"encoding/base64"
+	"fmt"
+)
+
+// passphraseRecipient is recorded in the metadata of subtrees
+// that are encrypted with a passphrase.
+const passphraseRecipient = "scrypt"
+
+// newEnvelope generates a data key for a new subtree and metadata that
+// records the data key wrapped for all recipients.
+func newEnvelope(recipients []string) (*[32]byte, *metadata, error) {
+	wrapFunc, err := newAgeWrapFunction(recipients...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return newEnvelopeWithWrapFunction(recipients, wrapFunc)
+}
+
+// newPassphraseEnvelope works like newEnvelope but wraps
+// the data key with a passphrase.
+func newPassphraseEnvelope(passphrase string) (*[32]byte, *metadata, error) {
+	wrapFunc, err := newPassphraseWrapFunction(passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return newEnvelopeWithWrapFunction([]string{passphraseRecipient}, wrapFunc)
+}
+
+// newEnvelopeLike generates a new data key for a subtree that is wrapped the
+// same way as the data key of an existing subtree. Subtrees that were encrypted
+// with a passphrase need the passphrase for that.
+func newEnvelopeLike(old *metadata, passphrase string) (*[32]byte, *metadata, error) {
+	if !old.hasRecipients([]string{passphraseRecipient}) {
+		return newEnvelope(old.Recipients)
+	}
+
+	if passphrase == "" {
+		return nil, nil, fmt.Errorf("subtree is encrypted with a passphrase")
+	}
+
+	wrapFunc, err := newPassphraseWrapFunction(passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+	return newEnvelopeWithWrapFunction(old.Recipients, wrapFunc)
+}
+
+func newEnvelopeWithWrapFunction(recipients []string, wrapFunc encryptionFunc) (*[32]byte, *metadata, error) {
+	key := newEncryptionKey()
+	meta := newMetadata(recipients)
+	wrapped, err := wrapDataKey(key, wrapFunc)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	meta.DataKey = wrapped
+	return key, meta, nil
+}
+
+// wrapDataKey encrypts the data key of a subtree with wrapFunc.
+// The result is base64 encoded.
+func wrapDataKey(key *[32]byte, wrapFunc encryptionFunc) (string, error) {
+	bites, err := wrapFunc(key[:])
+	if err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(bites), nil
+}
+
+// unwrapDataKey is the inverse of wrapDataKey.
+func unwrapDataKey(wrapped string, unwrapFunc decryptionFunc) (*[32]byte, error) {
+	bites, err := base64.StdEncoding.DecodeString(wrapped)
+	if err != nil {
+		return nil, err
+	}
+
+	bites, err = unwrapFunc(bites)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(bites) != 32 {
+		return nil, fmt.Errorf("invalid data key")
+	}
+
+	key := [32]byte{}
+	copy(key[:], bites)
+	return &key, nil
+}
+
+// newDataKeyEncryptionFunction returns an encryptionFunc that encrypts
+// every value with AES-256-GCM under the data key of a subtree.
+func newDataKeyEncryptionFunction(key *[32]byte) encryptionFunc {
+	return func(bites []byte) ([]byte, error) {
+		return aesEncrypt(bites, key)
+	}
+}
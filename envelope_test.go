@@ -0,0 +1,181 @@
+package keycloak
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+)
+
+// bigDocument turns testdata/big into a document with a couple thousand secrets.
+func bigDocument(tb testing.TB) map[string]interface{} {
+	data, err := ioutil.ReadFile("testdata/big")
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	secrets := make(map[string]interface{})
+	for idx := 0; (idx+1)*256 <= len(data); idx++ {
+		secrets[fmt.Sprintf("secret-%04d", idx)] = base64.StdEncoding.EncodeToString(data[idx*256 : (idx+1)*256])
+	}
+	return map[string]interface{}{"secrets": secrets}
+}
+
+// encryptPerValueKey encrypts a subtree the way it was done before envelope encryption.
+func encryptPerValueKey(tb testing.TB, v map[string]interface{}, recipient string, workers int) {
+	ef, err := newAgeEncryptionFunction(recipient)
+	if err != nil {
+		tb.Fatal(err)
+	}
+
+	meta := newMetadata([]string{recipient})
+	meta.Version = formatVersionPerValueKey
+	meta.Cipher = cipherPerValueKey
+	err = encryptSubtree(v, ef, nil, meta, workers)
+	if err != nil {
+		tb.Fatal(err)
+	}
+}
+
+func TestEnvelopePerValueKeyFile(t *testing.T) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	doc := map[string]interface{}{
+		"secrets": map[string]interface{}{"db_password": "pw1", "port": json.Number("5432")},
+	}
+	encryptPerValueKey(t, doc["secrets"].(map[string]interface{}), ageIdentity.Recipient().String(), 0)
+	bites, err := json.Marshal(doc)
+	assert.Nil(t, err)
+
+	store, err := GetStoreFromBytes(bites, JSON)
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(ageIdentity.String(), "secrets")
+	assert.Nil(t, err)
+	st, err := store.Subtree("secrets")
+	assert.Nil(t, err)
+	assert.Equal(t, "pw1", st["db_password"])
+	assert.Equal(t, json.Number("5432"), st["port"])
+
+	// updating the subtree upgrades it
+	err = store.UpdateSubtree(nil, "secrets")
+	assert.Nil(t, err)
+	st, err = store.Subtree("secrets")
+	assert.Nil(t, err)
+	meta, err := parseMetadata(st["__keycloak__"])
+	assert.Nil(t, err)
+	assert.Equal(t, formatVersionEnvelope, meta.Version)
+
+	store, err = GetStoreFromBytes(mustBytes(t, store), JSON)
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(ageIdentity.String(), "secrets")
+	assert.Nil(t, err)
+	v, err := store.Get("secrets", "db_password")
+	assert.Nil(t, err)
+	assert.Equal(t, "pw1", v)
+}
+
+func TestEnvelopeSize(t *testing.T) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	perValueKey := bigDocument(t)
+	encryptPerValueKey(t, perValueKey["secrets"].(map[string]interface{}), ageIdentity.Recipient().String(), 0)
+	perValueKeyBites, err := json.Marshal(perValueKey)
+	assert.Nil(t, err)
+
+	store, err := GetStoreFromBytes([]byte("{}"), JSON)
+	assert.Nil(t, err)
+	err = store.Set(bigDocument(t))
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "secrets")
+	assert.Nil(t, err)
+	envelopeBites := mustBytes(t, store)
+
+	// every value saves the age header of its own key
+	secrets := len(perValueKey["secrets"].(map[string]interface{}))
+	assert.Greater(t, len(perValueKeyBites)-len(envelopeBites), 200*secrets)
+}
+
+func BenchmarkEncryptPerValueKey(b *testing.B) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		doc := bigDocument(b)
+		b.StartTimer()
+		encryptPerValueKey(b, doc["secrets"].(map[string]interface{}), ageIdentity.Recipient().String(), 0)
+	}
+}
+
+func BenchmarkEncryptEnvelope(b *testing.B) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		store := &jsonStore{root: bigDocument(b), subtrees: make(map[string]*subtreeState)}
+		b.StartTimer()
+		err = store.EncryptSubtree(ageIdentity.Recipient().String(), "secrets")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecryptPerValueKey(b *testing.B) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	doc := bigDocument(b)
+	encryptPerValueKey(b, doc["secrets"].(map[string]interface{}), ageIdentity.Recipient().String(), 0)
+	benchmarkDecrypt(b, doc, ageIdentity.String(), 0)
+}
+
+func BenchmarkDecryptEnvelope(b *testing.B) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	store := &jsonStore{root: bigDocument(b), subtrees: make(map[string]*subtreeState)}
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "secrets")
+	if err != nil {
+		b.Fatal(err)
+	}
+	benchmarkDecrypt(b, store.root, ageIdentity.String(), 0)
+}
+
+func benchmarkDecrypt(b *testing.B, doc interface{}, identity string, workers int) {
+	bites, err := json.Marshal(doc)
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		b.StopTimer()
+		store, err := newJSONStore(bites)
+		if err != nil {
+			b.Fatal(err)
+		}
+		store.parallelism = workers
+		b.StartTimer()
+
+		err = store.DecryptSubtree(identity, "secrets")
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,466 @@
+package keycloak
+
+import (
+	"fmt"
+	"strings"
+)
+
+// iniLine is a line of an ini file. Comments and blank lines have neither a
+// key nor a header.
+type iniLine struct {
+	raw string
+	// section is the section the line belongs to, it's empty for
+	// lines in front of the first section header
+	section string
+	header  bool
+	key     string
+	value   string
+	// prefix is everything in front of the value
+	prefix string
+	quoted bool
+}
+
+// newINIStore reads an ini file. Keys in front of the first section become
+// top-level values and every section becomes a subtree. The values of keys
+// that are repeated within a section, e.g. hosts[] in PHP, become lists.
+func newINIStore(bites []byte) (*iniStore, error) {
+	rawLines, trailingNewline := splitLines(bites)
+
+	root := make(map[string]interface{})
+	var lines []*iniLine
+	section := ""
+	for idx, raw := range rawLines {
+		line, err := parseINILine(raw, section)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", idx+1, err.Error())
+		}
+		lines = append(lines, line)
+
+		if line.header {
+			section = line.section
+			v, ok := root[section]
+			if !ok {
+				root[section] = make(map[string]interface{})
+			} else if !isINISection(section, v) {
+				return nil, fmt.Errorf("line %d: section %s conflicts with a key", idx+1, section)
+			}
+		}
+
+		if line.key == "" {
+			continue
+		}
+
+		target := iniSection(root, section)
+		v, err := parseFlatValue(line.key, line.value)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", idx+1, err.Error())
+		}
+
+		switch existing := target[line.key].(type) {
+		case nil:
+			target[line.key] = v
+		case []interface{}:
+			target[line.key] = append(existing, v)
+		case string:
+			target[line.key] = []interface{}{existing, v}
+		default:
+			return nil, fmt.Errorf("line %d: %s is already defined", idx+1, line.key)
+		}
+	}
+
+	return &iniStore{
+		js: &jsonStore{
+			root:     root,
+			subtrees: make(map[string]*subtreeState),
+		},
+		lines:           lines,
+		trailingNewline: trailingNewline,
+	}, nil
+}
+
+type iniStore struct {
+	js *jsonStore
+	// lines are the lines of the file as it was read
+	lines           []*iniLine
+	trailingNewline bool
+}
+
+func (s *iniStore) EncryptSubtree(recipient string, path ...string) error {
+	return s.js.EncryptSubtree(recipient, path...)
+}
+
+func (s *iniStore) EncryptSubtreeForRecipients(recipients []string, path ...string) error {
+	return s.js.EncryptSubtreeForRecipients(recipients, path...)
+}
+
+func (s *iniStore) EncryptSubtreeWithPassphrase(passphrase string, path ...string) error {
+	return s.js.EncryptSubtreeWithPassphrase(passphrase, path...)
+}
+
+func (s *iniStore) UpdateSubtree(recipients []string, path ...string) error {
+	return s.js.UpdateSubtree(recipients, path...)
+}
+
+func (s *iniStore) DecryptSubtree(identity string, path ...string) error {
+	return s.js.DecryptSubtree(identity, path...)
+}
+
+func (s *iniStore) DecryptSubtreeWithPassphrase(passphrase string, path ...string) error {
+	return s.js.DecryptSubtreeWithPassphrase(passphrase, path...)
+}
+
+func (s *iniStore) Rotate(identity string) error {
+	return s.js.Rotate(identity)
+}
+
+func (s *iniStore) RotateWithPassphrase(passphrase string) error {
+	return s.js.RotateWithPassphrase(passphrase)
+}
+
+func (s *iniStore) UpdateRecipients(identity string, recipients []string) ([]string, []string, error) {
+	return s.js.UpdateRecipients(identity, recipients)
+}
+
+func (s *iniStore) UpdateRecipientsWithPassphrase(passphrase string, recipients []string) ([]string, []string, error) {
+	return s.js.UpdateRecipientsWithPassphrase(passphrase, recipients)
+}
+
+func (s *iniStore) Subtree(path ...string) (map[string]interface{}, error) {
+	return s.js.Subtree(path...)
+}
+
+func (s *iniStore) Get(path ...string) (interface{}, error) {
+	return s.js.Get(path...)
+}
+
+func (s *iniStore) Set(value interface{}, path ...string) error {
+	return s.js.Set(value, path...)
+}
+
+func (s *iniStore) Delete(path ...string) error {
+	return s.js.Delete(path...)
+}
+
+func (s *iniStore) backingStore() *jsonStore {
+	return s.js
+}
+
+func (s *iniStore) ToFile(path string) error {
+	bites, err := s.bytes()
+	if err != nil {
+		return err
+	}
+
+	return writeFile(path, bites)
+}
+
+// bytes writes unchanged lines as they were read. New keys are added at the
+// end of their section and new sections at the end of the file.
+func (s *iniStore) bytes() ([]byte, error) {
+	root, ok := s.js.root.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid document")
+	}
+
+	var out []*iniLine
+	written := make(map[string]map[string]bool)
+	// the lines of a repeated key take the elements of its list in order
+	occurrences := make(map[*iniLine]int)
+	counts := make(map[string]int)
+	last := make(map[string]*iniLine)
+	skip := false
+	for _, line := range s.lines {
+		if line.header {
+			_, ok := root[line.section].(map[string]interface{})
+			skip = !ok || line.section == "__keycloak__"
+			if !skip {
+				out = append(out, line)
+				if written[line.section] == nil {
+					written[line.section] = make(map[string]bool)
+				}
+			}
+			continue
+		}
+
+		if skip {
+			continue
+		}
+
+		if line.key == "" {
+			out = append(out, line)
+			continue
+		}
+
+		section := iniSection(root, line.section)
+		v, ok := section[line.key]
+		if !ok || (line.section == "" && isINISection(line.key, v)) {
+			continue
+		}
+
+		id := line.section + "\x00" + line.key
+		occurrence := counts[id]
+		counts[id]++
+		if a, ok := v.([]interface{}); ok {
+			if occurrence >= len(a) {
+				continue
+			}
+			v = a[occurrence]
+		} else if occurrence > 0 {
+			continue
+		}
+
+		value, err := flatValue(line.key, v)
+		if err != nil {
+			return nil, err
+		}
+
+		if written[line.section] == nil {
+			written[line.section] = make(map[string]bool)
+		}
+		written[line.section][line.key] = true
+
+		last[id] = line
+		if value == line.value {
+			occurrences[line] = len(out)
+			out = append(out, line)
+			continue
+		}
+
+		quoted, err := quoteINIValue(value, line.quoted)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", line.key, err.Error())
+		}
+		occurrences[line] = len(out)
+		out = append(out, &iniLine{raw: line.prefix + quoted, section: line.section, key: line.key})
+	}
+
+	// new elements of lists follow the last line of their key
+	insertions := make(map[int][]string)
+	for id, line := range last {
+		a, ok := iniSection(root, line.section)[line.key].([]interface{})
+		if !ok {
+			continue
+		}
+
+		pos := occurrences[line]
+		for _, v := range a[counts[id]:] {
+			value, err := flatValue(line.key, v)
+			if err != nil {
+				return nil, err
+			}
+
+			quoted, err := quoteINIValue(value, line.quoted)
+			if err != nil {
+				return nil, fmt.Errorf("%s: %s", line.key, err.Error())
+			}
+			insertions[pos] = append(insertions[pos], line.prefix+quoted)
+		}
+	}
+
+	// new keys of existing sections follow the last line of their section,
+	// new top-level keys follow the last top-level key or open the file
+	for _, name := range append([]string{""}, sortedKeys(root)...) {
+		section := iniSection(root, name)
+		if section == nil || (name != "" && written[name] == nil) {
+			continue
+		}
+
+		var entries []string
+		for _, key := range sortedKeys(section) {
+			if written[name][key] || (name == "" && isINISection(key, section[key])) {
+				continue
+			}
+
+			lines, err := iniEntries(key, section[key])
+			if err != nil {
+				return nil, err
+			}
+			entries = append(entries, lines...)
+		}
+
+		if len(entries) > 0 {
+			pos := iniInsertPosition(out, name)
+			insertions[pos] = append(insertions[pos], entries...)
+		}
+	}
+
+	var texts []string
+	texts = append(texts, insertions[-1]...)
+	for idx, line := range out {
+		texts = append(texts, line.raw)
+		texts = append(texts, insertions[idx]...)
+	}
+
+	appended := len(insertions) > 0
+	for _, name := range sortedKeys(root) {
+		if written[name] != nil || !isINISection(name, root[name]) {
+			continue
+		}
+
+		if len(texts) > 0 && strings.TrimSpace(texts[len(texts)-1]) != "" {
+			texts = append(texts, "")
+		}
+
+		lines, err := iniSectionLines(name, root[name].(map[string]interface{}))
+		if err != nil {
+			return nil, err
+		}
+		texts = append(texts, lines...)
+		appended = true
+	}
+
+	return joinLines(texts, s.trailingNewline || appended), nil
+}
+
+// MarshalINI encodes a document as returned by Store.Subtree as an ini file.
+// Top-level values come first and sections must not contain nested values.
+func MarshalINI(v map[string]interface{}) ([]byte, error) {
+	var texts []string
+	for _, key := range sortedKeys(v) {
+		if isINISection(key, v[key]) {
+			continue
+		}
+
+		entries, err := iniEntries(key, v[key])
+		if err != nil {
+			return nil, err
+		}
+		texts = append(texts, entries...)
+	}
+
+	for _, key := range sortedKeys(v) {
+		if !isINISection(key, v[key]) {
+			continue
+		}
+
+		if len(texts) > 0 {
+			texts = append(texts, "")
+		}
+
+		lines, err := iniSectionLines(key, v[key].(map[string]interface{}))
+		if err != nil {
+			return nil, err
+		}
+		texts = append(texts, lines...)
+	}
+	return joinLines(texts, true), nil
+}
+
+func iniSectionLines(name string, section map[string]interface{}) ([]string, error) {
+	lines := []string{"[" + name + "]"}
+	for _, key := range sortedKeys(section) {
+		entries, err := iniEntries(key, section[key])
+		if err != nil {
+			return nil, fmt.Errorf("%s.%s", name, err.Error())
+		}
+		lines = append(lines, entries...)
+	}
+	return lines, nil
+}
+
+// iniEntries returns the lines of a key. Lists are written as repeated keys.
+func iniEntries(key string, v interface{}) ([]string, error) {
+	values := []interface{}{v}
+	if a, ok := v.([]interface{}); ok {
+		values = a
+	}
+
+	entries := make([]string, len(values))
+	for idx, v := range values {
+		value, err := flatValue(key, v)
+		if err != nil {
+			return nil, err
+		}
+
+		quoted, err := quoteINIValue(value, false)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %s", key, err.Error())
+		}
+		entries[idx] = key + " = " + quoted
+	}
+	return entries, nil
+}
+
+// iniSection returns the values of a section. The top-level values
+// are the section without a name.
+func iniSection(root map[string]interface{}, name string) map[string]interface{} {
+	if name == "" {
+		return root
+	}
+
+	section, _ := root[name].(map[string]interface{})
+	return section
+}
+
+// isINISection returns true if a top-level value is a section. The metadata of
+// an encrypted document is stored as a single value.
+func isINISection(key string, v interface{}) bool {
+	_, ok := v.(map[string]interface{})
+	return ok && key != "__keycloak__"
+}
+
+// iniInsertPosition returns the index of the line after which new keys of a
+// section are inserted. -1 means in front of the first line.
+func iniInsertPosition(out []*iniLine, section string) int {
+	pos := -1
+	for idx, line := range out {
+		if line.section == section && (line.header || line.key != "") {
+			pos = idx
+		}
+	}
+	return pos
+}
+
+// quoteINIValue quotes values with surrounding whitespace and values that
+// were quoted before.
+func quoteINIValue(value string, quoted bool) (string, error) {
+	if strings.ContainsAny(value, "\r\n") {
+		return "", fmt.Errorf("ini values can't span several lines")
+	}
+
+	looksQuoted := len(value) >= 2 && strings.HasPrefix(value, `"`) && strings.HasSuffix(value, `"`)
+	if quoted || looksQuoted || value != strings.TrimSpace(value) {
+		return `"` + value + `"`, nil
+	}
+	return value, nil
+}
+
+func parseINILine(raw string, section string) (*iniLine, error) {
+	trimmed := strings.TrimSpace(raw)
+	if trimmed == "" || strings.HasPrefix(trimmed, ";") || strings.HasPrefix(trimmed, "#") {
+		return &iniLine{raw: raw, section: section}, nil
+	}
+
+	if strings.HasPrefix(trimmed, "[") {
+		if !strings.HasSuffix(trimmed, "]") {
+			return nil, fmt.Errorf("invalid section header")
+		}
+
+		name := strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+		if name == "" {
+			return nil, fmt.Errorf("empty section name")
+		}
+		return &iniLine{raw: raw, section: name, header: true}, nil
+	}
+
+	idx := strings.IndexAny(raw, "=:")
+	if idx < 0 {
+		return nil, fmt.Errorf("expected key = value")
+	}
+
+	line := &iniLine{raw: raw, section: section}
+	line.key = strings.TrimSpace(raw[:idx])
+	if line.key == "" {
+		return nil, fmt.Errorf("empty key")
+	}
+
+	rest := raw[idx+1:]
+	valueStart := idx + 1 + len(rest) - len(strings.TrimLeft(rest, " \t"))
+	line.prefix = raw[:valueStart]
+	line.value = strings.TrimRight(raw[valueStart:], " \t")
+	if len(line.value) >= 2 && strings.HasPrefix(line.value, `"`) && strings.HasSuffix(line.value, `"`) {
+		line.value = line.value[1 : len(line.value)-1]
+		line.quoted = true
+	}
+	return line, nil
+}
@@ -0,0 +1,138 @@
+package keycloak
+
+import (
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestINIBasic(t *testing.T) {
+	bites, err := ioutil.ReadFile("testdata/app.ini")
+	assert.Nil(t, err)
+	store, err := newINIStore(bites)
+	assert.Nil(t, err)
+
+	st, err := store.Subtree()
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(st))
+	assert.Equal(t, "keycloak", st["name"])
+
+	db, err := store.Subtree("database")
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password1", db["password"])
+	assert.Equal(t, "admin", db["user"])
+
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "database")
+	assert.Nil(t, err)
+
+	encrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.NotContains(t, string(encrypted), "super-secret")
+	assert.Contains(t, string(encrypted), "; application settings\nname = keycloak\n")
+	assert.Contains(t, string(encrypted), "\n# credentials\npassword = \"")
+	assert.Contains(t, string(encrypted), "\n__keycloak__ = {")
+	assert.Contains(t, string(encrypted), "\n\n[server]\nport = 8080\n")
+
+	// the encrypted file can be read again
+	store, err = newINIStore(encrypted)
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(ageIdentity.String(), "database")
+	assert.Nil(t, err)
+
+	decrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, string(bites), string(decrypted))
+}
+
+func TestINISetAndDelete(t *testing.T) {
+	store, err := newINIStore([]byte("a = 1\n\n[s]\nb = 2\n\n[t]\nc = 3\n"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, store.Set("x", "top"))
+	assert.Nil(t, store.Set(" padded ", "s", "d"))
+	assert.Nil(t, store.Delete("t"))
+	assert.Nil(t, store.Set(map[string]interface{}{"e": "5"}, "u"))
+
+	bites, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, "a = 1\ntop = x\n\n[s]\nb = 2\nd = \" padded \"\n\n[u]\ne = 5\n", string(bites))
+
+	assert.Nil(t, store.Set("two\nlines", "a"))
+	_, err = store.bytes()
+	assert.NotNil(t, err)
+}
+
+func TestINIRepeatedKeys(t *testing.T) {
+	doc := "[db]\nhosts[] = db1\nport = 5432\nhosts[] = \"db2\"\n"
+	store, err := newINIStore([]byte(doc))
+	assert.Nil(t, err)
+
+	v, err := store.Get("db", "hosts[]")
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"db1", "db2"}, v)
+
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "db")
+	assert.Nil(t, err)
+	encrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.NotContains(t, string(encrypted), "db1")
+	assert.Equal(t, 2, strings.Count(string(encrypted), "hosts[] = "))
+
+	store, err = newINIStore(encrypted)
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(ageIdentity.String(), "db")
+	assert.Nil(t, err)
+	decrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, doc, string(decrypted))
+
+	// new elements follow the last line of the key
+	store, err = newINIStore([]byte(doc))
+	assert.Nil(t, err)
+	assert.Nil(t, store.Set([]interface{}{"db1", "db2", "db3"}, "db", "hosts[]"))
+	assert.Nil(t, store.Set([]interface{}{"a", "b"}, "db", "users[]"))
+	bites, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, "[db]\nhosts[] = db1\nport = 5432\nhosts[] = \"db2\"\nhosts[] = \"db3\"\nusers[] = a\nusers[] = b\n", string(bites))
+
+	assert.Nil(t, store.Set("db1", "db", "hosts[]"))
+	bites, err = store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, "[db]\nhosts[] = db1\nport = 5432\nusers[] = a\nusers[] = b\n", string(bites))
+}
+
+func TestINIInvalid(t *testing.T) {
+	invalid := []string{
+		"key",
+		"= value",
+		"[section",
+		"[]",
+		"a = 1\n[a]",
+		"__keycloak__ = not-json",
+		"__keycloak__ = {}\n__keycloak__ = {}",
+	}
+
+	for _, doc := range invalid {
+		_, err := newINIStore([]byte(doc))
+		assert.NotNil(t, err, doc)
+	}
+}
+
+func TestMarshalINI(t *testing.T) {
+	bites, err := MarshalINI(map[string]interface{}{
+		"b": map[string]interface{}{"y": "2", "x": true},
+		"a": "1",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "a = 1\n\n[b]\nx = true\ny = 2\n", string(bites))
+
+	_, err = MarshalINI(map[string]interface{}{"b": map[string]interface{}{"c": map[string]interface{}{}}})
+	assert.NotNil(t, err)
+}
@@ -3,170 +3,1305 @@ package keycloak
 import (
 	"bytes"
 	"crypto/hmac"
-	"crypto/sha512"
 	"encoding/base64"
 	"encoding/binary"
 	"encoding/json"
 	"fmt"
-	"io/ioutil"
+	"io"
 	"math"
 	"sort"
 	"strconv"
+	"strings"
+	"time"
 )
 
 type jsonDataType int8
 
 const (
 	stringType jsonDataType = 0
+	// numberType values are stored as 8 IEEE 754 bytes.
+	// They are only written for float64 values.
 	numberType jsonDataType = 1
+	boolType   jsonDataType = 2
+	nullType   jsonDataType = 3
+	// decimalType values are stored in their original textual representation.
+	decimalType jsonDataType = 4
+	// datetimeType values are TOML dates and times in their original
+	// textual representation.
+	datetimeType jsonDataType = 5
 )
 
+// Datetime is a TOML date, time or date and time in its original textual
+// representation. Get and Subtree return it for dates and times read from TOML
+// files. JSON and YAML documents represent it as a string.
+type Datetime string
+
 func newJSONStore(bites []byte) (*jsonStore, error) {
 	root := make(map[string]interface{})
-	err := json.Unmarshal(bites, &root)
+	err := unmarshalJSON(bites, &root)
+	if err != nil {
+		return nil, err
+	}
+
+	layout, err := readJSONLayout(bites)
 	if err != nil {
 		return nil, err
 	}
 
 	return &jsonStore{
-		root: root,
+		root:     root,
+		subtrees: make(map[string]*subtreeState),
+		layout:   layout,
 	}, nil
 }
 
-type jsonStore struct {
-	root interface{}
+type jsonStore struct {
+	root interface{}
+	// subtrees remembers the subtrees this store encrypted or decrypted.
+	// It allows to keep the ciphertexts of unchanged values when a subtree is
+	// encrypted again and to modify subtrees this store encrypted itself.
+	subtrees map[string]*subtreeState
+	// layout describes how the document was formatted when it was read.
+	// Documents without a layout are written compactly with sorted keys.
+	layout *jsonLayout
+	// parallelism is the maximum number of values that are encrypted or
+	// decrypted concurrently. If it isn't positive, runtime.GOMAXPROCS is used.
+	parallelism int
+}
+
+type subtreeState struct {
+	sealed bool
+	// decrypted is set for subtrees that were decrypted with DecryptSubtree.
+	// They are sealed again as soon as one of their values changes.
+	decrypted bool
+	// dataKey is nil for subtrees written before envelope encryption was introduced
+	dataKey *[32]byte
+	leaves  leafCache
+	// meta is nil for subtrees written before metadata was introduced
+	meta *metadata
+}
+
+func (s *jsonStore) EncryptSubtree(recipient string, path ...string) error {
+	return s.EncryptSubtreeForRecipients([]string{recipient}, path...)
+}
+
+func (s *jsonStore) EncryptSubtreeForRecipients(recipients []string, path ...string) error {
+	key, meta, err := newEnvelope(recipients)
+	if err != nil {
+		return err
+	}
+
+	return s.encryptSubtree(key, make(leafCache), meta, path...)
+}
+
+// EncryptSubtreeWithPassphrase encrypts a subtree with a key that is derived
+// from the passphrase with scrypt instead of encrypting it for recipients.
+func (s *jsonStore) EncryptSubtreeWithPassphrase(passphrase string, path ...string) error {
+	key, meta, err := newPassphraseEnvelope(passphrase)
+	if err != nil {
+		return err
+	}
+
+	return s.encryptSubtree(key, make(leafCache), meta, path...)
+}
+
+// UpdateSubtree re-encrypts a subtree that was decrypted with DecryptSubtree.
+// Values that didn't change since keep their ciphertext byte-for-byte, only
+// changed values and the MAC are encrypted anew. If no recipients are given,
+// the recipients recorded in the subtree's metadata are used. If the
+// recipients differ from the recorded ones or the subtree was written in an
+// older format, all values are encrypted anew.
+func (s *jsonStore) UpdateSubtree(recipients []string, path ...string) error {
+	state, ok := s.subtrees[pathKey(path)]
+	if !ok || (state.sealed && !state.decrypted) {
+		return fmt.Errorf("subtree [%s] wasn't decrypted", strings.Join(path, "."))
+	}
+
+	if state.sealed {
+		// the subtree was sealed again by Set or Delete
+		err := s.unsealSubtree(path)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(recipients) == 0 {
+		if state.meta == nil {
+			return fmt.Errorf("subtree [%s] doesn't record its recipients", strings.Join(path, "."))
+		}
+		recipients = state.meta.Recipients
+	}
+
+	if state.dataKey != nil && state.meta.hasRecipients(recipients) {
+		// keep the data key so that the old ciphertexts stay valid
+		meta := newMetadata(recipients)
+		meta.Created = state.meta.Created
+		meta.DataKey = state.meta.DataKey
+		return s.encryptSubtree(state.dataKey, state.leaves, meta, path...)
+	}
+
+	key, meta, err := newEnvelope(recipients)
+	if err != nil {
+		return err
+	}
+
+	if state.meta != nil {
+		meta.Created = state.meta.Created
+	}
+	return s.encryptSubtree(key, make(leafCache), meta, path...)
+}
+
+func (s *jsonStore) encryptSubtree(key *[32]byte, cache leafCache, meta *metadata, path ...string) error {
+	newRoot, err := objectSubtree(s.root, path...)
+	if err != nil {
+		return err
+	}
+
+	err = encryptSubtree(newRoot, newDataKeyEncryptionFunction(key), cache, meta, s.parallelism)
+	if err != nil {
+		return fmt.Errorf("cannot encrypt subtree [%s]: %s", strings.Join(path, "."), err.Error())
+	}
+
+	s.subtrees[pathKey(path)] = &subtreeState{
+		sealed:  true,
+		dataKey: key,
+		leaves:  cache,
+		meta:    meta,
+	}
+	return nil
+}
+
+func (s *jsonStore) DecryptSubtree(identity string, path ...string) error {
+	unwrapFunc, err := newAgeUnwrapFunction(identity)
+	if err != nil {
+		return err
+	}
+
+	return s.decryptSubtree(unwrapFunc, path...)
+}
+
+// DecryptSubtreeWithPassphrase decrypts a subtree that was encrypted with
+// EncryptSubtreeWithPassphrase.
+func (s *jsonStore) DecryptSubtreeWithPassphrase(passphrase string, path ...string) error {
+	unwrapFunc, err := newPassphraseUnwrapFunction(passphrase)
+	if err != nil {
+		return err
+	}
+
+	return s.decryptSubtree(unwrapFunc, path...)
+}
+
+func (s *jsonStore) decryptSubtree(unwrapFunc decryptionFunc, path ...string) error {
+	newRoot, err := objectSubtree(s.root, path...)
+	if err != nil {
+		return err
+	}
+
+	cache := make(leafCache)
+	version, meta, key, err := decryptSubTree(newRoot, unwrapFunc, cache, s.parallelism)
+	if err != nil {
+		return err
+	}
+
+	s.subtrees[pathKey(path)] = &subtreeState{
+		decrypted: true,
+		dataKey:   key,
+		leaves:    cache,
+		meta:      meta,
+	}
+
+	if version < macVersionStructural {
+		Logger.Printf("warning: subtree [%s] uses MAC version %d which doesn't authenticate key names, re-encrypt it to upgrade", strings.Join(path, "."), version)
+	}
+	return nil
+}
+
+// Rotate decrypts all encrypted subtrees and encrypts them again with fresh
+// keys for the recipients recorded in their metadata.
+func (s *jsonStore) Rotate(identity string) error {
+	unwrapFunc, err := newAgeUnwrapFunction(identity)
+	if err != nil {
+		return err
+	}
+
+	return s.atomically(func() error {
+		return s.rotate(unwrapFunc, "")
+	})
+}
+
+// RotateWithPassphrase works like Rotate for subtrees that were encrypted
+// with a passphrase. They are encrypted with the same passphrase again.
+func (s *jsonStore) RotateWithPassphrase(passphrase string) error {
+	unwrapFunc, err := newPassphraseUnwrapFunction(passphrase)
+	if err != nil {
+		return err
+	}
+
+	return s.atomically(func() error {
+		return s.rotate(unwrapFunc, passphrase)
+	})
+}
+
+func (s *jsonStore) rotate(unwrapFunc decryptionFunc, passphrase string) error {
+	paths := findEncryptedSubtrees(s.root, []string{})
+	for _, path := range paths {
+		err := s.decryptSubtree(unwrapFunc, path...)
+		if err != nil {
+			return fmt.Errorf("cannot decrypt subtree [%s]: %s", strings.Join(path, "."), err.Error())
+		}
+
+		if s.subtrees[pathKey(path)].meta == nil {
+			return fmt.Errorf("subtree [%s] doesn't record its recipients", strings.Join(path, "."))
+		}
+	}
+
+	for _, path := range paths {
+		old := s.subtrees[pathKey(path)].meta
+		key, meta, err := newEnvelopeLike(old, passphrase)
+		if err != nil {
+			return err
+		}
+
+		meta.Created = old.Created
+		err = s.encryptSubtree(key, make(leafCache), meta, path...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// UpdateRecipients makes all encrypted subtrees readable by exactly the given
+// recipients. The data key of every subtree is unwrapped with the identity and
+// wrapped for the new recipients again. The values themselves aren't encrypted
+// anew unless the subtree was written in an older format.
+// It returns the recipients that were added and removed.
+func (s *jsonStore) UpdateRecipients(identity string, recipients []string) ([]string, []string, error) {
+	unwrapFunc, err := newAgeUnwrapFunction(identity)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s.updateRecipientsAtomically(unwrapFunc, recipients)
+}
+
+// UpdateRecipientsWithPassphrase works like UpdateRecipients for subtrees that
+// were encrypted with a passphrase. Afterwards they can only be decrypted by
+// the recipients.
+func (s *jsonStore) UpdateRecipientsWithPassphrase(passphrase string, recipients []string) ([]string, []string, error) {
+	unwrapFunc, err := newPassphraseUnwrapFunction(passphrase)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return s.updateRecipientsAtomically(unwrapFunc, recipients)
+}
+
+func (s *jsonStore) updateRecipientsAtomically(unwrapFunc decryptionFunc, recipients []string) ([]string, []string, error) {
+	var added []string
+	var removed []string
+	err := s.atomically(func() error {
+		var err error
+		added, removed, err = s.updateRecipients(unwrapFunc, recipients)
+		return err
+	})
+	return added, removed, err
+}
+
+func (s *jsonStore) updateRecipients(unwrapFunc decryptionFunc, recipients []string) ([]string, []string, error) {
+	wrapFunc, err := newAgeWrapFunction(recipients...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	oldRecipients := make(map[string]bool)
+	for _, path := range findEncryptedSubtrees(s.root, []string{}) {
+		err := s.decryptSubtree(unwrapFunc, path...)
+		if err != nil {
+			return nil, nil, fmt.Errorf("cannot decrypt subtree [%s]: %s", strings.Join(path, "."), err.Error())
+		}
+
+		state := s.subtrees[pathKey(path)]
+		key := state.dataKey
+		cache := state.leaves
+		meta := newMetadata(recipients)
+		if key != nil {
+			meta.DataKey, err = wrapDataKey(key, wrapFunc)
+		} else {
+			// older formats are upgraded which requires to encrypt all values anew
+			key, meta, err = newEnvelope(recipients)
+			cache = make(leafCache)
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+
+		if state.meta != nil {
+			meta.Created = state.meta.Created
+			for _, r := range state.meta.Recipients {
+				oldRecipients[r] = true
+			}
+		}
+
+		err = s.encryptSubtree(key, cache, meta, path...)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	var added []string
+	newRecipients := make(map[string]bool)
+	for _, r := range recipients {
+		newRecipients[r] = true
+		if !oldRecipients[r] {
+			added = append(added, r)
+		}
+	}
+
+	var removed []string
+	for r := range oldRecipients {
+		if !newRecipients[r] {
+			removed = append(removed, r)
+		}
+	}
+
+	sort.Strings(added)
+	sort.Strings(removed)
+	return added, removed, nil
+}
+
+// atomically restores the document if fn fails.
+func (s *jsonStore) atomically(fn func() error) error {
+	root := copyValue(s.root)
+	subtrees := make(map[string]*subtreeState, len(s.subtrees))
+	for key, state := range s.subtrees {
+		subtrees[key] = state
+	}
+
+	err := fn()
+	if err != nil {
+		s.root = root
+		s.subtrees = subtrees
+	}
+	return err
+}
+
+func (s *jsonStore) Subtree(path ...string) (map[string]interface{}, error) {
+	st, err := subtree(s.root, path...)
+	if err != nil {
+		return nil, err
+	}
+
+	m, ok := st.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid subtree")
+	}
+
+	return m, nil
+}
+
+// Get returns the value at the given path. Values inside of encrypted subtrees
+// can only be read if this store encrypted the subtree itself.
+func (s *jsonStore) Get(path ...string) (interface{}, error) {
+	prefix, sealed := s.findEncryptedSubtree(path...)
+	if !sealed {
+		return subtree(s.root, path...)
+	}
+
+	var v interface{}
+	err := s.withSealedSubtree(prefix, func(st map[string]interface{}) error {
+		var err error
+		v, err = subtree(st, path[len(prefix):]...)
+		return err
+	})
+	return v, err
+}
+
+// Set sets the value at the given path. The value must be representable in
+// JSON. Setting a value without a path replaces the whole document.
+//
+// Set doesn't create missing objects: all keys but the last one must exist,
+// otherwise the error names the first missing key.
+//
+// Values inside of encrypted subtrees can only be set if this store encrypted
+// or decrypted the subtree itself. Subtrees that were read encrypted fail with
+// "subtree [a] is encrypted, decrypt it first". In a subtree this store
+// encrypted the value is encrypted right away and the subtree's MAC is updated.
+// A decrypted subtree is sealed again as a whole with its data key and for the
+// recipients recorded in its metadata, so Subtree returns ciphertext after Set.
+func (s *jsonStore) Set(value interface{}, path ...string) error {
+	v, err := normalizeValue(value)
+	if err != nil {
+		return err
+	}
+
+	if len(path) == 0 {
+		if _, ok := v.(map[string]interface{}); !ok {
+			return fmt.Errorf("invalid document")
+		}
+
+		s.root = v
+		s.forgetSubtrees()
+		return nil
+	}
+
+	// encrypted subtrees keep their keys, so the parents can be checked on the root
+	err = checkParents(s.root, path...)
+	if err != nil {
+		return err
+	}
+
+	prefix, sealed := s.findEncryptedSubtree(path...)
+	if sealed {
+		return s.updateSealedSubtree(prefix, func(st map[string]interface{}) error {
+			return setValue(st, v, path[len(prefix):]...)
+		})
+	}
+
+	s.forgetSubtrees(path...)
+	err = setValue(s.root, v, path...)
+	if err != nil {
+		return err
+	}
+	return s.resealSubtree(path...)
+}
+
+// Delete removes the value at the given path. Values inside of encrypted
+// subtrees can only be deleted if this store encrypted or decrypted the
+// subtree itself.
+func (s *jsonStore) Delete(path ...string) error {
+	if len(path) == 0 {
+		return fmt.Errorf("cannot delete the whole document")
+	}
+
+	prefix, sealed := s.findEncryptedSubtree(path...)
+	if sealed {
+		return s.updateSealedSubtree(prefix, func(st map[string]interface{}) error {
+			return deleteValue(st, path[len(prefix):]...)
+		})
+	}
+
+	s.forgetSubtrees(path...)
+	err := deleteValue(s.root, path...)
+	if err != nil {
+		return err
+	}
+	return s.resealSubtree(path...)
+}
+
+// findEncryptedSubtree returns the path of the encrypted subtree
+// that contains the given path if there is one.
+func (s *jsonStore) findEncryptedSubtree(path ...string) ([]string, bool) {
+	v := s.root
+	for idx := range path {
+		if m, ok := v.(map[string]interface{}); ok {
+			if _, ok := m["__mac__"]; ok {
+				return path[:idx], true
+			}
+		}
+
+		var err error
+		v, err = traversePath(v, path[idx])
+		if err != nil {
+			return nil, false
+		}
+	}
+	return nil, false
+}
+
+// resealSubtree encrypts the decrypted subtree that contains the given path
+// again. Unchanged values keep their ciphertexts. Subtrees written in older
+// formats stay decrypted until UpdateSubtree is called for them.
+func (s *jsonStore) resealSubtree(path ...string) error {
+	for idx := len(path) - 1; idx >= 0; idx-- {
+		prefix := path[:idx]
+		state, ok := s.subtrees[pathKey(prefix)]
+		if !ok || state.sealed {
+			continue
+		}
+
+		if state.dataKey == nil || state.meta == nil {
+			return nil
+		}
+
+		meta := *state.meta
+		meta.Modified = now().UTC().Truncate(time.Second)
+		err := s.encryptSubtree(state.dataKey, state.leaves, &meta, prefix...)
+		if err != nil {
+			return err
+		}
+		s.subtrees[pathKey(prefix)].decrypted = true
+		return nil
+	}
+	return nil
+}
+
+// unsealSubtree replaces a subtree this store sealed with its plaintext.
+func (s *jsonStore) unsealSubtree(path []string) error {
+	state := s.subtrees[pathKey(path)]
+	return s.withSealedSubtree(path, func(plain map[string]interface{}) error {
+		err := s.replaceSubtree(path, plain)
+		if err != nil {
+			return err
+		}
+
+		state.sealed = false
+		return nil
+	})
+}
+
+// withSealedSubtree calls fn with a decrypted copy of a subtree this store encrypted.
+func (s *jsonStore) withSealedSubtree(path []string, fn func(map[string]interface{}) error) error {
+	state, ok := s.subtrees[pathKey(path)]
+	if !ok || !state.sealed {
+		return fmt.Errorf("subtree [%s] is encrypted, decrypt it first", strings.Join(path, "."))
+	}
+
+	st, err := s.Subtree(path...)
+	if err != nil {
+		return err
+	}
+
+	plain := copyValue(st).(map[string]interface{})
+	err = decryptSubtreeFromCache(plain, state.leaves)
+	if err != nil {
+		return err
+	}
+
+	return fn(plain)
+}
+
+// updateSealedSubtree applies fn to a subtree this store encrypted and
+// encrypts the result again. Only changed values get a new ciphertext.
+func (s *jsonStore) updateSealedSubtree(path []string, fn func(map[string]interface{}) error) error {
+	state := s.subtrees[pathKey(path)]
+	return s.withSealedSubtree(path, func(plain map[string]interface{}) error {
+		err := fn(plain)
+		if err != nil {
+			return err
+		}
+
+		meta := *state.meta
+		meta.Modified = now().UTC().Truncate(time.Second)
+		err = encryptSubtree(plain, newDataKeyEncryptionFunction(state.dataKey), state.leaves, &meta, s.parallelism)
+		if err != nil {
+			return err
+		}
+		state.meta = &meta
+		return s.replaceSubtree(path, plain)
+	})
+}
+
+// replaceSubtree swaps the contents of the subtree at path with v.
+func (s *jsonStore) replaceSubtree(path []string, v map[string]interface{}) error {
+	st, err := s.Subtree(path...)
+	if err != nil {
+		return err
+	}
+
+	for key := range st {
+		delete(st, key)
+	}
+	for key, value := range v {
+		st[key] = value
+	}
+	return nil
+}
+
+// forgetSubtrees drops the state of all encrypted subtrees at or below the
+// given path. Decrypted subtrees are kept around for UpdateSubtree.
+func (s *jsonStore) forgetSubtrees(path ...string) {
+	prefix := pathKey(path)
+	for key, state := range s.subtrees {
+		if !state.sealed {
+			continue
+		}
+
+		if len(path) == 0 || key == prefix || strings.HasPrefix(key, prefix+".") {
+			delete(s.subtrees, key)
+		}
+	}
+}
+
+func (s *jsonStore) backingStore() *jsonStore {
+	return s
+}
+
+func (s *jsonStore) ToFile(path string) error {
+	bites, err := s.bytes()
+	if err != nil {
+		return err
+	}
+
+	return writeFile(path, bites)
+}
+
+func (s *jsonStore) bytes() ([]byte, error) {
+	if s.layout == nil {
+		return json.Marshal(s.root)
+	}
+
+	var buf bytes.Buffer
+	err := s.layout.write(&buf, s.root, s.layout.order, 0)
+	if err != nil {
+		return nil, err
+	}
+
+	if s.layout.trailingNewline {
+		buf.WriteString(s.layout.lineEnding)
+	}
+	return buf.Bytes(), nil
+}
+
+// jsonLayout records the formatting of a document so that it can be
+// written the way it was read.
+type jsonLayout struct {
+	// pretty is set for documents that span multiple lines
+	pretty bool
+	indent string
+	// colon and comma are the separators between keys and values and
+	// between the members of a single line object or array
+	colon string
+	comma string
+	// lineEnding is either "\n" or "\r\n"
+	lineEnding string
+	// trailingNewline is set if the document ended with a newline
+	trailingNewline bool
+	order           *keyOrder
+}
+
+// keyOrder records the order of the keys of an object and of all objects
+// nested in it.
+type keyOrder struct {
+	keys     []string
+	children map[string]*keyOrder
+	items    []*keyOrder
+}
+
+func readJSONLayout(bites []byte) (*jsonLayout, error) {
+	dec := json.NewDecoder(bytes.NewReader(bites))
+	order, err := readKeyOrder(dec)
+	if err != nil {
+		return nil, err
+	}
+
+	trimmed := bytes.TrimSpace(bites)
+	layout := &jsonLayout{
+		pretty:          bytes.ContainsRune(trimmed, '\n'),
+		lineEnding:      "\n",
+		trailingNewline: bytes.HasSuffix(bites, []byte("\n")),
+		order:           order,
+	}
+	if idx := bytes.IndexByte(bites, '\n'); idx > 0 && bites[idx-1] == '\r' {
+		layout.lineEnding = "\r\n"
+	}
+	layout.colon, layout.comma = readJSONSeparators(trimmed, layout.pretty)
+
+	// the first indented line is one level deep
+	for _, line := range strings.Split(string(trimmed), "\n")[1:] {
+		content := strings.TrimLeft(line, " \t")
+		if content != "" && content != line {
+			layout.indent = line[:len(line)-len(content)]
+			break
+		}
+	}
+	return layout, nil
+}
+
+// readJSONSeparators returns the first colon and comma outside of strings
+// including the blanks that follow them. Commas of multi-line documents are
+// followed by a newline instead.
+func readJSONSeparators(bites []byte, pretty bool) (string, string) {
+	colon := ""
+	comma := ""
+	if pretty {
+		comma = ","
+	}
+
+	inString := false
+	for idx := 0; idx < len(bites) && (colon == "" || comma == ""); idx++ {
+		c := bites[idx]
+		if inString {
+			if c == '\\' {
+				idx++
+			} else if c == '"' {
+				inString = false
+			}
+			continue
+		}
+
+		switch c {
+		case '"':
+			inString = true
+		case ':', ',':
+			end := idx + 1
+			for end < len(bites) && (bites[end] == ' ' || bites[end] == '\t') {
+				end++
+			}
+			if c == ':' && colon == "" {
+				colon = string(bites[idx:end])
+			} else if c == ',' && comma == "" {
+				comma = string(bites[idx:end])
+			}
+		}
+	}
+
+	if colon == "" {
+		colon = ":"
+		if pretty {
+			colon = ": "
+		}
+	}
+	if comma == "" {
+		comma = ","
+	}
+	return colon, comma
+}
+
+func readKeyOrder(dec *json.Decoder) (*keyOrder, error) {
+	tok, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		order := &keyOrder{children: make(map[string]*keyOrder)}
+		for dec.More() {
+			tok, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+
+			key := tok.(string)
+			child, err := readKeyOrder(dec)
+			if err != nil {
+				return nil, err
+			}
+
+			if _, ok := order.children[key]; !ok {
+				order.keys = append(order.keys, key)
+			}
+			order.children[key] = child
+		}
+		_, err = dec.Token()
+		return order, err
+
+	case json.Delim('['):
+		order := &keyOrder{}
+		for dec.More() {
+			child, err := readKeyOrder(dec)
+			if err != nil {
+				return nil, err
+			}
+			order.items = append(order.items, child)
+		}
+		_, err = dec.Token()
+		return order, err
+
+	default:
+		return nil, nil
+	}
+}
+
+// sortKeys returns the keys of m in the recorded order.
+// New keys follow in sorted order.
+func (o *keyOrder) sortKeys(m map[string]interface{}) []string {
+	if o == nil {
+		return sortedKeys(m)
+	}
+
+	keys := make([]string, 0, len(m))
+	for _, key := range o.keys {
+		if _, ok := m[key]; ok {
+			keys = append(keys, key)
+		}
+	}
+
+	for _, key := range sortedKeys(m) {
+		if _, ok := o.children[key]; !ok {
+			keys = append(keys, key)
+		}
+	}
+	return keys
+}
+
+func (o *keyOrder) child(key string) *keyOrder {
+	if o == nil {
+		return nil
+	}
+	return o.children[key]
+}
+
+func (o *keyOrder) item(idx int) *keyOrder {
+	if o == nil || idx >= len(o.items) {
+		return nil
+	}
+	return o.items[idx]
+}
+
+func (l *jsonLayout) write(buf *bytes.Buffer, v interface{}, order *keyOrder, depth int) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if len(v) == 0 {
+			buf.WriteString("{}")
+			return nil
+		}
+
+		buf.WriteByte('{')
+		for idx, key := range order.sortKeys(v) {
+			if idx > 0 {
+				buf.WriteString(l.comma)
+			}
+			l.newline(buf, depth+1)
+
+			bites, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			buf.Write(bites)
+			buf.WriteString(l.colon)
+
+			err = l.write(buf, v[key], order.child(key), depth+1)
+			if err != nil {
+				return err
+			}
+		}
+		l.newline(buf, depth)
+		buf.WriteByte('}')
+		return nil
+
+	case []interface{}:
+		if len(v) == 0 {
+			buf.WriteString("[]")
+			return nil
+		}
+
+		buf.WriteByte('[')
+		for idx, item := range v {
+			if idx > 0 {
+				buf.WriteString(l.comma)
+			}
+			l.newline(buf, depth+1)
+
+			err := l.write(buf, item, order.item(idx), depth+1)
+			if err != nil {
+				return err
+			}
+		}
+		l.newline(buf, depth)
+		buf.WriteByte(']')
+		return nil
+
+	default:
+		bites, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(bites)
+		return nil
+	}
+}
+
+func (l *jsonLayout) newline(buf *bytes.Buffer, depth int) {
+	if !l.pretty {
+		return
+	}
+
+	buf.WriteString(l.lineEnding)
+	for i := 0; i < depth; i++ {
+		buf.WriteString(l.indent)
+	}
+}
+
+// unmarshalJSON works like json.Unmarshal but decodes numbers
+// as json.Number in order to preserve their exact value.
+func unmarshalJSON(bites []byte, v interface{}) error {
+	dec := json.NewDecoder(bytes.NewReader(bites))
+	dec.UseNumber()
+	err := dec.Decode(v)
+	if err != nil {
+		return err
+	}
+
+	_, err = dec.Token()
+	if err != io.EOF {
+		return fmt.Errorf("invalid json: unexpected data after top-level value")
+	}
+	return nil
+}
+
+// normalizeValue converts any value that can be marshaled to JSON into the
+// generic representation used by the store. Dates, nan and inf are kept as
+// they are.
+func normalizeValue(value interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, item := range v {
+			newV, err := normalizeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = newV
+		}
+		return m, nil
+
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for idx, item := range v {
+			newV, err := normalizeValue(item)
+			if err != nil {
+				return nil, err
+			}
+			a[idx] = newV
+		}
+		return a, nil
+
+	case string, bool, nil, Datetime:
+		return v, nil
+
+	case float64:
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return v, nil
+		}
+	}
+
+	bites, err := json.Marshal(value)
+	if err != nil {
+		return nil, err
+	}
+
+	var v interface{}
+	err = unmarshalJSON(bites, &v)
+	if err != nil {
+		return nil, err
+	}
+	return v, nil
+}
+
+// copyValue returns a deep copy of v. Unlike normalizeValue it keeps values
+// that can't be represented in JSON like dates and nan.
+func copyValue(v interface{}) interface{} {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			m[key] = copyValue(value)
+		}
+		return m
+
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for idx, value := range v {
+			a[idx] = copyValue(value)
+		}
+		return a
+
+	default:
+		return v
+	}
+}
+
+func subtree(v interface{}, path ...string) (interface{}, error) {
+	return traversePath(v, path...)
 }
 
-func (s *jsonStore) EncryptSubtree(recipient string, path ...string) error {
-	st, err := subtree(s.root, path...)
+// objectSubtree returns the object at the given path. Arrays can't be
+// encrypted as a whole since there is no place for their metadata.
+func objectSubtree(v interface{}, path ...string) (map[string]interface{}, error) {
+	st, err := subtree(v, path...)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	ef, err := newAgeEncryptionFunction(recipient)
-	if err != nil {
-		return err
+	switch st := st.(type) {
+	case map[string]interface{}:
+		return st, nil
+	case []interface{}:
+		return nil, fmt.Errorf("invalid subtree: %s is an array, its elements have to be encrypted one by one", strings.Join(path, "."))
+	default:
+		return nil, fmt.Errorf("invalid subtree")
 	}
+}
 
-	newRoot, ok := st.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("invalid subtree")
+// findEncryptedSubtrees returns the paths of all encrypted subtrees in v.
+func findEncryptedSubtrees(v interface{}, path []string) [][]string {
+	var paths [][]string
+	switch v := v.(type) {
+	case []interface{}:
+		for idx := range v {
+			paths = append(paths, findEncryptedSubtrees(v[idx], childPath(path, strconv.Itoa(idx)))...)
+		}
+
+	case map[string]interface{}:
+		if _, ok := v["__mac__"]; ok {
+			return [][]string{path}
+		}
+
+		for _, key := range sortedKeys(v) {
+			paths = append(paths, findEncryptedSubtrees(v[key], childPath(path, key))...)
+		}
 	}
+	return paths
+}
+
+// findEncryptionMarker returns the path of the first object in v that
+// carries a MAC or metadata.
+func findEncryptionMarker(v interface{}, path []string) ([]string, bool) {
+	switch v := v.(type) {
+	case []interface{}:
+		for idx := range v {
+			if p, ok := findEncryptionMarker(v[idx], childPath(path, strconv.Itoa(idx))); ok {
+				return p, true
+			}
+		}
+
+	case map[string]interface{}:
+		_, hasMAC := v["__mac__"]
+		_, hasMeta := v["__keycloak__"]
+		if hasMAC || hasMeta {
+			return path, true
+		}
 
-	return encryptSubtree(newRoot, ef, "1234567890")
+		for _, key := range sortedKeys(v) {
+			if p, ok := findEncryptionMarker(v[key], childPath(path, key)); ok {
+				return p, true
+			}
+		}
+	}
+	return nil, false
 }
 
-func (s *jsonStore) DecryptSubtree(identity string, path ...string) error {
-	st, err := subtree(s.root, path...)
-	if err != nil {
-		return err
+// checkParents returns an error naming the first key of the path that doesn't
+// exist. The last key of the path doesn't need to exist.
+func checkParents(root interface{}, path ...string) error {
+	v := root
+	for idx := range path[:len(path)-1] {
+		var err error
+		v, err = traversePath(v, path[idx])
+		if err != nil {
+			return fmt.Errorf("invalid path: [%s] doesn't exist", strings.Join(path[:idx+1], "."))
+		}
 	}
+	return nil
+}
 
-	df, err := newAgeDecryptionFunction(identity)
+func setValue(root interface{}, v interface{}, path ...string) error {
+	parent, err := subtree(root, path[:len(path)-1]...)
 	if err != nil {
 		return err
 	}
 
-	newRoot, ok := st.(map[string]interface{})
-	if !ok {
-		return fmt.Errorf("invalid subtree")
-	}
+	key := path[len(path)-1]
+	switch parent := parent.(type) {
+	case map[string]interface{}:
+		parent[key] = v
+		return nil
 
-	return decryptSubTree(newRoot, df, "1234567890")
-}
+	case []interface{}:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(parent) {
+			return fmt.Errorf("invalid path")
+		}
 
-func (s *jsonStore) Subtree(path ...string) (map[string]interface{}, error) {
-	st, err := subtree(s.root, path...)
-	if err != nil {
-		return nil, err
-	}
+		parent[i] = v
+		return nil
 
-	m, ok := st.(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("invalid subtree")
+	default:
+		return fmt.Errorf("invalid path")
 	}
-
-	return m, nil
 }
 
-func (s *jsonStore) ToFile(path string) error {
-	bites, err := s.bytes()
+func deleteValue(root interface{}, path ...string) error {
+	parentPath := path[:len(path)-1]
+	parent, err := subtree(root, parentPath...)
 	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(path, bites, 0600)
-}
+	key := path[len(path)-1]
+	switch p := parent.(type) {
+	case map[string]interface{}:
+		if _, ok := p[key]; !ok {
+			return fmt.Errorf("invalid path")
+		}
 
-func (s *jsonStore) bytes() ([]byte, error) {
-	return json.Marshal(s.root)
-}
+		delete(p, key)
+		return nil
 
-func subtree(v interface{}, path ...string) (interface{}, error) {
-	return traversePath(v, path...)
+	case []interface{}:
+		i, err := strconv.Atoi(key)
+		if err != nil || i < 0 || i >= len(p) {
+			return fmt.Errorf("invalid path")
+		}
+
+		// removing an element from an array requires to replace the array
+		a := append(p[:i:i], p[i+1:]...)
+		if len(parentPath) == 0 {
+			return fmt.Errorf("invalid path")
+		}
+		return setValue(root, a, parentPath...)
+
+	default:
+		return fmt.Errorf("invalid path")
+	}
 }
 
-func encryptSubtree(v map[string]interface{}, ef encryptionFunc, serviceName string) error {
-	hsher := &hasher{hmac.New(sha512.New512_256, []byte(serviceName))}
-	err := encryptSubtreeWithHasher(v, ef, hsher.write)
+// encryptSubtree encrypts all values in v and adds a MAC. Values that are
+// found unchanged in the cache keep their previous ciphertext. Subtrees that
+// are encrypted already or contain encrypted subtrees are rejected, sealing
+// them again would drop the only keys their values can be decrypted with.
+func encryptSubtree(v map[string]interface{}, ef encryptionFunc, cache leafCache, meta *metadata, workers int) error {
+	if path, ok := findEncryptionMarker(v, []string{}); ok {
+		if len(path) == 0 {
+			return fmt.Errorf("already encrypted")
+		}
+		return fmt.Errorf("contains the encrypted subtree [%s]", strings.Join(path, "."))
+	}
+
+	macKey := newEncryptionKey()
+	hsher := newMACHasher(macVersionStructural, macKey[:])
+	err := hashMetadata(meta, hsher.write)
 	if err != nil {
 		return err
 	}
 
-	encHash, err := ef(hsher.Sum(nil))
+	err = traverseEncrypt(v, []string{}, ef, hsher.write, cache, workers)
 	if err != nil {
 		return err
 	}
 
-	v["__mac__"] = base64.StdEncoding.EncodeToString(encHash)
-	return nil
-}
+	mac, err := encodeMAC(macVersionStructural, macKey[:], hsher.Sum(nil), ef)
+	if err != nil {
+		return err
+	}
 
-func encryptSubtreeWithHasher(v map[string]interface{}, ef encryptionFunc, hf hashingFunc) error {
-	_, err := traverseEncrypt(v, ef, hf)
-	return err
-}
+	metaValue, err := meta.toValue()
+	if err != nil {
+		return err
+	}
 
-func decryptSubTree(v map[string]interface{}, df decryptionFunc, serviceName string) error {
-	hsher := &hasher{hmac.New(sha512.New512_256, []byte(serviceName))}
+	v["__mac__"] = mac
+	v["__keycloak__"] = metaValue
+	return nil
+}
 
+// decryptSubTree decrypts all values in v and verifies them against the
+// subtree's MAC. unwrapFunc decrypts what was encrypted for the recipients
+// with age. It returns the version of the MAC that was verified, the subtree's
+// metadata (if the subtree has any) and its data key (if the subtree uses
+// envelope encryption).
+// All decrypted values are recorded in the cache if one is given.
+func decryptSubTree(v map[string]interface{}, unwrapFunc decryptionFunc, cache leafCache, workers int) (macVersion, *metadata, *[32]byte, error) {
 	m, ok := v["__mac__"]
 	if !ok {
-		return fmt.Errorf("cannot find mac")
+		return 0, nil, nil, fmt.Errorf("cannot find mac")
+	}
+
+	mac, ok := m.(string)
+	if !ok {
+		return 0, nil, nil, fmt.Errorf("invalid mac")
+	}
+
+	// subtrees written before metadata was introduced don't have any
+	var meta *metadata
+	var err error
+	if metaValue, ok := v["__keycloak__"]; ok {
+		meta, err = parseMetadata(metaValue)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+	}
+
+	var key *[32]byte
+	df := newPerValueDecryptionFunction(unwrapFunc)
+	if meta != nil && meta.Version == formatVersionEnvelope {
+		key, err = unwrapDataKey(meta.DataKey, unwrapFunc)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+
+		df, err = newAESDecryptionFunction(key)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+	}
+
+	version, macKey, macSum, err := decodeMAC(mac, df)
+	if err != nil && key != nil {
+		// the data key was unwrapped already, so the mac must be broken
+		return 0, nil, nil, fmt.Errorf("invalid mac")
+	} else if err != nil {
+		return 0, nil, nil, err
+	}
+
+	if meta != nil {
+		err = meta.validate(version)
+		if err != nil {
+			return 0, nil, nil, err
+		}
 	}
 
 	delete(v, "__mac__")
-	err := decryptSubTreeWithHasher(v, df, hsher.write)
+	delete(v, "__keycloak__")
+	hsher := newMACHasher(version, macKey)
+	err = hashMetadata(meta, hsher.write)
 	if err != nil {
-		return err
+		return 0, nil, nil, err
 	}
 
-	mac, ok := m.(string)
-	if !ok {
-		return fmt.Errorf("invalid mac")
+	err = traverseDecrypt(v, []string{}, df, hsher.write, cache, workers)
+	if err != nil {
+		return 0, nil, nil, err
 	}
 
-	macBites, err := base64.StdEncoding.DecodeString(mac)
-	if err != nil {
-		return err
+	if !hmac.Equal(macSum, hsher.Sum(nil)) {
+		return 0, nil, nil, fmt.Errorf("invalid mac")
+	}
+
+	return version, meta, key, nil
+}
+
+func hashMetadata(meta *metadata, hf hashingFunc) error {
+	if meta == nil {
+		return nil
 	}
 
-	macBites, err = df(macBites)
+	bites, err := meta.bytes()
 	if err != nil {
 		return err
 	}
+	return hf([]string{"__keycloak__"}, metadataMarker, bites)
+}
+
+// decryptSubtreeFromCache decrypts a subtree by looking up the plaintexts of
+// all values in the cache. It fails if the subtree contains unknown ciphertexts.
+func decryptSubtreeFromCache(v map[string]interface{}, cache leafCache) error {
+	plaintexts := make(map[string][]byte, len(cache))
+	for _, leaf := range cache {
+		bites, err := base64.StdEncoding.DecodeString(leaf.ciphertext)
+		if err != nil {
+			return err
+		}
+		plaintexts[string(bites[1:])] = leaf.plaintext
+	}
 
-	hSum := hsher.Sum(nil)
-	if !bytes.Equal(macBites, hSum) {
-		return fmt.Errorf("invalid mac")
+	df := func(bites []byte) ([]byte, error) {
+		plaintext, ok := plaintexts[string(bites)]
+		if !ok {
+			return nil, fmt.Errorf("subtree was modified after it was encrypted")
+		}
+		return plaintext, nil
 	}
 
-	return nil
-}
+	hf := func([]string, byte, []byte) error {
+		return nil
+	}
 
-func decryptSubTreeWithHasher(v map[string]interface{}, df decryptionFunc, hf hashingFunc) error {
-	_, err := traverseDecrypt(v, df, hf)
-	return err
+	delete(v, "__mac__")
+	delete(v, "__keycloak__")
+	return traverseDecrypt(v, []string{}, df, hf, nil, 0)
 }
 
 func traversePath(v interface{}, path ...string) (interface{}, error) {
@@ -185,6 +1320,10 @@ func traversePath(v interface{}, path ...string) (interface{}, error) {
 			return nil, fmt.Errorf("invalid path: %s", err.Error())
 		}
 
+		if i < 0 || int(i) >= len(v) {
+			return nil, fmt.Errorf("invalid path")
+		}
+
 		return traversePath(v[i], path[1:]...)
 
 	case map[string]interface{}:
@@ -201,7 +1340,7 @@ func traversePath(v interface{}, path ...string) (interface{}, error) {
 		}
 
 		return v, nil
-	case float64:
+	case float64, json.Number, bool, Datetime, nil:
 		if len(path) != 0 {
 			return nil, fmt.Errorf("invalid path")
 		}
@@ -213,150 +1352,296 @@ func traversePath(v interface{}, path ...string) (interface{}, error) {
 	}
 }
 
-func traverseDecrypt(v interface{}, df decryptionFunc, hf hashingFunc) (interface{}, error) {
+// node is an object, array or value of a subtree. Objects and arrays carry
+// their marker as kind and their length as data, values their type byte and
+// plaintext once they're known.
+type node struct {
+	path  []string
+	kind  byte
+	data  []byte
+	value interface{}
+	leaf  bool
+	// set replaces the value in its parent
+	set func(interface{})
+}
+
+// flatten returns all nodes of v in the order in which they are hashed.
+func flatten(v interface{}, path []string, set func(interface{}), nodes []*node) ([]*node, error) {
+	var err error
 	switch v := v.(type) {
 	case []interface{}:
+		nodes = append(nodes, &node{path: path, kind: arrayMarker, data: encodeLength(len(v))})
 		for idx := range v {
-			newV, err := traverseDecrypt(v[idx], df, hf)
+			idx := idx
+			nodes, err = flatten(v[idx], childPath(path, strconv.Itoa(idx)), func(newV interface{}) {
+				v[idx] = newV
+			}, nodes)
 			if err != nil {
 				return nil, err
 			}
-
-			if newV != nil {
-				v[idx] = newV
-			}
 		}
-		return "", nil
+		return nodes, nil
 
 	case map[string]interface{}:
-		keys := make([]string, len(v))
-		idx := 0
-		for key := range v {
-			keys[idx] = key
-			idx++
-		}
-
-		sort.Strings(keys)
-		for _, key := range keys {
-			newV, err := traverseDecrypt(v[key], df, hf)
+		nodes = append(nodes, &node{path: path, kind: objectMarker, data: encodeLength(len(v))})
+		for _, key := range sortedKeys(v) {
+			key := key
+			nodes, err = flatten(v[key], childPath(path, key), func(newV interface{}) {
+				v[key] = newV
+			}, nodes)
 			if err != nil {
 				return nil, err
 			}
+		}
+		return nodes, nil
 
-			if newV != nil {
-				v[key] = newV
-			}
+	case string, float64, json.Number, bool, Datetime, nil:
+		return append(nodes, &node{path: path, value: v, leaf: true, set: set}), nil
+
+	default:
+		return nil, fmt.Errorf("unknown type %T", v)
+	}
+}
+
+func traverseDecrypt(v interface{}, path []string, df decryptionFunc, hf hashingFunc, cache leafCache, workers int) error {
+	nodes, err := flatten(v, path, func(interface{}) {}, nil)
+	if err != nil {
+		return err
+	}
+
+	var leaves []*node
+	for _, n := range nodes {
+		if n.leaf {
+			leaves = append(leaves, n)
 		}
-		return nil, nil
+	}
 
-	case string:
-		bites, err := base64.StdEncoding.DecodeString(v)
+	err = parallelize(workers, len(leaves), func(idx int) error {
+		n := leaves[idx]
+		s, ok := n.value.(string)
+		if !ok {
+			return fmt.Errorf("invalid type")
+		}
+
+		bites, err := base64.StdEncoding.DecodeString(s)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		typeByte := bites[0]
-		bites = bites[1:]
-		data, err := df(bites)
+		if len(bites) == 0 {
+			return fmt.Errorf("invalid value")
+		}
+
+		n.kind = bites[0]
+		n.data, err = df(bites[1:])
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	// the hash covers all nodes in order
+	for _, n := range nodes {
+		err = hf(n.path, n.kind, n.data)
 		if err != nil {
-			return nil, err
+			return err
+		}
+
+		if !n.leaf {
+			continue
 		}
 
-		err = hf(data)
+		cache.add(n.path, n.kind, n.data, n.value.(string))
+		newV, err := decodeValue(jsonDataType(n.kind), n.data)
 		if err != nil {
-			return nil, err
+			return err
 		}
+		n.set(newV)
+	}
+	return nil
+}
 
-		switch jsonDataType(typeByte) {
-		case stringType:
-			return string(data), nil
+func decodeValue(typ jsonDataType, data []byte) (interface{}, error) {
+	switch typ {
+	case stringType:
+		return string(data), nil
 
-		case numberType:
-			return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
+	case numberType:
+		if len(data) != 8 {
+			return nil, fmt.Errorf("invalid number")
+		}
+		return math.Float64frombits(binary.BigEndian.Uint64(data)), nil
 
-		default:
-			return "", fmt.Errorf("invalid type")
+	case boolType:
+		if len(data) != 1 {
+			return nil, fmt.Errorf("invalid bool")
 		}
+		return data[0] != 0, nil
+
+	case nullType:
+		return nil, nil
+
+	case decimalType:
+		return parseNumber(data)
+
+	case datetimeType:
+		return Datetime(data), nil
 
 	default:
-		return "", fmt.Errorf("invalid type")
+		return nil, fmt.Errorf("invalid type")
 	}
 }
 
-func traverseEncrypt(v interface{}, ef encryptionFunc, hf hashingFunc) (string, error) {
-	var newV string
-	var bites []byte
-	var err error
-	switch v := v.(type) {
-	case []interface{}:
-		for idx := range v {
-			newV, err = traverseEncrypt(v[idx], ef, hf)
-			if err != nil {
-				return "", err
-			}
-
-			if len(newV) > 0 {
-				v[idx] = newV
-			}
-		}
-		return "", nil
+func traverseEncrypt(v interface{}, path []string, ef encryptionFunc, hf hashingFunc, cache leafCache, workers int) error {
+	nodes, err := flatten(v, path, func(interface{}) {}, nil)
+	if err != nil {
+		return err
+	}
 
-	case map[string]interface{}:
-		keys := make([]string, len(v))
-		idx := 0
-		for key := range v {
-			keys[idx] = key
-			idx++
+	// the hash covers all nodes in order
+	var leaves []*node
+	for _, n := range nodes {
+		if n.leaf {
+			var typ jsonDataType
+			typ, n.data = encodeValue(n.value)
+			n.kind = byte(typ)
 		}
 
-		sort.Strings(keys)
-		for _, key := range keys {
-			newV, err = traverseEncrypt(v[key], ef, hf)
+		if hf != nil {
+			err = hf(n.path, n.kind, n.data)
 			if err != nil {
-				return "", err
+				return err
 			}
+		}
 
-			if len(newV) > 0 {
-				v[key] = newV
-			}
+		if !n.leaf {
+			continue
 		}
-		return "", nil
 
-	case string:
-		bites, err = ef([]byte(v))
-		if err != nil {
-			return "", err
+		ciphertext, ok := cache.get(n.path, n.kind, n.data)
+		if ok {
+			n.set(ciphertext)
+			continue
 		}
+		leaves = append(leaves, n)
+	}
 
-		if hf != nil {
-			err = hf([]byte(v))
-			if err != nil {
-				return "", err
-			}
+	ciphertexts := make([]string, len(leaves))
+	err = parallelize(workers, len(leaves), func(idx int) error {
+		n := leaves[idx]
+		bites, err := ef(n.data)
+		if err != nil {
+			return err
 		}
 
-		bites = joinSize(1+len(bites), []byte{byte(stringType)}, bites)
-		return base64.StdEncoding.EncodeToString(bites), nil
+		bites = joinSize(1+len(bites), []byte{n.kind}, bites)
+		ciphertexts[idx] = base64.StdEncoding.EncodeToString(bites)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for idx, n := range leaves {
+		cache.add(n.path, n.kind, n.data, ciphertexts[idx])
+		n.set(ciphertexts[idx])
+	}
+	return nil
+}
 
+// encodeValue returns the type and the binary representation of a value.
+func encodeValue(v interface{}) (jsonDataType, []byte) {
+	switch v := v.(type) {
 	case float64:
 		var buf [8]byte
 		binary.BigEndian.PutUint64(buf[:], math.Float64bits(v))
-		bites, err := ef(buf[:])
-		if err != nil {
-			return "", err
-		}
+		return numberType, buf[:]
 
-		if hf != nil {
-			err = hf(buf[:])
-			if err != nil {
-				return "", err
-			}
+	case json.Number:
+		return decimalType, []byte(v)
+
+	case bool:
+		if v {
+			return boolType, []byte{1}
 		}
+		return boolType, []byte{0}
 
-		bites = joinSize(1+len(bites), []byte{byte(numberType)}, bites)
-		return base64.StdEncoding.EncodeToString(bites), nil
+	case nil:
+		return nullType, []byte{}
+
+	case Datetime:
+		return datetimeType, []byte(v)
 
 	default:
-		return "", fmt.Errorf("unknown type %s", v)
+		return stringType, []byte(v.(string))
+	}
+}
+
+func parseNumber(data []byte) (json.Number, error) {
+	var v interface{}
+	err := unmarshalJSON(data, &v)
+	if err != nil {
+		return "", err
+	}
+
+	n, ok := v.(json.Number)
+	if !ok {
+		return "", fmt.Errorf("invalid number")
+	}
+	return n, nil
+}
+
+func sortedKeys(m map[string]interface{}) []string {
+	keys := make([]string, len(m))
+	idx := 0
+	for key := range m {
+		keys[idx] = key
+		idx++
+	}
+
+	sort.Strings(keys)
+	return keys
+}
+
+func pathKey(path []string) string {
+	quoted := make([]string, len(path))
+	for idx := range path {
+		quoted[idx] = strconv.Quote(path[idx])
+	}
+	return strings.Join(quoted, ".")
+}
+
+// childPath appends key to a copy of path.
+func childPath(path []string, key string) []string {
+	return append(path[:len(path):len(path)], key)
+}
+
+// leafCache maps the path of every leaf in a subtree to its plaintext and ciphertext.
+type leafCache map[string]cachedLeaf
+
+type cachedLeaf struct {
+	kind       byte
+	plaintext  []byte
+	ciphertext string
+}
+
+func (c leafCache) add(path []string, kind byte, plaintext []byte, ciphertext string) {
+	if c == nil {
+		return
+	}
+
+	c[pathKey(path)] = cachedLeaf{
+		kind:       kind,
+		plaintext:  plaintext,
+		ciphertext: ciphertext,
+	}
+}
+
+// get returns the cached ciphertext of the leaf at path if the leaf's type and plaintext didn't change.
+func (c leafCache) get(path []string, kind byte, plaintext []byte) (string, bool) {
+	leaf, ok := c[pathKey(path)]
+	if !ok || leaf.kind != kind || !bytes.Equal(leaf.plaintext, plaintext) {
+		return "", false
 	}
+	return leaf.ciphertext, true
 }
@@ -1,7 +1,11 @@
 package keycloak
 
 import (
+	"encoding/json"
+	"fmt"
 	"io/ioutil"
+	"runtime"
+	"strings"
 	"testing"
 
 	"filippo.io/age"
@@ -12,6 +16,7 @@ import (
 func TestJSONBasic(t *testing.T) {
 	jsons := []string{
 		"testdata/creds1.json",
+		"testdata/creds3.json",
 	}
 
 	for idx := range jsons {
@@ -47,3 +52,306 @@ func runTestJSONBasic(t *testing.T, filepath string) {
 	diff, _ := jsondiff.Compare(bites, bites2, &opts)
 	assert.Equal(t, jsondiff.FullMatch, diff)
 }
+
+func TestJSONBoolAndNull(t *testing.T) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	store, err := GetStoreForFile("testdata/creds3.json")
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "secrets")
+	assert.Nil(t, err)
+
+	// all leaves are encrypted
+	st, err := store.Subtree("secrets")
+	assert.Nil(t, err)
+	_, ok := st["enabled"].(string)
+	assert.True(t, ok)
+	_, ok = st["token"].(string)
+	assert.True(t, ok)
+
+	err = store.DecryptSubtree(ageIdentity.String(), "secrets")
+	assert.Nil(t, err)
+	st, err = store.Subtree("secrets")
+	assert.Nil(t, err)
+	assert.Equal(t, true, st["enabled"])
+	assert.Equal(t, false, st["debug"])
+	v, ok := st["token"]
+	assert.True(t, ok)
+	assert.Nil(t, v)
+	assert.Equal(t, []interface{}{"db1", "db2", nil}, st["hosts"])
+}
+
+func TestJSONExactNumbers(t *testing.T) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	store, err := newJSONStore([]byte(`{"secrets":{"port":5432,"id":12345678901234567890123,"ratio":1.10,"small":-1e-7}}`))
+	assert.Nil(t, err)
+
+	// float64 values from older files keep working
+	st, err := store.Subtree("secrets")
+	assert.Nil(t, err)
+	st["pi"] = 3.14
+
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "secrets")
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(ageIdentity.String(), "secrets")
+	assert.Nil(t, err)
+
+	st, err = store.Subtree("secrets")
+	assert.Nil(t, err)
+	assert.Equal(t, json.Number("5432"), st["port"])
+	assert.Equal(t, json.Number("12345678901234567890123"), st["id"])
+	assert.Equal(t, json.Number("1.10"), st["ratio"])
+	assert.Equal(t, json.Number("-1e-7"), st["small"])
+	assert.Equal(t, 3.14, st["pi"])
+
+	bites, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Contains(t, string(bites), `"id":12345678901234567890123`)
+	assert.Contains(t, string(bites), `"ratio":1.10`)
+}
+
+func TestJSONTrailingData(t *testing.T) {
+	_, err := newJSONStore([]byte(`{"a":"b"} {"c":"d"}`))
+	assert.NotNil(t, err)
+}
+
+func TestJSONUpdateSubtree(t *testing.T) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	recipients := []string{ageIdentity.Recipient().String()}
+
+	store, err := GetStoreForFile("testdata/creds2.json")
+	assert.Nil(t, err)
+	err = store.EncryptSubtreeForRecipients(recipients, "secrets")
+	assert.Nil(t, err)
+	before, err := store.Subtree("secrets", "prod")
+	assert.Nil(t, err)
+	// copy the ciphertexts because the subtree is modified in place
+	ciphertexts := make(map[string]interface{})
+	for k, v := range before {
+		ciphertexts[k] = v
+	}
+
+	err = store.UpdateSubtree(recipients, "secrets")
+	assert.NotNil(t, err)
+
+	err = store.DecryptSubtree(ageIdentity.String(), "secrets")
+	assert.Nil(t, err)
+	err = store.Set("new-password8", "secrets", "prod", "secret-name8")
+	assert.Nil(t, err)
+	err = store.UpdateSubtree(recipients, "secrets")
+	assert.Nil(t, err)
+
+	after, err := store.Subtree("secrets", "prod")
+	assert.Nil(t, err)
+	assert.Equal(t, ciphertexts["secret-name7"], after["secret-name7"])
+	assert.NotEqual(t, ciphertexts["secret-name8"], after["secret-name8"])
+	assert.Equal(t, ciphertexts["secret-name9"], after["secret-name9"])
+
+	err = store.DecryptSubtree(ageIdentity.String(), "secrets")
+	assert.Nil(t, err)
+	after, err = store.Subtree("secrets", "prod")
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password7", after["secret-name7"])
+	assert.Equal(t, "new-password8", after["secret-name8"])
+}
+
+func TestJSONSet(t *testing.T) {
+	store, err := newJSONStore([]byte(`{"secrets":{"hosts":["a","b"]}}`))
+	assert.Nil(t, err)
+
+	err = store.Set(5432, "secrets", "port")
+	assert.Nil(t, err)
+	err = store.Set("c", "secrets", "hosts", "1")
+	assert.Nil(t, err)
+	err = store.Set(map[string]int{"x": 1}, "secrets", "nested")
+	assert.Nil(t, err)
+
+	st, err := store.Subtree("secrets")
+	assert.Nil(t, err)
+	assert.Equal(t, json.Number("5432"), st["port"])
+	assert.Equal(t, []interface{}{"a", "c"}, st["hosts"])
+	assert.Equal(t, map[string]interface{}{"x": json.Number("1")}, st["nested"])
+
+	err = store.Set("c", "secrets", "hosts", "2")
+	assert.NotNil(t, err)
+	err = store.Set("c", "does", "not", "exist")
+	assert.NotNil(t, err)
+	err = store.Set(make(chan int), "secrets", "port")
+	assert.NotNil(t, err)
+	err = store.Set("not a document")
+	assert.NotNil(t, err)
+}
+
+func TestJSONParallelTraversal(t *testing.T) {
+	key := newEncryptionKey()
+	macKey := newEncryptionKey()
+	df, err := newAESDecryptionFunction(key)
+	assert.Nil(t, err)
+
+	var sums [][]byte
+	for _, p := range []int{1, 2, 16} {
+		doc := bigDocument(t)
+		// mix in a couple of other types
+		doc["secrets"].(map[string]interface{})["nested"] = []interface{}{json.Number("5"), true, nil, 1.5}
+
+		hsher := newMACHasher(macVersionStructural, macKey[:])
+		err = traverseEncrypt(doc, []string{}, newDataKeyEncryptionFunction(key), hsher.write, nil, p)
+		assert.Nil(t, err)
+		sums = append(sums, hsher.Sum(nil))
+
+		hsher = newMACHasher(macVersionStructural, macKey[:])
+		err = traverseDecrypt(doc, []string{}, df, hsher.write, nil, p)
+		assert.Nil(t, err)
+		assert.Equal(t, sums[0], hsher.Sum(nil))
+		assert.Equal(t, []interface{}{json.Number("5"), true, nil, 1.5}, doc["secrets"].(map[string]interface{})["nested"])
+		assert.Equal(t, bigDocument(t)["secrets"].(map[string]interface{})["secret-0042"], doc["secrets"].(map[string]interface{})["secret-0042"])
+	}
+
+	// the MAC doesn't depend on the number of workers
+	assert.Equal(t, sums[0], sums[1])
+	assert.Equal(t, sums[0], sums[2])
+}
+
+func TestJSONParallelTraversalError(t *testing.T) {
+	ef := newDataKeyEncryptionFunction(newEncryptionKey())
+	doc := bigDocument(t)
+	err := traverseEncrypt(doc, []string{}, ef, nil, nil, 4)
+	assert.Nil(t, err)
+
+	// values encrypted with another key fail to decrypt
+	df, err := newAESDecryptionFunction(newEncryptionKey())
+	assert.Nil(t, err)
+	err = traverseDecrypt(doc, []string{}, df, func([]string, byte, []byte) error { return nil }, nil, 4)
+	assert.NotNil(t, err)
+}
+
+func BenchmarkJSONEncrypt(b *testing.B) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	benchmarkParallelism(b, func(b *testing.B, workers int) {
+		for i := 0; i < b.N; i++ {
+			b.StopTimer()
+			doc := bigDocument(b)
+			b.StartTimer()
+			encryptPerValueKey(b, doc["secrets"].(map[string]interface{}), ageIdentity.Recipient().String(), workers)
+		}
+	})
+}
+
+func BenchmarkJSONDecrypt(b *testing.B) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	doc := bigDocument(b)
+	encryptPerValueKey(b, doc["secrets"].(map[string]interface{}), ageIdentity.Recipient().String(), 0)
+	benchmarkParallelism(b, func(b *testing.B, workers int) {
+		benchmarkDecrypt(b, doc, ageIdentity.String(), workers)
+	})
+}
+
+// benchmarkParallelism runs the benchmark sequentially and with one worker per CPU.
+func benchmarkParallelism(b *testing.B, fn func(b *testing.B, workers int)) {
+	workers := []int{1}
+	if runtime.GOMAXPROCS(0) > 1 {
+		workers = append(workers, runtime.GOMAXPROCS(0))
+	}
+
+	for _, p := range workers {
+		p := p
+		b.Run(fmt.Sprintf("workers-%d", p), func(b *testing.B) {
+			fn(b, p)
+		})
+	}
+}
+
+func TestJSONPreservesLayout(t *testing.T) {
+	bites, err := ioutil.ReadFile("testdata/creds2.json")
+	assert.Nil(t, err)
+	store, err := newJSONStore(bites)
+	assert.Nil(t, err)
+
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "secrets")
+	assert.Nil(t, err)
+
+	encrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.True(t, strings.HasPrefix(string(encrypted), "{\n    \"name\": \"some-service\",\n    \"secrets\": {\n        \"dev\": {\n"))
+
+	err = store.DecryptSubtree(ageIdentity.String(), "secrets")
+	assert.Nil(t, err)
+	decrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, string(bites), string(decrypted))
+}
+
+func TestJSONKeyOrder(t *testing.T) {
+	doc := "{\n\t\"z\": 1,\n\t\"a\": {\n\t\t\"y\": [\n\t\t\t{\n\t\t\t\t\"d\": true,\n\t\t\t\t\"c\": null\n\t\t\t}\n\t\t],\n\t\t\"x\": {}\n\t}\n}"
+	store, err := newJSONStore([]byte(doc))
+	assert.Nil(t, err)
+
+	bites, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, doc, string(bites))
+
+	err = store.Set("new", "a", "b")
+	assert.Nil(t, err)
+	err = store.Delete("z")
+	assert.Nil(t, err)
+	bites, err = store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, "{\n\t\"a\": {\n\t\t\"y\": [\n\t\t\t{\n\t\t\t\t\"d\": true,\n\t\t\t\t\"c\": null\n\t\t\t}\n\t\t],\n\t\t\"x\": {},\n\t\t\"b\": \"new\"\n\t}\n}", string(bites))
+
+	store, err = newJSONStore([]byte(`{"b":1,"a":[2,3]}` + "\n"))
+	assert.Nil(t, err)
+	bites, err = store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, `{"b":1,"a":[2,3]}`+"\n", string(bites))
+}
+
+func TestJSONSeparatorsAndLineEndings(t *testing.T) {
+	for _, file := range []string{"testdata/compact.json", "testdata/crlf.json"} {
+		bites, err := ioutil.ReadFile(file)
+		assert.Nil(t, err)
+		store, err := newJSONStore(bites)
+		assert.Nil(t, err)
+
+		written, err := store.bytes()
+		assert.Nil(t, err)
+		assert.Equal(t, string(bites), string(written))
+
+		ageIdentity, err := age.GenerateX25519Identity()
+		assert.Nil(t, err)
+		err = store.EncryptSubtree(ageIdentity.Recipient().String(), "secrets")
+		assert.Nil(t, err)
+		encrypted, err := store.bytes()
+		assert.Nil(t, err)
+		assert.NotContains(t, string(encrypted), "super-secret-password")
+
+		store, err = newJSONStore(encrypted)
+		assert.Nil(t, err)
+		err = store.DecryptSubtree(ageIdentity.String(), "secrets")
+		assert.Nil(t, err)
+		decrypted, err := store.bytes()
+		assert.Nil(t, err)
+		assert.Equal(t, string(bites), string(decrypted))
+	}
+
+	store, err := newJSONStore([]byte("{\"a\": \"x,y:z\",  \"b\":   [1,2]}"))
+	assert.Nil(t, err)
+	err = store.Set(true, "c")
+	assert.Nil(t, err)
+	bites, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, "{\"a\": \"x,y:z\",  \"b\": [1,  2],  \"c\": true}", string(bites))
+}
@@ -6,6 +6,9 @@ import (
 	"path/filepath"
 )
 
+// Version is the version of keycloak. It's recorded in the metadata of every encrypted subtree.
+const Version = "0.2.0"
+
 // The file format of an encrypted file.
 type FileFormat int
 
@@ -14,6 +17,14 @@ const (
 	JSON FileFormat = iota
 	// YAML -
 	YAML
+	// TOML -
+	TOML
+	// DOTENV -
+	DOTENV
+	// INI -
+	INI
+	// PROPERTIES -
+	PROPERTIES
 )
 
 // Store defines an encrypted data file.
@@ -22,41 +33,112 @@ const (
 type Store interface {
 	// EncryptSubtree -
 	EncryptSubtree(string, ...string) error
-	// DecryptSubtree -
+	// EncryptSubtreeForRecipients encrypts the subtree at the given path so
+	// that any of the given recipients can decrypt it.
+	EncryptSubtreeForRecipients([]string, ...string) error
+	// EncryptSubtreeWithPassphrase encrypts the subtree at the given path
+	// with a key derived from the passphrase.
+	EncryptSubtreeWithPassphrase(string, ...string) error
+	// UpdateSubtree re-encrypts a subtree that was decrypted before and keeps
+	// the ciphertexts of all values that didn't change in the meantime.
+	UpdateSubtree([]string, ...string) error
+	// DecryptSubtree decrypts the subtree at the given path. The identity
+	// string may contain several age identities and SSH private keys,
+	// any one of which has to match.
 	DecryptSubtree(string, ...string) error
+	// DecryptSubtreeWithPassphrase decrypts a subtree that was encrypted
+	// with a passphrase.
+	DecryptSubtreeWithPassphrase(string, ...string) error
+	// Rotate re-encrypts all encrypted subtrees with fresh keys
+	// for the recipients recorded in their metadata.
+	Rotate(string) error
+	// RotateWithPassphrase re-encrypts all subtrees that were encrypted with
+	// the passphrase with fresh keys.
+	RotateWithPassphrase(string) error
+	// UpdateRecipients makes all encrypted subtrees readable by exactly the
+	// given recipients. It returns the recipients that were added and removed.
+	UpdateRecipients(string, []string) ([]string, []string, error)
+	// UpdateRecipientsWithPassphrase makes subtrees that were encrypted with
+	// the passphrase readable by exactly the given recipients instead.
+	UpdateRecipientsWithPassphrase(string, []string) ([]string, []string, error)
 	// Subtree -
 	Subtree(...string) (map[string]interface{}, error)
+	// Get returns the value at the given path.
+	Get(...string) (interface{}, error)
+	// Set sets the value at the given path. Missing parents are not created.
+	// Values in encrypted subtrees, including subtrees that were decrypted
+	// before, are encrypted right away.
+	Set(interface{}, ...string) error
+	// Delete removes the value at the given path.
+	Delete(...string) error
 	// ToFile -
 	ToFile(string) error
 }
 
+// StoreOption configures a store.
+type StoreOption func(*jsonStore)
+
+// WithParallelism sets the maximum number of values that are encrypted or
+// decrypted concurrently. If it isn't positive, runtime.GOMAXPROCS is used.
+func WithParallelism(n int) StoreOption {
+	return func(s *jsonStore) {
+		s.parallelism = n
+	}
+}
+
+// backedStore is implemented by all stores. They keep the document in a json store.
+type backedStore interface {
+	Store
+	backingStore() *jsonStore
+}
+
 // GetStoreForFile -
-func GetStoreForFile(path string) (Store, error) {
+func GetStoreForFile(path string, opts ...StoreOption) (Store, error) {
 	frmt, err := getFormat(path)
 	if err != nil {
 		return nil, err
 	}
 
-	return GetStoreWithFormat(path, frmt)
+	return GetStoreWithFormat(path, frmt, opts...)
 }
 
 // GetStoreWithFormat -
-func GetStoreWithFormat(path string, frmt FileFormat) (Store, error) {
+func GetStoreWithFormat(path string, frmt FileFormat, opts ...StoreOption) (Store, error) {
 	bites, err := ioutil.ReadFile(path)
 	if err != nil {
 		return nil, err
 	}
 
-	return GetStoreFromBytes(bites, frmt)
+	return GetStoreFromBytes(bites, frmt, opts...)
 }
 
 // GetStoreFromBytes -
-func GetStoreFromBytes(bites []byte, frmt FileFormat) (Store, error) {
+func GetStoreFromBytes(bites []byte, frmt FileFormat, opts ...StoreOption) (Store, error) {
+	store, err := newStore(bites, frmt)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, opt := range opts {
+		opt(store.backingStore())
+	}
+	return store, nil
+}
+
+func newStore(bites []byte, frmt FileFormat) (backedStore, error) {
 	switch frmt {
 	case JSON:
 		return newJSONStore(bites)
 	case YAML:
 		return newYAMLStore(bites)
+	case TOML:
+		return newTOMLStore(bites)
+	case DOTENV:
+		return newDotenvStore(bites)
+	case INI:
+		return newINIStore(bites)
+	case PROPERTIES:
+		return newPropertiesStore(bites)
 	default:
 		return nil, fmt.Errorf("invalid format")
 	}
@@ -68,6 +150,14 @@ func getFormat(path string) (FileFormat, error) {
 		return JSON, nil
 	case ".yaml", ".yml":
 		return YAML, nil
+	case ".toml":
+		return TOML, nil
+	case ".env":
+		return DOTENV, nil
+	case ".ini", ".cfg":
+		return INI, nil
+	case ".properties":
+		return PROPERTIES, nil
 	default:
 		return JSON, fmt.Errorf("unsupported format: %s", filepath.Ext(path))
 	}
@@ -1,7 +1,11 @@
 package keycloak
 
 import (
+	"encoding/json"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
 	"filippo.io/age"
@@ -74,3 +78,697 @@ func TestMultiTreeFile(t *testing.T) {
 	diff, _ := jsondiff.Compare(originalBites, roundtripBites, &opts)
 	assert.Equal(t, jsondiff.FullMatch, diff)
 }
+
+func TestEncryptTwice(t *testing.T) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	ageRecipient := ageIdentity.Recipient()
+
+	store, err := GetStoreForFile("testdata/creds2.json")
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(ageRecipient.String(), "secrets", "prod")
+	assert.Nil(t, err)
+	before, err := store.Subtree("secrets", "prod")
+	assert.Nil(t, err)
+	mac := before["__mac__"]
+
+	err = store.EncryptSubtree(ageRecipient.String(), "secrets", "prod")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "already encrypted")
+	err = store.EncryptSubtreeWithPassphrase("correct horse battery staple", "secrets", "prod")
+	assert.NotNil(t, err)
+	err = store.EncryptSubtree(ageRecipient.String(), "secrets")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "contains the encrypted subtree [prod]")
+	err = store.EncryptSubtree(ageRecipient.String())
+	assert.NotNil(t, err)
+
+	// the subtree can still be decrypted
+	after, err := store.Subtree("secrets", "prod")
+	assert.Nil(t, err)
+	assert.Equal(t, mac, after["__mac__"])
+	err = store.DecryptSubtree(ageIdentity.String(), "secrets", "prod")
+	assert.Nil(t, err)
+	v, err := store.Get("secrets", "prod", "secret-name7")
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password7", v)
+}
+
+func TestMultiRecipientFile(t *testing.T) {
+	identities := make([]*age.X25519Identity, 3)
+	recipients := make([]string, len(identities))
+	for idx := range identities {
+		identity, err := age.GenerateX25519Identity()
+		assert.Nil(t, err)
+		identities[idx] = identity
+		recipients[idx] = identity.Recipient().String()
+	}
+
+	store, err := GetStoreForFile("testdata/creds2.json")
+	assert.Nil(t, err)
+	err = store.EncryptSubtreeForRecipients(recipients, "secrets")
+	assert.Nil(t, err)
+
+	fd, err := ioutil.TempFile("", "TestMultiRecipientFile-")
+	assert.Nil(t, err)
+	defer fd.Close()
+	err = store.ToFile(fd.Name())
+	assert.Nil(t, err)
+
+	originalBites, err := ioutil.ReadFile("testdata/creds2.json")
+	assert.Nil(t, err)
+
+	// every single identity must be able to decrypt the file on its own
+	for _, identity := range identities {
+		bites, err := ioutil.ReadFile(fd.Name())
+		assert.Nil(t, err)
+		store2, err := GetStoreFromBytes(bites, JSON)
+		assert.Nil(t, err)
+		err = store2.DecryptSubtree(identity.String(), "secrets")
+		assert.Nil(t, err)
+
+		st, err := store2.Subtree()
+		assert.Nil(t, err)
+		roundtripBites, err := json.Marshal(st)
+		assert.Nil(t, err)
+		opts := jsondiff.DefaultConsoleOptions()
+		diff, _ := jsondiff.Compare(originalBites, roundtripBites, &opts)
+		assert.Equal(t, jsondiff.FullMatch, diff)
+	}
+
+	// a stranger can't
+	stranger, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	bites, err := ioutil.ReadFile(fd.Name())
+	assert.Nil(t, err)
+	store3, err := GetStoreFromBytes(bites, JSON)
+	assert.Nil(t, err)
+	err = store3.DecryptSubtree(stranger.String(), "secrets")
+	assert.NotNil(t, err)
+
+	err = store3.EncryptSubtreeForRecipients([]string{}, "secrets")
+	assert.NotNil(t, err)
+}
+
+func TestWithParallelism(t *testing.T) {
+	store1, err := GetStoreForFile("testdata/creds1.yaml", WithParallelism(3))
+	assert.Nil(t, err)
+	store2, err := GetStoreForFile("testdata/creds1.yaml")
+	assert.Nil(t, err)
+	assert.Equal(t, 3, store1.(backedStore).backingStore().parallelism)
+	assert.Equal(t, 0, store2.(backedStore).backingStore().parallelism)
+
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	err = store1.EncryptSubtree(ageIdentity.Recipient().String(), "secrets")
+	assert.Nil(t, err)
+	store2, err = GetStoreFromBytes(mustBytes(t, store1), YAML, WithParallelism(1))
+	assert.Nil(t, err)
+	err = store2.DecryptSubtree(ageIdentity.String(), "secrets")
+	assert.Nil(t, err)
+	v, err := store2.Get("secrets", "secret-name1")
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password1", v)
+}
+
+func TestGetSetDeletePlaintext(t *testing.T) {
+	store, err := GetStoreFromBytes([]byte(`{"name":"some-service","hosts":["a","b","c"]}`), JSON)
+	assert.Nil(t, err)
+
+	v, err := store.Get("name")
+	assert.Nil(t, err)
+	assert.Equal(t, "some-service", v)
+
+	err = store.Set("db", "hosts", "0")
+	assert.Nil(t, err)
+	err = store.Set(map[string]string{"password": "pw"}, "secrets")
+	assert.Nil(t, err)
+	err = store.Delete("hosts", "1")
+	assert.Nil(t, err)
+
+	v, err = store.Get("hosts")
+	assert.Nil(t, err)
+	assert.Equal(t, []interface{}{"db", "c"}, v)
+	v, err = store.Get("secrets", "password")
+	assert.Nil(t, err)
+	assert.Equal(t, "pw", v)
+
+	err = store.Delete("name")
+	assert.Nil(t, err)
+	_, err = store.Get("name")
+	assert.NotNil(t, err)
+	err = store.Delete("name")
+	assert.NotNil(t, err)
+	err = store.Delete()
+	assert.NotNil(t, err)
+}
+
+func TestGetSetDeleteEncrypted(t *testing.T) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	store, err := GetStoreForFile("testdata/creds2.json")
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "secrets")
+	assert.Nil(t, err)
+	st, err := store.Subtree("secrets", "dev")
+	assert.Nil(t, err)
+	ciphertext1 := st["secret-name1"]
+	ciphertext2 := st["secret-name2"]
+
+	// values can be modified without decrypting the subtree
+	err = store.Set("new-password2", "secrets", "dev", "secret-name2")
+	assert.Nil(t, err)
+	err = store.Set(true, "secrets", "dev", "enabled")
+	assert.Nil(t, err)
+	err = store.Delete("secrets", "dev", "secret-name3")
+	assert.Nil(t, err)
+
+	st, err = store.Subtree("secrets", "dev")
+	assert.Nil(t, err)
+	assert.Equal(t, ciphertext1, st["secret-name1"])
+	assert.NotEqual(t, ciphertext2, st["secret-name2"])
+	_, ok := st["enabled"].(string)
+	assert.True(t, ok)
+
+	v, err := store.Get("secrets", "dev", "secret-name2")
+	assert.Nil(t, err)
+	assert.Equal(t, "new-password2", v)
+
+	// the changes survive a roundtrip through a file
+	fd, err := ioutil.TempFile("", "TestGetSetDeleteEncrypted-")
+	assert.Nil(t, err)
+	defer fd.Close()
+	err = store.ToFile(fd.Name())
+	assert.Nil(t, err)
+	bites, err := ioutil.ReadFile(fd.Name())
+	assert.Nil(t, err)
+	store2, err := GetStoreFromBytes(bites, JSON)
+	assert.Nil(t, err)
+
+	// a store that didn't encrypt the subtree needs to decrypt it first
+	_, err = store2.Get("secrets", "dev", "secret-name1")
+	assert.NotNil(t, err)
+	err = store2.Set("x", "secrets", "dev", "secret-name1")
+	assert.NotNil(t, err)
+	err = store2.Delete("secrets", "dev", "secret-name1")
+	assert.NotNil(t, err)
+
+	err = store2.DecryptSubtree(ageIdentity.String(), "secrets")
+	assert.Nil(t, err)
+	st, err = store2.Subtree("secrets", "dev")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"secret-name1": "super-secret-password1",
+		"secret-name2": "new-password2",
+		"enabled":      true,
+	}, st)
+}
+
+func TestSetAfterDecrypt(t *testing.T) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	store, err := GetStoreForFile("testdata/creds2.json")
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "secrets")
+	assert.Nil(t, err)
+	dir, err := ioutil.TempDir("", "TestSetAfterDecrypt-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := dir + "/creds.json"
+	err = store.ToFile(file)
+	assert.Nil(t, err)
+
+	store, err = GetStoreForFile(file)
+	assert.Nil(t, err)
+	before, err := store.Subtree("secrets", "dev")
+	assert.Nil(t, err)
+	ciphertext := before["secret-name1"]
+
+	// a decrypted subtree is encrypted again as soon as it's modified
+	err = store.DecryptSubtree(ageIdentity.String(), "secrets")
+	assert.Nil(t, err)
+	err = store.Set("generated-password", "secrets", "dev", "secret-name2")
+	assert.Nil(t, err)
+	err = store.Delete("secrets", "dev", "secret-name3")
+	assert.Nil(t, err)
+	v, err := store.Get("secrets", "dev", "secret-name2")
+	assert.Nil(t, err)
+	assert.Equal(t, "generated-password", v)
+	err = store.ToFile(file)
+	assert.Nil(t, err)
+
+	bites, err := ioutil.ReadFile(file)
+	assert.Nil(t, err)
+	assert.NotContains(t, string(bites), "generated-password")
+	assert.NotContains(t, string(bites), "super-secret-password")
+
+	store, err = GetStoreForFile(file)
+	assert.Nil(t, err)
+	after, err := store.Subtree("secrets", "dev")
+	assert.Nil(t, err)
+	assert.Equal(t, ciphertext, after["secret-name1"])
+
+	err = store.DecryptSubtree(ageIdentity.String(), "secrets")
+	assert.Nil(t, err)
+	st, err := store.Subtree("secrets", "dev")
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{
+		"secret-name1": "super-secret-password1",
+		"secret-name2": "generated-password",
+	}, st)
+}
+
+func TestSetContract(t *testing.T) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	// missing parents are not created
+	store, err := GetStoreForFile("testdata/creds2.json")
+	assert.Nil(t, err)
+	err = store.Set("x", "secrets", "qa", "secret-name1")
+	assert.NotNil(t, err)
+	assert.Equal(t, "invalid path: [secrets.qa] doesn't exist", err.Error())
+
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "secrets")
+	assert.Nil(t, err)
+	err = store.Set("x", "secrets", "qa", "secret-name1")
+	assert.NotNil(t, err)
+	assert.Equal(t, "invalid path: [secrets.qa] doesn't exist", err.Error())
+	dir, err := ioutil.TempDir("", "TestSetContract-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	file := dir + "/creds.json"
+	err = store.ToFile(file)
+	assert.Nil(t, err)
+
+	// a subtree that was read encrypted needs to be decrypted first
+	store, err = GetStoreForFile(file)
+	assert.Nil(t, err)
+	err = store.Set("x", "secrets", "dev", "secret-name1")
+	assert.NotNil(t, err)
+	assert.Equal(t, "subtree [secrets] is encrypted, decrypt it first", err.Error())
+
+	// after decrypting, setting a value seals the whole subtree again
+	err = store.DecryptSubtree(ageIdentity.String(), "secrets")
+	assert.Nil(t, err)
+	st, err := store.Subtree("secrets", "dev")
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password1", st["secret-name1"])
+
+	err = store.Set("x", "secrets", "dev", "secret-name2")
+	assert.Nil(t, err)
+	st, err = store.Subtree("secrets", "dev")
+	assert.Nil(t, err)
+	assert.NotEqual(t, "super-secret-password1", st["secret-name1"])
+	assert.NotEqual(t, "x", st["secret-name2"])
+	st, err = store.Subtree("secrets")
+	assert.Nil(t, err)
+	assert.Contains(t, st, "__mac__")
+	v, err := store.Get("secrets", "dev", "secret-name2")
+	assert.Nil(t, err)
+	assert.Equal(t, "x", v)
+}
+
+func TestToFileKeepsModeAndSymlinks(t *testing.T) {
+	dir, err := ioutil.TempDir("", "TestToFileKeepsModeAndSymlinks-")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	bites, err := ioutil.ReadFile("testdata/creds2.json")
+	assert.Nil(t, err)
+	file := filepath.Join(dir, "creds.json")
+	err = ioutil.WriteFile(file, bites, 0640)
+	assert.Nil(t, err)
+	err = os.Chmod(file, 0640)
+	assert.Nil(t, err)
+	link := filepath.Join(dir, "link.json")
+	err = os.Symlink("creds.json", link)
+	assert.Nil(t, err)
+
+	store, err := GetStoreForFile(link)
+	assert.Nil(t, err)
+	err = store.Set("other-service", "name")
+	assert.Nil(t, err)
+	err = store.ToFile(link)
+	assert.Nil(t, err)
+
+	// the link still points to the file which keeps its mode
+	info, err := os.Lstat(link)
+	assert.Nil(t, err)
+	assert.Equal(t, os.ModeSymlink, info.Mode()&os.ModeSymlink)
+	info, err = os.Stat(file)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0640), info.Mode().Perm())
+	store, err = GetStoreForFile(file)
+	assert.Nil(t, err)
+	v, err := store.Get("name")
+	assert.Nil(t, err)
+	assert.Equal(t, "other-service", v)
+
+	// new files are only readable by the current user
+	newFile := filepath.Join(dir, "new.json")
+	err = store.ToFile(newFile)
+	assert.Nil(t, err)
+	info, err = os.Stat(newFile)
+	assert.Nil(t, err)
+	assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+}
+
+func TestRotate(t *testing.T) {
+	identity1, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	identity2, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	recipients := []string{identity1.Recipient().String(), identity2.Recipient().String()}
+
+	store, err := GetStoreForFile("testdata/creds2.json")
+	assert.Nil(t, err)
+	err = store.EncryptSubtreeForRecipients(recipients, "secrets", "dev")
+	assert.Nil(t, err)
+	err = store.EncryptSubtreeForRecipients(recipients[:1], "secrets", "prod")
+	assert.Nil(t, err)
+	dev, err := store.Subtree("secrets", "dev")
+	assert.Nil(t, err)
+	ciphertext := dev["secret-name1"]
+	created := dev["__keycloak__"].(map[string]interface{})["created"]
+
+	// identity2 can't decrypt all subtrees
+	err = store.Rotate(identity2.String())
+	assert.NotNil(t, err)
+	dev, err = store.Subtree("secrets", "dev")
+	assert.Nil(t, err)
+	assert.Equal(t, ciphertext, dev["secret-name1"])
+
+	store, err = GetStoreFromBytes(mustBytes(t, store), JSON)
+	assert.Nil(t, err)
+	err = store.Rotate(identity1.String())
+	assert.Nil(t, err)
+
+	dev, err = store.Subtree("secrets", "dev")
+	assert.Nil(t, err)
+	assert.NotEqual(t, ciphertext, dev["secret-name1"])
+	assert.Equal(t, created, dev["__keycloak__"].(map[string]interface{})["created"])
+
+	// the recipients are kept
+	err = store.DecryptSubtree(identity2.String(), "secrets", "dev")
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(identity1.String(), "secrets", "prod")
+	assert.Nil(t, err)
+	st, err := store.Subtree("secrets", "stage")
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password4", st["secret-name4"])
+}
+
+func mustBytes(t *testing.T, store Store) []byte {
+	fd, err := ioutil.TempFile("", "keycloak-test-")
+	assert.Nil(t, err)
+	defer os.Remove(fd.Name())
+	defer fd.Close()
+
+	err = store.ToFile(fd.Name())
+	assert.Nil(t, err)
+	bites, err := ioutil.ReadFile(fd.Name())
+	assert.Nil(t, err)
+	return bites
+}
+
+func TestUpdateRecipients(t *testing.T) {
+	identities := make([]*age.X25519Identity, 3)
+	recipients := make([]string, len(identities))
+	for idx := range identities {
+		identity, err := age.GenerateX25519Identity()
+		assert.Nil(t, err)
+		identities[idx] = identity
+		recipients[idx] = identity.Recipient().String()
+	}
+
+	store, err := GetStoreForFile("testdata/creds2.json")
+	assert.Nil(t, err)
+	err = store.EncryptSubtreeForRecipients(recipients[:1], "secrets", "dev")
+	assert.Nil(t, err)
+	err = store.EncryptSubtreeForRecipients(recipients[:2], "secrets", "prod")
+	assert.Nil(t, err)
+	dev, err := store.Subtree("secrets", "dev")
+	assert.Nil(t, err)
+	ciphertext := dev["secret-name1"].(string)
+
+	_, _, err = store.UpdateRecipients(identities[2].String(), recipients)
+	assert.NotNil(t, err)
+
+	added, removed, err := store.UpdateRecipients(identities[0].String(), []string{recipients[0], recipients[2]})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{recipients[2]}, added)
+	assert.Equal(t, []string{recipients[1]}, removed)
+
+	// only the data key is wrapped for the new recipients
+	dev, err = store.Subtree("secrets", "dev")
+	assert.Nil(t, err)
+	assert.Equal(t, ciphertext, dev["secret-name1"])
+
+	bites := mustBytes(t, store)
+	store2, err := GetStoreFromBytes(bites, JSON)
+	assert.Nil(t, err)
+	err = store2.DecryptSubtree(identities[1].String(), "secrets", "prod")
+	assert.NotNil(t, err)
+
+	store2, err = GetStoreFromBytes(bites, JSON)
+	assert.Nil(t, err)
+	err = store2.DecryptSubtree(identities[2].String(), "secrets", "dev")
+	assert.Nil(t, err)
+	err = store2.DecryptSubtree(identities[2].String(), "secrets", "prod")
+	assert.Nil(t, err)
+	st, err := store2.Subtree("secrets", "prod")
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password9", st["secret-name9"])
+}
+
+func TestPassphrase(t *testing.T) {
+	defer func(f int) {
+		scryptWorkFactor = f
+	}(scryptWorkFactor)
+	scryptWorkFactor = 10
+
+	store, err := GetStoreForFile("testdata/creds1.yaml")
+	assert.Nil(t, err)
+	err = store.EncryptSubtreeWithPassphrase("correct horse battery staple", "secrets")
+	assert.Nil(t, err)
+	st, err := store.Subtree("secrets")
+	assert.Nil(t, err)
+	ciphertext := st["secret-name1"]
+	meta, err := parseMetadata(st["__keycloak__"])
+	assert.Nil(t, err)
+	assert.Equal(t, []string{passphraseRecipient}, meta.Recipients)
+	bites := mustBytes(t, store)
+
+	store, err = GetStoreFromBytes(bites, YAML)
+	assert.Nil(t, err)
+	err = store.DecryptSubtreeWithPassphrase("wrong passphrase", "secrets")
+	assert.NotNil(t, err)
+	err = store.DecryptSubtree(testIdentity, "secrets")
+	assert.NotNil(t, err)
+
+	err = store.DecryptSubtreeWithPassphrase("correct horse battery staple", "secrets")
+	assert.Nil(t, err)
+	st, err = store.Subtree("secrets")
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password1", st["secret-name1"])
+
+	// the data key is kept without asking for the passphrase again
+	err = store.Set("changed-password2", "secrets", "secret-name2")
+	assert.Nil(t, err)
+	err = store.UpdateSubtree(nil, "secrets")
+	assert.Nil(t, err)
+	st, err = store.Subtree("secrets")
+	assert.Nil(t, err)
+	assert.Equal(t, ciphertext, st["secret-name1"])
+
+	store, err = GetStoreFromBytes(mustBytes(t, store), YAML)
+	assert.Nil(t, err)
+	err = store.DecryptSubtreeWithPassphrase("correct horse battery staple", "secrets")
+	assert.Nil(t, err)
+	v, err := store.Get("secrets", "secret-name2")
+	assert.Nil(t, err)
+	assert.Equal(t, "changed-password2", v)
+}
+
+func TestRotatePassphrase(t *testing.T) {
+	defer func(f int) {
+		scryptWorkFactor = f
+	}(scryptWorkFactor)
+	scryptWorkFactor = 10
+
+	store, err := GetStoreForFile("testdata/creds1.yaml")
+	assert.Nil(t, err)
+	err = store.EncryptSubtreeWithPassphrase("correct horse battery staple", "secrets")
+	assert.Nil(t, err)
+	st, err := store.Subtree("secrets")
+	assert.Nil(t, err)
+	ciphertext := st["secret-name1"]
+	bites := mustBytes(t, store)
+
+	store, err = GetStoreFromBytes(bites, YAML)
+	assert.Nil(t, err)
+	err = store.Rotate(testIdentity)
+	assert.NotNil(t, err)
+	err = store.RotateWithPassphrase("wrong passphrase")
+	assert.NotNil(t, err)
+	err = store.RotateWithPassphrase("correct horse battery staple")
+	assert.Nil(t, err)
+
+	st, err = store.Subtree("secrets")
+	assert.Nil(t, err)
+	assert.NotEqual(t, ciphertext, st["secret-name1"])
+	meta, err := parseMetadata(st["__keycloak__"])
+	assert.Nil(t, err)
+	assert.Equal(t, []string{passphraseRecipient}, meta.Recipients)
+
+	store, err = GetStoreFromBytes(mustBytes(t, store), YAML)
+	assert.Nil(t, err)
+	err = store.DecryptSubtreeWithPassphrase("correct horse battery staple", "secrets")
+	assert.Nil(t, err)
+	v, err := store.Get("secrets", "secret-name1")
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password1", v)
+}
+
+func TestUpdateRecipientsPassphrase(t *testing.T) {
+	defer func(f int) {
+		scryptWorkFactor = f
+	}(scryptWorkFactor)
+	scryptWorkFactor = 10
+
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	store, err := GetStoreForFile("testdata/creds1.yaml")
+	assert.Nil(t, err)
+	err = store.EncryptSubtreeWithPassphrase("correct horse battery staple", "secrets")
+	assert.Nil(t, err)
+	st, err := store.Subtree("secrets")
+	assert.Nil(t, err)
+	ciphertext := st["secret-name1"]
+
+	store, err = GetStoreFromBytes(mustBytes(t, store), YAML)
+	assert.Nil(t, err)
+	added, removed, err := store.UpdateRecipientsWithPassphrase("correct horse battery staple", []string{ageIdentity.Recipient().String()})
+	assert.Nil(t, err)
+	assert.Equal(t, []string{ageIdentity.Recipient().String()}, added)
+	assert.Equal(t, []string{passphraseRecipient}, removed)
+
+	// only the data key is wrapped for the recipients
+	st, err = store.Subtree("secrets")
+	assert.Nil(t, err)
+	assert.Equal(t, ciphertext, st["secret-name1"])
+
+	store, err = GetStoreFromBytes(mustBytes(t, store), YAML)
+	assert.Nil(t, err)
+	err = store.DecryptSubtreeWithPassphrase("correct horse battery staple", "secrets")
+	assert.NotNil(t, err)
+	err = store.DecryptSubtree(ageIdentity.String(), "secrets")
+	assert.Nil(t, err)
+	v, err := store.Get("secrets", "secret-name1")
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password1", v)
+}
+
+func TestSSHKeys(t *testing.T) {
+	defer func() {
+		SSHKeyPassphrase = nil
+	}()
+
+	readKey := func(path string) string {
+		bites, err := ioutil.ReadFile(path)
+		assert.Nil(t, err)
+		return strings.TrimSpace(string(bites))
+	}
+
+	recipients := []string{
+		readKey("testdata/id_ed25519.pub"),
+		readKey("testdata/id_rsa.pub"),
+		readKey("testdata/id_ed25519_encrypted.pub"),
+	}
+	store, err := GetStoreForFile("testdata/creds2.json")
+	assert.Nil(t, err)
+	err = store.EncryptSubtreeForRecipients(recipients, "secrets", "prod")
+	assert.Nil(t, err)
+	bites := mustBytes(t, store)
+
+	for _, keyFile := range []string{"testdata/id_ed25519", "testdata/id_rsa"} {
+		store, err := GetStoreFromBytes(bites, JSON)
+		assert.Nil(t, err)
+		err = store.DecryptSubtree(readKey(keyFile), "secrets", "prod")
+		assert.Nil(t, err, keyFile)
+		v, err := store.Get("secrets", "prod", "secret-name7")
+		assert.Nil(t, err)
+		assert.Equal(t, "super-secret-password7", v)
+	}
+
+	// encrypted keys need a passphrase
+	encryptedKey := readKey("testdata/id_ed25519_encrypted")
+	store, err = GetStoreFromBytes(bites, JSON)
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(encryptedKey, "secrets", "prod")
+	assert.NotNil(t, err)
+
+	SSHKeyPassphrase = func(func([]byte) bool) ([]byte, error) {
+		return []byte("wrong"), nil
+	}
+	store, err = GetStoreFromBytes(bites, JSON)
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(encryptedKey, "secrets", "prod")
+	assert.NotNil(t, err)
+
+	SSHKeyPassphrase = func(func([]byte) bool) ([]byte, error) {
+		return []byte("keycloak"), nil
+	}
+	store, err = GetStoreFromBytes(bites, JSON)
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(encryptedKey, "secrets", "prod")
+	assert.Nil(t, err)
+
+	// keys that aren't recipients don't ask for a passphrase
+	asked := false
+	SSHKeyPassphrase = func(func([]byte) bool) ([]byte, error) {
+		asked = true
+		return []byte("keycloak"), nil
+	}
+	store, err = GetStoreForFile("testdata/creds2.json")
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(recipients[0], "secrets", "dev")
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(encryptedKey, "secrets", "dev")
+	assert.NotNil(t, err)
+	assert.False(t, asked)
+}
+
+func TestMultipleIdentities(t *testing.T) {
+	sshKey, err := ioutil.ReadFile("testdata/id_ed25519")
+	assert.Nil(t, err)
+	sshPubKey, err := ioutil.ReadFile("testdata/id_ed25519.pub")
+	assert.Nil(t, err)
+	stranger, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	store, err := GetStoreForFile("testdata/creds2.json")
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(strings.TrimSpace(string(sshPubKey)), "secrets", "dev")
+	assert.Nil(t, err)
+	err = store.EncryptSubtree("age133p5vy8lw48dw59jdl7rrlpm50dslc6m6kpjc3slaq2edmqayyas5pv8se", "secrets", "prod")
+	assert.Nil(t, err)
+
+	identities := "# personal key\n" + stranger.String() + "\n\n# team key\n" + testIdentity + "\n" + string(sshKey)
+	err = store.DecryptSubtree(identities, "secrets", "dev")
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(identities, "secrets", "prod")
+	assert.Nil(t, err)
+	v, err := store.Get("secrets", "prod", "secret-name9")
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password9", v)
+
+	_, err = parseIdentities("# just a comment\n")
+	assert.NotNil(t, err)
+	_, err = parseIdentities(testIdentity + "\nnot-a-key\n")
+	assert.NotNil(t, err)
+}
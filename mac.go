@@ -0,0 +1,99 @@
+package keycloak
+
+import (
+	"crypto/hmac"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+)
+
+type macVersion byte
+
+const (
+	// macVersionLegacy marks MACs that were written without a version byte.
+	// They are keyed with the constant legacyMACKey.
+	macVersionLegacy macVersion = 0
+	// macVersionRandomKey MACs are keyed with a random per-subtree key.
+	// The key is encrypted together with the sum.
+	macVersionRandomKey macVersion = 1
+	// macVersionStructural MACs additionally authenticate the path and type of
+	// every leaf as well as the shape of all objects and arrays in the subtree.
+	macVersionStructural macVersion = 2
+
+	legacyMACKey = "1234567890"
+	macKeySize   = 32
+
+	// objectMarker and arrayMarker are fed into the hasher in place of a
+	// type byte for objects and arrays respectively.
+	objectMarker byte = 'o'
+	arrayMarker  byte = 'a'
+	// metadataMarker is fed into the hasher together with the subtree's metadata.
+	metadataMarker byte = 'm'
+)
+
+func (v macVersion) String() string {
+	switch v {
+	case macVersionLegacy:
+		return "hmac-sha512/256-v0"
+	case macVersionRandomKey:
+		return "hmac-sha512/256-v1"
+	case macVersionStructural:
+		return "hmac-sha512/256-v2"
+	default:
+		return fmt.Sprintf("unknown-%d", byte(v))
+	}
+}
+
+func newMACHasher(version macVersion, macKey []byte) *hasher {
+	return &hasher{
+		Hash:    hmac.New(sha512.New512_256, macKey),
+		version: version,
+	}
+}
+
+// encodeMAC encrypts the MAC key and sum and prefixes them with the version
+// byte. Output takes the form version|ef(key|sum) base64 encoded.
+func encodeMAC(version macVersion, macKey []byte, sum []byte, ef encryptionFunc) (string, error) {
+	bites, err := ef(joinSize(len(macKey)+len(sum), macKey, sum))
+	if err != nil {
+		return "", err
+	}
+
+	bites = joinSize(1+len(bites), []byte{byte(version)}, bites)
+	return base64.StdEncoding.EncodeToString(bites), nil
+}
+
+// decodeMAC is the inverse of encodeMAC. It also understands legacy MACs
+// which consist of the encrypted sum only.
+func decodeMAC(mac string, df decryptionFunc) (macVersion, []byte, []byte, error) {
+	bites, err := base64.StdEncoding.DecodeString(mac)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+
+	if len(bites) == 0 {
+		return 0, nil, nil, fmt.Errorf("invalid mac")
+	}
+
+	version := macVersion(bites[0])
+	switch version {
+	case macVersionRandomKey, macVersionStructural:
+		bites, err = df(bites[1:])
+		if err != nil {
+			return 0, nil, nil, err
+		}
+
+		if len(bites) <= macKeySize {
+			return 0, nil, nil, fmt.Errorf("invalid mac")
+		}
+		return version, bites[:macKeySize], bites[macKeySize:], nil
+
+	default:
+		// legacy MACs start with the age header right away
+		bites, err = df(bites)
+		if err != nil {
+			return 0, nil, nil, err
+		}
+		return macVersionLegacy, []byte(legacyMACKey), bites, nil
+	}
+}
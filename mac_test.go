@@ -0,0 +1,208 @@
+package keycloak
+
+import (
+	"bytes"
+	"encoding/base64"
+	"os"
+	"strings"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+)
+
+const testIdentity = "AGE-SECRET-KEY-1C2JYKATVQLH8LLLZRNCS02SH457T9GLVYJ9KQ6DL9MGL7HD8QH4SJCS3CP"
+
+// newAgeEncryptionFunction returns an encryptionFunc that encrypts every value
+// with a fresh AES key and wraps the result for all given recipients. Any one
+// of the matching identities is able to decrypt the result.
+func newAgeEncryptionFunction(pubKeys ...string) (encryptionFunc, error) {
+	wrapFunc, err := newAgeWrapFunction(pubKeys...)
+	if err != nil {
+		return nil, err
+	}
+
+	aesFunc, err := newAESEncryptionFunction()
+	if err != nil {
+		return nil, err
+	}
+
+	return func(bites []byte) ([]byte, error) {
+		bites, err := aesFunc(bites)
+		if err != nil {
+			return nil, err
+		}
+
+		return wrapFunc(bites)
+	}, nil
+}
+
+// encryptSubtreeWithHasher encrypts all values in v without adding a MAC
+// and feeds them to hf instead.
+func encryptSubtreeWithHasher(v map[string]interface{}, ef encryptionFunc, hf hashingFunc) error {
+	return traverseEncrypt(v, []string{}, ef, hf, nil, 0)
+}
+
+func TestMACRoundtrip(t *testing.T) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	ef, err := newAgeEncryptionFunction(ageIdentity.Recipient().String())
+	assert.Nil(t, err)
+	df, err := newAgeDecryptionFunction(ageIdentity.String())
+	assert.Nil(t, err)
+
+	macKey := newEncryptionKey()
+	mac, err := encodeMAC(macVersionRandomKey, macKey[:], []byte("sum"), ef)
+	assert.Nil(t, err)
+
+	bites, err := base64.StdEncoding.DecodeString(mac)
+	assert.Nil(t, err)
+	assert.Equal(t, byte(macVersionRandomKey), bites[0])
+
+	version, key, sum, err := decodeMAC(mac, df)
+	assert.Nil(t, err)
+	assert.Equal(t, macVersionRandomKey, version)
+	assert.Equal(t, macKey[:], key)
+	assert.Equal(t, []byte("sum"), sum)
+}
+
+func TestMACLegacyFile(t *testing.T) {
+	store, err := GetStoreForFile("testdata/creds1.enc.yaml")
+	assert.Nil(t, err)
+	st, err := store.Subtree("secrets")
+	assert.Nil(t, err)
+
+	df, err := newAgeDecryptionFunction(testIdentity)
+	assert.Nil(t, err)
+	version, key, _, err := decodeMAC(st["__mac__"].(string), df)
+	assert.Nil(t, err)
+	assert.Equal(t, macVersionLegacy, version)
+	assert.Equal(t, []byte(legacyMACKey), key)
+
+	err = store.DecryptSubtree(testIdentity, "secrets")
+	assert.Nil(t, err)
+	st, err = store.Subtree("secrets")
+	assert.Nil(t, err)
+	assert.Equal(t, "super-secret-password1", st["secret-name1"])
+}
+
+func TestMACKeyPerSubtree(t *testing.T) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	store, err := GetStoreForFile("testdata/creds2.json")
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "secrets", "dev")
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "secrets", "stage")
+	assert.Nil(t, err)
+
+	dev, err := store.Subtree("secrets", "dev")
+	assert.Nil(t, err)
+	stage, err := store.Subtree("secrets", "stage")
+	assert.Nil(t, err)
+
+	_, devKey, _, err := decodeMAC(dev["__mac__"].(string), dataKeyDecryptionFunction(t, dev, ageIdentity.String()))
+	assert.Nil(t, err)
+	_, stageKey, _, err := decodeMAC(stage["__mac__"].(string), dataKeyDecryptionFunction(t, stage, ageIdentity.String()))
+	assert.Nil(t, err)
+	assert.NotEqual(t, devKey, stageKey)
+
+	// a mac from another subtree doesn't verify
+	dev["__mac__"] = stage["__mac__"]
+	err = store.DecryptSubtree(ageIdentity.String(), "secrets", "dev")
+	assert.NotNil(t, err)
+	assert.True(t, strings.Contains(err.Error(), "invalid mac"))
+}
+
+// dataKeyDecryptionFunction unwraps the data key of an encrypted subtree.
+func dataKeyDecryptionFunction(t *testing.T, st map[string]interface{}, identity string) decryptionFunc {
+	meta, err := parseMetadata(st["__keycloak__"])
+	assert.Nil(t, err)
+	unwrapFunc, err := newAgeUnwrapFunction(identity)
+	assert.Nil(t, err)
+	key, err := unwrapDataKey(meta.DataKey, unwrapFunc)
+	assert.Nil(t, err)
+	df, err := newAESDecryptionFunction(key)
+	assert.Nil(t, err)
+	return df
+}
+
+func TestMACDetectsStructuralTampering(t *testing.T) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	tamperings := []func(st map[string]interface{}){
+		// swap two values
+		func(st map[string]interface{}) {
+			st["db_password"], st["api_key"] = st["api_key"], st["db_password"]
+		},
+		// rename a key
+		func(st map[string]interface{}) {
+			st["renamed"] = st["api_key"]
+			delete(st, "api_key")
+		},
+		// reorder an array
+		func(st map[string]interface{}) {
+			a := st["hosts"].([]interface{})
+			a[0], a[1] = a[1], a[0]
+		},
+		// turn an object into an array
+		func(st map[string]interface{}) {
+			st["nested"] = []interface{}{st["nested"].(map[string]interface{})["0"]}
+		},
+	}
+
+	for idx, tamper := range tamperings {
+		store, err := GetStoreFromBytes([]byte(`{"prod":{"db_password":"pw1","api_key":"pw2","hosts":["a","b"],"nested":{"0":"x"}}}`), JSON)
+		assert.Nil(t, err)
+		err = store.EncryptSubtree(ageIdentity.Recipient().String(), "prod")
+		assert.Nil(t, err)
+
+		st, err := store.Subtree("prod")
+		assert.Nil(t, err)
+		tamper(st)
+
+		err = store.DecryptSubtree(ageIdentity.String(), "prod")
+		assert.NotNil(t, err, "tampering %d went unnoticed", idx)
+	}
+}
+
+func TestMACOldVersionWarning(t *testing.T) {
+	var buf bytes.Buffer
+	Logger.SetOutput(&buf)
+	defer Logger.SetOutput(os.Stderr)
+
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	ef, err := newAgeEncryptionFunction(ageIdentity.Recipient().String())
+	assert.Nil(t, err)
+
+	// write a subtree with a version 1 MAC
+	store, err := GetStoreFromBytes([]byte(`{"prod":{"db_password":"pw1","api_key":"pw2"}}`), JSON)
+	assert.Nil(t, err)
+	st, err := store.Subtree("prod")
+	assert.Nil(t, err)
+	macKey := newEncryptionKey()
+	hsher := newMACHasher(macVersionRandomKey, macKey[:])
+	err = encryptSubtreeWithHasher(st, ef, hsher.write)
+	assert.Nil(t, err)
+	st["__mac__"], err = encodeMAC(macVersionRandomKey, macKey[:], hsher.Sum(nil), ef)
+	assert.Nil(t, err)
+
+	err = store.DecryptSubtree(ageIdentity.String(), "prod")
+	assert.Nil(t, err)
+	assert.Contains(t, buf.String(), "subtree [prod] uses MAC version 1")
+
+	st, err = store.Subtree("prod")
+	assert.Nil(t, err)
+	assert.Equal(t, "pw1", st["db_password"])
+
+	// current MACs don't trigger a warning
+	buf.Reset()
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "prod")
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(ageIdentity.String(), "prod")
+	assert.Nil(t, err)
+	assert.Equal(t, 0, buf.Len())
+}
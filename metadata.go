@@ -0,0 +1,137 @@
+package keycloak
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+const (
+	// formatVersionPerValueKey encrypts every value with its own AES-256-GCM
+	// key which in turn is encrypted for all recipients with age.
+	formatVersionPerValueKey = 1
+
+	// formatVersionEnvelope encrypts all values of a subtree with the same
+	// AES-256-GCM data key. The data key is encrypted for all recipients
+	// with age and stored in the metadata.
+	formatVersionEnvelope = 2
+
+	cipherPerValueKey = "age+aes-256-gcm"
+	cipherEnvelope    = "age-data-key+aes-256-gcm"
+)
+
+// now is replaced in tests
+var now = time.Now
+
+// metadata describes an encrypted subtree. It is stored next to the MAC
+// and is covered by the MAC.
+type metadata struct {
+	Version         int       `json:"version"`
+	Recipients      []string  `json:"recipients"`
+	Created         time.Time `json:"created"`
+	Modified        time.Time `json:"modified"`
+	MAC             string    `json:"mac"`
+	Cipher          string    `json:"cipher"`
+	KeycloakVersion string    `json:"keycloak_version"`
+	// DataKey is only set for subtrees using formatVersionEnvelope
+	DataKey string `json:"data_key,omitempty"`
+}
+
+func newMetadata(recipients []string) *metadata {
+	t := now().UTC().Truncate(time.Second)
+	rs := make([]string, len(recipients))
+	copy(rs, recipients)
+	sort.Strings(rs)
+	return &metadata{
+		Version:         formatVersionEnvelope,
+		Recipients:      rs,
+		Created:         t,
+		Modified:        t,
+		MAC:             macVersionStructural.String(),
+		Cipher:          cipherEnvelope,
+		KeycloakVersion: Version,
+	}
+}
+
+// parseMetadata reads the metadata of a subtree as it's stored in the document.
+func parseMetadata(v interface{}) (*metadata, error) {
+	bites, err := json.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	m := &metadata{}
+	err = json.Unmarshal(bites, m)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %s", err.Error())
+	}
+	return m, nil
+}
+
+// validate checks that the subtree can be decrypted and that the metadata
+// agrees with the version of the subtree's MAC.
+func (m *metadata) validate(version macVersion) error {
+	switch m.Version {
+	case formatVersionPerValueKey:
+		if m.Cipher != cipherPerValueKey {
+			return fmt.Errorf("unsupported cipher %s", m.Cipher)
+		}
+
+		if m.DataKey != "" {
+			return fmt.Errorf("invalid metadata: unexpected data key")
+		}
+
+	case formatVersionEnvelope:
+		if m.Cipher != cipherEnvelope {
+			return fmt.Errorf("unsupported cipher %s", m.Cipher)
+		}
+
+		if m.DataKey == "" {
+			return fmt.Errorf("invalid metadata: no data key")
+		}
+
+	default:
+		return fmt.Errorf("unsupported format version %d", m.Version)
+	}
+
+	if m.MAC != version.String() {
+		return fmt.Errorf("metadata doesn't match mac: %s != %s", m.MAC, version.String())
+	}
+
+	if len(m.Recipients) == 0 {
+		return fmt.Errorf("invalid metadata: no recipients")
+	}
+
+	if m.Created.IsZero() || m.Modified.Before(m.Created) {
+		return fmt.Errorf("invalid metadata: timestamps")
+	}
+	return nil
+}
+
+// bytes returns the canonical encoding of the metadata that is fed into the MAC.
+func (m *metadata) bytes() ([]byte, error) {
+	return json.Marshal(m)
+}
+
+// toValue converts the metadata into the representation stored in the document.
+func (m *metadata) toValue() (interface{}, error) {
+	return normalizeValue(m)
+}
+
+// hasRecipients returns true if the subtree is encrypted for exactly the given recipients.
+func (m *metadata) hasRecipients(recipients []string) bool {
+	if len(m.Recipients) != len(recipients) {
+		return false
+	}
+
+	rs := make([]string, len(recipients))
+	copy(rs, recipients)
+	sort.Strings(rs)
+	for idx := range rs {
+		if rs[idx] != m.Recipients[idx] {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,174 @@
+package keycloak
+
+import (
+	"testing"
+	"time"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+)
+
+func stubNow(t time.Time) func() {
+	now = func() time.Time {
+		return t
+	}
+	return func() {
+		now = time.Now
+	}
+}
+
+func TestMetadataWritten(t *testing.T) {
+	created := time.Date(2022, 2, 1, 10, 0, 0, 0, time.UTC)
+	defer stubNow(created)()
+
+	identity1, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	identity2, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	recipients := []string{identity1.Recipient().String(), identity2.Recipient().String()}
+
+	store, err := GetStoreForFile("testdata/creds2.json")
+	assert.Nil(t, err)
+	err = store.EncryptSubtreeForRecipients(recipients, "secrets", "prod")
+	assert.Nil(t, err)
+
+	st, err := store.Subtree("secrets", "prod")
+	assert.Nil(t, err)
+	meta, err := parseMetadata(st["__keycloak__"])
+	assert.Nil(t, err)
+	assert.Equal(t, formatVersionEnvelope, meta.Version)
+	assert.ElementsMatch(t, recipients, meta.Recipients)
+	assert.Equal(t, created, meta.Created)
+	assert.Equal(t, created, meta.Modified)
+	assert.Equal(t, "hmac-sha512/256-v2", meta.MAC)
+	assert.Equal(t, cipherEnvelope, meta.Cipher)
+	assert.Equal(t, Version, meta.KeycloakVersion)
+	assert.NotEmpty(t, meta.DataKey)
+
+	// the metadata isn't part of the decrypted subtree
+	err = store.DecryptSubtree(identity2.String(), "secrets", "prod")
+	assert.Nil(t, err)
+	st, err = store.Subtree("secrets", "prod")
+	assert.Nil(t, err)
+	_, ok := st["__keycloak__"]
+	assert.False(t, ok)
+	assert.Equal(t, 3, len(st))
+}
+
+func TestMetadataTampering(t *testing.T) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	stranger, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	tamperings := []func(meta map[string]interface{}){
+		func(meta map[string]interface{}) {
+			meta["recipients"] = []interface{}{ageIdentity.Recipient().String(), stranger.Recipient().String()}
+		},
+		func(meta map[string]interface{}) {
+			meta["created"] = "2000-01-01T00:00:00Z"
+		},
+		func(meta map[string]interface{}) {
+			meta["mac"] = "hmac-sha512/256-v1"
+		},
+		func(meta map[string]interface{}) {
+			meta["version"] = 42
+		},
+		func(meta map[string]interface{}) {
+			meta["recipients"] = "nobody"
+		},
+	}
+
+	for idx, tamper := range tamperings {
+		store, err := GetStoreForFile("testdata/creds1.yaml")
+		assert.Nil(t, err)
+		err = store.EncryptSubtree(ageIdentity.Recipient().String(), "secrets")
+		assert.Nil(t, err)
+
+		st, err := store.Subtree("secrets")
+		assert.Nil(t, err)
+		tamper(st["__keycloak__"].(map[string]interface{}))
+
+		err = store.DecryptSubtree(ageIdentity.String(), "secrets")
+		assert.NotNil(t, err, "tampering %d went unnoticed", idx)
+	}
+}
+
+func TestMetadataUpdateSubtree(t *testing.T) {
+	created := time.Date(2022, 2, 1, 10, 0, 0, 0, time.UTC)
+	modified := created.Add(time.Hour)
+	restore := stubNow(created)
+	defer restore()
+
+	identity1, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	identity2, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	store, err := GetStoreForFile("testdata/creds1.yaml")
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(identity1.Recipient().String(), "secrets")
+	assert.Nil(t, err)
+	st, err := store.Subtree("secrets")
+	assert.Nil(t, err)
+	ciphertext := st["secret-name1"]
+
+	// without recipients the recorded ones are used
+	stubNow(modified)
+	err = store.DecryptSubtree(identity1.String(), "secrets")
+	assert.Nil(t, err)
+	err = store.UpdateSubtree(nil, "secrets")
+	assert.Nil(t, err)
+	st, err = store.Subtree("secrets")
+	assert.Nil(t, err)
+	assert.Equal(t, ciphertext, st["secret-name1"])
+	meta, err := parseMetadata(st["__keycloak__"])
+	assert.Nil(t, err)
+	assert.Equal(t, created, meta.Created)
+	assert.Equal(t, modified, meta.Modified)
+	assert.Equal(t, []string{identity1.Recipient().String()}, meta.Recipients)
+
+	// new recipients require new ciphertexts
+	err = store.DecryptSubtree(identity1.String(), "secrets")
+	assert.Nil(t, err)
+	err = store.UpdateSubtree([]string{identity2.Recipient().String()}, "secrets")
+	assert.Nil(t, err)
+	st, err = store.Subtree("secrets")
+	assert.Nil(t, err)
+	assert.NotEqual(t, ciphertext, st["secret-name1"])
+	err = store.DecryptSubtree(identity2.String(), "secrets")
+	assert.Nil(t, err)
+}
+
+func TestMetadataLegacyFile(t *testing.T) {
+	store, err := GetStoreForFile("testdata/creds1.enc.yaml")
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(testIdentity, "secrets")
+	assert.Nil(t, err)
+
+	// legacy files don't know their recipients
+	err = store.UpdateSubtree(nil, "secrets")
+	assert.NotNil(t, err)
+}
+
+func TestMetadataValidate(t *testing.T) {
+	_, meta, err := newEnvelope([]string{"age133p5vy8lw48dw59jdl7rrlpm50dslc6m6kpjc3slaq2edmqayyas5pv8se"})
+	assert.Nil(t, err)
+	assert.Nil(t, meta.validate(macVersionStructural))
+	assert.NotNil(t, meta.validate(macVersionRandomKey))
+
+	// the data key and the format version go together
+	dataKey := meta.DataKey
+	meta.DataKey = ""
+	assert.NotNil(t, meta.validate(macVersionStructural))
+	meta.Version = formatVersionPerValueKey
+	meta.Cipher = cipherPerValueKey
+	assert.Nil(t, meta.validate(macVersionStructural))
+	meta.DataKey = dataKey
+	assert.NotNil(t, meta.validate(macVersionStructural))
+
+	meta = newMetadata([]string{"age133p5vy8lw48dw59jdl7rrlpm50dslc6m6kpjc3slaq2edmqayyas5pv8se"})
+	meta.DataKey = dataKey
+	meta.Modified = meta.Created.Add(-time.Second)
+	assert.NotNil(t, meta.validate(macVersionStructural))
+}
@@ -0,0 +1,459 @@
+package keycloak
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+)
+
+// propertiesLine is a logical line of a properties file, i.e. a line and its
+// continuation lines. Comments and blank lines have no key.
+type propertiesLine struct {
+	raw   string
+	key   string
+	value string
+	// prefix is everything in front of the value
+	prefix string
+}
+
+// newPropertiesStore reads a Java properties file. Keys are split at their
+// dots so that e.g. all keys starting with "database." form a subtree.
+func newPropertiesStore(bites []byte) (*propertiesStore, error) {
+	rawLines, trailingNewline := splitLines(bites)
+
+	root := make(map[string]interface{})
+	var lines []*propertiesLine
+	for idx := 0; idx < len(rawLines); idx++ {
+		line, consumed, err := parsePropertiesLine(rawLines[idx:])
+		if err != nil {
+			return nil, fmt.Errorf("line %d: %s", idx+1, err.Error())
+		}
+		lines = append(lines, line)
+
+		if line.key != "" {
+			err = setProperty(root, line.key, line.value)
+			if err != nil {
+				return nil, fmt.Errorf("line %d: %s", idx+1, err.Error())
+			}
+		}
+		idx += consumed - 1
+	}
+
+	return &propertiesStore{
+		js: &jsonStore{
+			root:     root,
+			subtrees: make(map[string]*subtreeState),
+		},
+		lines:           lines,
+		trailingNewline: trailingNewline,
+	}, nil
+}
+
+type propertiesStore struct {
+	js *jsonStore
+	// lines are the lines of the file as it was read
+	lines           []*propertiesLine
+	trailingNewline bool
+}
+
+func (s *propertiesStore) EncryptSubtree(recipient string, path ...string) error {
+	return s.js.EncryptSubtree(recipient, path...)
+}
+
+func (s *propertiesStore) EncryptSubtreeForRecipients(recipients []string, path ...string) error {
+	return s.js.EncryptSubtreeForRecipients(recipients, path...)
+}
+
+func (s *propertiesStore) EncryptSubtreeWithPassphrase(passphrase string, path ...string) error {
+	return s.js.EncryptSubtreeWithPassphrase(passphrase, path...)
+}
+
+func (s *propertiesStore) UpdateSubtree(recipients []string, path ...string) error {
+	return s.js.UpdateSubtree(recipients, path...)
+}
+
+func (s *propertiesStore) DecryptSubtree(identity string, path ...string) error {
+	return s.js.DecryptSubtree(identity, path...)
+}
+
+func (s *propertiesStore) DecryptSubtreeWithPassphrase(passphrase string, path ...string) error {
+	return s.js.DecryptSubtreeWithPassphrase(passphrase, path...)
+}
+
+func (s *propertiesStore) Rotate(identity string) error {
+	return s.js.Rotate(identity)
+}
+
+func (s *propertiesStore) RotateWithPassphrase(passphrase string) error {
+	return s.js.RotateWithPassphrase(passphrase)
+}
+
+func (s *propertiesStore) UpdateRecipients(identity string, recipients []string) ([]string, []string, error) {
+	return s.js.UpdateRecipients(identity, recipients)
+}
+
+func (s *propertiesStore) UpdateRecipientsWithPassphrase(passphrase string, recipients []string) ([]string, []string, error) {
+	return s.js.UpdateRecipientsWithPassphrase(passphrase, recipients)
+}
+
+func (s *propertiesStore) Subtree(path ...string) (map[string]interface{}, error) {
+	return s.js.Subtree(path...)
+}
+
+func (s *propertiesStore) Get(path ...string) (interface{}, error) {
+	return s.js.Get(path...)
+}
+
+func (s *propertiesStore) Set(value interface{}, path ...string) error {
+	return s.js.Set(value, path...)
+}
+
+func (s *propertiesStore) Delete(path ...string) error {
+	return s.js.Delete(path...)
+}
+
+func (s *propertiesStore) backingStore() *jsonStore {
+	return s.js
+}
+
+func (s *propertiesStore) ToFile(path string) error {
+	bites, err := s.bytes()
+	if err != nil {
+		return err
+	}
+
+	return writeFile(path, bites)
+}
+
+// bytes writes unchanged lines as they were read. New keys follow the last
+// key of the same subtree or are appended to the file.
+func (s *propertiesStore) bytes() ([]byte, error) {
+	root, ok := s.js.root.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid document")
+	}
+
+	properties := make(map[string]string)
+	err := flattenProperties(root, "", properties)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []*propertiesLine
+	written := make(map[string]bool, len(properties))
+	for _, line := range s.lines {
+		if line.key == "" {
+			out = append(out, line)
+			continue
+		}
+
+		value, ok := properties[line.key]
+		if !ok {
+			continue
+		}
+
+		written[line.key] = true
+		if value == line.value {
+			out = append(out, line)
+			continue
+		}
+		out = append(out, &propertiesLine{raw: line.prefix + escapeProperty(value, false), key: line.key})
+	}
+
+	insertions := make(map[int][]string)
+	for _, key := range sortedStrings(properties) {
+		if written[key] {
+			continue
+		}
+
+		pos := len(out) - 1
+		if idx := strings.LastIndexByte(key, '.'); idx >= 0 {
+			if found := propertiesInsertPosition(out, key[:idx]); found >= 0 {
+				pos = found
+			}
+		}
+		insertions[pos] = append(insertions[pos], escapeProperty(key, true)+"="+escapeProperty(properties[key], false))
+	}
+
+	var texts []string
+	texts = append(texts, insertions[-1]...)
+	for idx, line := range out {
+		texts = append(texts, line.raw)
+		texts = append(texts, insertions[idx]...)
+	}
+	return joinLines(texts, s.trailingNewline || len(insertions) > 0), nil
+}
+
+// MarshalProperties encodes a document as returned by Store.Subtree as a
+// properties file. Nested keys are joined with dots.
+func MarshalProperties(v map[string]interface{}) ([]byte, error) {
+	properties := make(map[string]string)
+	err := flattenProperties(v, "", properties)
+	if err != nil {
+		return nil, err
+	}
+
+	var texts []string
+	for _, key := range sortedStrings(properties) {
+		texts = append(texts, escapeProperty(key, true)+"="+escapeProperty(properties[key], false))
+	}
+	return joinLines(texts, true), nil
+}
+
+// setProperty adds a property to the tree. If a key is a value and has keys
+// below it, like log4j.appender.stdout and log4j.appender.stdout.layout, the
+// keys below it keep their dots and are stored next to the value.
+func setProperty(root map[string]interface{}, key string, value string) error {
+	path := strings.Split(key, ".")
+	m := root
+	for idx := 0; idx < len(path)-1; idx++ {
+		part := path[idx]
+		if part == "__keycloak__" {
+			return fmt.Errorf("%s conflicts with %s", key, strings.Join(path[:idx+1], "."))
+		}
+
+		child, ok := m[part]
+		if !ok {
+			child = make(map[string]interface{})
+			m[part] = child
+		}
+
+		childMap, ok := child.(map[string]interface{})
+		if !ok {
+			path = append(path[:idx], strings.Join(path[idx:], "."))
+			break
+		}
+		m = childMap
+	}
+
+	last := path[len(path)-1]
+	if child, ok := m[last].(map[string]interface{}); ok {
+		if len(findEncryptedSubtrees(child, nil)) > 0 {
+			return fmt.Errorf("%s conflicts with the encrypted keys below it", key)
+		}
+
+		below := make(map[string]string)
+		err := flattenProperties(child, last, below)
+		if err != nil {
+			return err
+		}
+
+		delete(m, last)
+		for k, v := range below {
+			m[k] = v
+		}
+	}
+
+	if _, ok := m[last]; ok {
+		return fmt.Errorf("%s is already defined", key)
+	}
+
+	v, err := parseFlatValue(last, value)
+	if err != nil {
+		return err
+	}
+	m[last] = v
+	return nil
+}
+
+// flattenProperties joins the keys of the tree with dots.
+func flattenProperties(m map[string]interface{}, prefix string, properties map[string]string) error {
+	for key, v := range m {
+		fullKey := key
+		if prefix != "" {
+			fullKey = prefix + "." + key
+		}
+
+		if child, ok := v.(map[string]interface{}); ok && key != "__keycloak__" {
+			err := flattenProperties(child, fullKey, properties)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		value, err := flatValue(key, v)
+		if err != nil {
+			if prefix != "" {
+				return fmt.Errorf("%s.%s", prefix, err.Error())
+			}
+			return err
+		}
+		properties[fullKey] = value
+	}
+	return nil
+}
+
+// propertiesInsertPosition returns the index of the last line of a subtree
+// or -1 if there is none.
+func propertiesInsertPosition(out []*propertiesLine, subtree string) int {
+	pos := -1
+	for idx, line := range out {
+		if line.key == subtree || strings.HasPrefix(line.key, subtree+".") {
+			pos = idx
+		}
+	}
+	return pos
+}
+
+func sortedStrings(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// escapeProperty escapes a key or a value so that it can be written on a
+// single line. Like the rest of the file, other characters are written as
+// UTF-8.
+func escapeProperty(s string, isKey bool) string {
+	var sb strings.Builder
+	for idx, r := range s {
+		switch {
+		case r == '\\':
+			sb.WriteString(`\\`)
+		case r == '\n':
+			sb.WriteString(`\n`)
+		case r == '\r':
+			sb.WriteString(`\r`)
+		case r == '\t':
+			sb.WriteString(`\t`)
+		case r == '\f':
+			sb.WriteString(`\f`)
+		case r == ' ' && (isKey || idx == 0):
+			sb.WriteString(`\ `)
+		case isKey && strings.ContainsRune("=:#!", r):
+			sb.WriteByte('\\')
+			sb.WriteRune(r)
+		case r < 0x20 || r == 0x7f:
+			for _, unit := range utf16.Encode([]rune{r}) {
+				fmt.Fprintf(&sb, `\u%04X`, unit)
+			}
+		default:
+			sb.WriteRune(r)
+		}
+	}
+	return sb.String()
+}
+
+// parsePropertiesLine parses the first logical line and returns how many
+// lines it consumed.
+func parsePropertiesLine(lines []string) (*propertiesLine, int, error) {
+	text := strings.TrimLeft(lines[0], " \t\f")
+	if text == "" || strings.HasPrefix(text, "#") || strings.HasPrefix(text, "!") {
+		return &propertiesLine{raw: lines[0]}, 1, nil
+	}
+
+	// a line ending with an odd number of backslashes continues on the next one
+	consumed := 1
+	indent := lines[0][:len(lines[0])-len(text)]
+	for continues(text) && consumed < len(lines) {
+		text = text[:len(text)-1] + strings.TrimLeft(lines[consumed], " \t\f")
+		consumed++
+	}
+	if continues(text) {
+		text = text[:len(text)-1]
+	}
+
+	// the key ends at the first unescaped separator or whitespace
+	keyEnd := len(text)
+	for idx := 0; idx < len(text); idx++ {
+		if text[idx] == '\\' {
+			idx++
+			continue
+		}
+
+		if strings.IndexByte("=: \t\f", text[idx]) >= 0 {
+			keyEnd = idx
+			break
+		}
+	}
+
+	valueStart := keyEnd
+	for valueStart < len(text) && strings.IndexByte(" \t\f", text[valueStart]) >= 0 {
+		valueStart++
+	}
+	if valueStart < len(text) && (text[valueStart] == '=' || text[valueStart] == ':') {
+		valueStart++
+		for valueStart < len(text) && strings.IndexByte(" \t\f", text[valueStart]) >= 0 {
+			valueStart++
+		}
+	}
+
+	key, err := unescapeProperty(text[:keyEnd])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	value, err := unescapeProperty(text[valueStart:])
+	if err != nil {
+		return nil, 0, err
+	}
+
+	return &propertiesLine{
+		raw:    strings.Join(lines[:consumed], "\n"),
+		key:    key,
+		value:  value,
+		prefix: indent + text[:valueStart],
+	}, consumed, nil
+}
+
+func continues(line string) bool {
+	backslashes := len(line) - len(strings.TrimRight(line, `\`))
+	return backslashes%2 == 1
+}
+
+func unescapeProperty(s string) (string, error) {
+	var units []uint16
+	var sb strings.Builder
+	flush := func() {
+		sb.WriteString(string(utf16.Decode(units)))
+		units = nil
+	}
+
+	for idx := 0; idx < len(s); idx++ {
+		if s[idx] != '\\' || idx+1 == len(s) {
+			flush()
+			sb.WriteByte(s[idx])
+			continue
+		}
+
+		idx++
+		switch s[idx] {
+		case 'u':
+			if idx+5 > len(s) {
+				return "", fmt.Errorf("malformed \\uxxxx encoding")
+			}
+
+			unit, err := strconv.ParseUint(s[idx+1:idx+5], 16, 16)
+			if err != nil {
+				return "", fmt.Errorf("malformed \\uxxxx encoding")
+			}
+			// surrogate pairs are decoded together
+			units = append(units, uint16(unit))
+			idx += 4
+			continue
+		case 't':
+			flush()
+			sb.WriteByte('\t')
+		case 'n':
+			flush()
+			sb.WriteByte('\n')
+		case 'r':
+			flush()
+			sb.WriteByte('\r')
+		case 'f':
+			flush()
+			sb.WriteByte('\f')
+		default:
+			flush()
+			sb.WriteByte(s[idx])
+		}
+	}
+	flush()
+	return sb.String(), nil
+}
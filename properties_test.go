@@ -0,0 +1,149 @@
+package keycloak
+
+import (
+	"io/ioutil"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestPropertiesBasic(t *testing.T) {
+	bites, err := ioutil.ReadFile("testdata/app.properties")
+	assert.Nil(t, err)
+	store, err := newPropertiesStore(bites)
+	assert.Nil(t, err)
+
+	v, err := store.Get("app", "greeting")
+	assert.Nil(t, err)
+	assert.Equal(t, "hello world", v)
+
+	db, err := store.Subtree("database")
+	assert.Nil(t, err)
+	assert.Equal(t, 4, len(db))
+	assert.Equal(t, "super-secret-password1", db["password"])
+	assert.Equal(t, "admin", db["user"])
+	assert.Equal(t, "café ☃", db["motto"])
+
+	v, err = store.Get("server", "port")
+	assert.Nil(t, err)
+	assert.Equal(t, "8080", v)
+
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "database")
+	assert.Nil(t, err)
+
+	encrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.NotContains(t, string(encrypted), "super-secret")
+	assert.Contains(t, string(encrypted), "app.greeting = hello \\\n    world\n")
+	assert.Contains(t, string(encrypted), "\n! database settings\ndatabase.host = ")
+	assert.Contains(t, string(encrypted), "\ndatabase.__keycloak__={")
+	assert.Contains(t, string(encrypted), "\n\nserver.port 8080\n")
+
+	// the encrypted file can be read again
+	store, err = newPropertiesStore(encrypted)
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(ageIdentity.String(), "database")
+	assert.Nil(t, err)
+
+	decrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, string(bites), string(decrypted))
+}
+
+func TestPropertiesSetAndDelete(t *testing.T) {
+	store, err := newPropertiesStore([]byte("a.b=1\nc=2\n"))
+	assert.Nil(t, err)
+
+	assert.Nil(t, store.Set("x y", "a", "d"))
+	assert.Nil(t, store.Set(" new\n", "e"))
+	assert.Nil(t, store.Delete("c"))
+
+	bites, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, "a.b=1\na.d=x y\ne=\\ new\\n\n", string(bites))
+}
+
+func TestPropertiesValuesWithKeysBelow(t *testing.T) {
+	bites, err := ioutil.ReadFile("testdata/log4j.properties")
+	assert.Nil(t, err)
+	store, err := newPropertiesStore(bites)
+	assert.Nil(t, err)
+
+	// the keys below a value are stored next to it
+	appender, err := store.Subtree("log4j", "appender")
+	assert.Nil(t, err)
+	assert.Equal(t, "org.apache.log4j.ConsoleAppender", appender["stdout"])
+	assert.Equal(t, "org.apache.log4j.PatternLayout", appender["stdout.layout"])
+	assert.Equal(t, "super-secret-password1", appender["file.Password"])
+
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "log4j")
+	assert.Nil(t, err)
+
+	encrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.NotContains(t, string(encrypted), "super-secret")
+	assert.Contains(t, string(encrypted), "\nlog4j.appender.stdout.layout=")
+	assert.Contains(t, string(encrypted), "\nlog4j.__keycloak__=")
+
+	store, err = newPropertiesStore(encrypted)
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(ageIdentity.String(), "log4j")
+	assert.Nil(t, err)
+
+	decrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, string(bites), string(decrypted))
+
+	// the order of the keys doesn't matter
+	store, err = newPropertiesStore([]byte("a.b.c=1\na.b=2\na=3\n"))
+	assert.Nil(t, err)
+	st, err := store.Subtree()
+	assert.Nil(t, err)
+	assert.Equal(t, map[string]interface{}{"a": "3", "a.b": "2", "a.b.c": "1"}, st)
+}
+
+func TestPropertiesInvalid(t *testing.T) {
+	invalid := []string{
+		"a=1\na=2",
+		"a=1\na.b=2\na.b=3",
+		"a.__keycloak__.b=1",
+		"a=\\u12",
+		"a=\\uzzzz",
+		"__keycloak__=not-json",
+	}
+
+	for _, doc := range invalid {
+		_, err := newPropertiesStore([]byte(doc))
+		assert.NotNil(t, err, doc)
+	}
+}
+
+func TestMarshalProperties(t *testing.T) {
+	bites, err := MarshalProperties(map[string]interface{}{
+		"b":     map[string]interface{}{"c": "x=y", "d": true},
+		"a key": "😀",
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "a\\ key=😀\nb.c=x=y\nb.d=true\n", string(bites))
+
+	store, err := newPropertiesStore(bites)
+	assert.Nil(t, err)
+	v, err := store.Get("a key")
+	assert.Nil(t, err)
+	assert.Equal(t, "😀", v)
+
+	// escaped surrogate pairs are decoded together
+	store, err = newPropertiesStore([]byte("a=\\uD83D\\uDE00\n"))
+	assert.Nil(t, err)
+	v, err = store.Get("a")
+	assert.Nil(t, err)
+	assert.Equal(t, "😀", v)
+
+	_, err = MarshalProperties(map[string]interface{}{"a": []interface{}{"b"}})
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,1358 @@
+package keycloak
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/BurntSushi/toml"
+)
+
+var bareTOMLKey = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// newTOMLStore converts the document into the representation used by the
+// json store. Integers and floats become numbers, nan and inf stay floats and
+// dates and times keep their textual representation.
+func newTOMLStore(bites []byte) (*tomlStore, error) {
+	var doc map[string]interface{}
+	md, err := toml.Decode(string(bites), &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	root, err := fromTOMLValue(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	order := &keyOrder{children: make(map[string]*keyOrder)}
+	for _, key := range md.Keys() {
+		o := order
+		for _, part := range key {
+			child, ok := o.children[part]
+			if !ok {
+				child = &keyOrder{children: make(map[string]*keyOrder)}
+				o.keys = append(o.keys, part)
+				o.children[part] = child
+			}
+			o = child
+		}
+	}
+
+	s := &tomlStore{
+		js: &jsonStore{
+			root:     root,
+			subtrees: make(map[string]*subtreeState),
+		},
+		order: order,
+	}
+
+	// documents the scanner can't make sense of are written as a whole
+	statements, arrays, err := scanTOML(bites)
+	if err == nil {
+		s.src = bites
+		s.statements = statements
+		s.arrays = arrays
+		s.orig = copyValue(root).(map[string]interface{})
+	}
+	return s, nil
+}
+
+type tomlStore struct {
+	js *jsonStore
+	// order records the order of the keys in the document as it was read.
+	// The elements of an array of tables share their order.
+	order *keyOrder
+	// src is the text of the document, orig its contents when it was read.
+	// ToFile only rewrites the parts of the text whose values changed.
+	src        []byte
+	statements []*tomlStatement
+	arrays     map[string]*tomlArray
+	orig       map[string]interface{}
+}
+
+func (s *tomlStore) EncryptSubtree(recipient string, path ...string) error {
+	return s.js.EncryptSubtree(recipient, path...)
+}
+
+func (s *tomlStore) EncryptSubtreeForRecipients(recipients []string, path ...string) error {
+	return s.js.EncryptSubtreeForRecipients(recipients, path...)
+}
+
+func (s *tomlStore) EncryptSubtreeWithPassphrase(passphrase string, path ...string) error {
+	return s.js.EncryptSubtreeWithPassphrase(passphrase, path...)
+}
+
+func (s *tomlStore) UpdateSubtree(recipients []string, path ...string) error {
+	return s.js.UpdateSubtree(recipients, path...)
+}
+
+func (s *tomlStore) DecryptSubtree(identity string, path ...string) error {
+	return s.js.DecryptSubtree(identity, path...)
+}
+
+func (s *tomlStore) DecryptSubtreeWithPassphrase(passphrase string, path ...string) error {
+	return s.js.DecryptSubtreeWithPassphrase(passphrase, path...)
+}
+
+func (s *tomlStore) Rotate(identity string) error {
+	return s.js.Rotate(identity)
+}
+
+func (s *tomlStore) RotateWithPassphrase(passphrase string) error {
+	return s.js.RotateWithPassphrase(passphrase)
+}
+
+func (s *tomlStore) UpdateRecipients(identity string, recipients []string) ([]string, []string, error) {
+	return s.js.UpdateRecipients(identity, recipients)
+}
+
+func (s *tomlStore) UpdateRecipientsWithPassphrase(passphrase string, recipients []string) ([]string, []string, error) {
+	return s.js.UpdateRecipientsWithPassphrase(passphrase, recipients)
+}
+
+func (s *tomlStore) Subtree(path ...string) (map[string]interface{}, error) {
+	return s.js.Subtree(path...)
+}
+
+func (s *tomlStore) Get(path ...string) (interface{}, error) {
+	return s.js.Get(path...)
+}
+
+func (s *tomlStore) Set(value interface{}, path ...string) error {
+	return s.js.Set(value, path...)
+}
+
+func (s *tomlStore) Delete(path ...string) error {
+	return s.js.Delete(path...)
+}
+
+func (s *tomlStore) backingStore() *jsonStore {
+	return s.js
+}
+
+func (s *tomlStore) ToFile(path string) error {
+	bites, err := s.bytes()
+	if err != nil {
+		return err
+	}
+
+	return writeFile(path, bites)
+}
+
+// bytes writes the current contents of the store. Comments and the text of
+// values that didn't change are kept. Documents that can't be edited in place
+// are written as a whole.
+func (s *tomlStore) bytes() ([]byte, error) {
+	root, ok := s.js.root.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid document")
+	}
+
+	if s.orig != nil {
+		e := newTOMLEditor(s.src, s.statements, s.arrays, s.orig, root)
+		err := e.edit()
+		if err == nil {
+			return e.apply(), nil
+		}
+		if err != errTOMLNotEditable {
+			return nil, err
+		}
+	}
+
+	w := &tomlWriter{}
+	err := w.writeTable(root, s.order, nil)
+	if err != nil {
+		return nil, err
+	}
+	return w.buf.Bytes(), nil
+}
+
+// MarshalTOML encodes a document as returned by Store.Subtree as TOML.
+// Dates and times read from TOML files are written as such.
+func MarshalTOML(v map[string]interface{}) ([]byte, error) {
+	w := &tomlWriter{}
+	err := w.writeTable(v, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return w.buf.Bytes(), nil
+}
+
+func fromTOMLValue(v interface{}) (interface{}, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for key, value := range v {
+			newV, err := fromTOMLValue(value)
+			if err != nil {
+				return nil, err
+			}
+			m[key] = newV
+		}
+		return m, nil
+
+	case []map[string]interface{}:
+		a := make([]interface{}, len(v))
+		for idx, value := range v {
+			newV, err := fromTOMLValue(value)
+			if err != nil {
+				return nil, err
+			}
+			a[idx] = newV
+		}
+		return a, nil
+
+	case []interface{}:
+		a := make([]interface{}, len(v))
+		for idx, value := range v {
+			newV, err := fromTOMLValue(value)
+			if err != nil {
+				return nil, err
+			}
+			a[idx] = newV
+		}
+		return a, nil
+
+	case int64:
+		return json.Number(strconv.FormatInt(v, 10)), nil
+
+	case float64:
+		// nan and inf can't be written as json numbers
+		if math.IsInf(v, 0) || math.IsNaN(v) {
+			return v, nil
+		}
+
+		s, err := tomlFloat(v)
+		if err != nil {
+			return nil, err
+		}
+		return json.Number(s), nil
+
+	case time.Time:
+		// the location tells which kind of date or time was read
+		switch v.Location().String() {
+		case "datetime-local":
+			return Datetime(v.Format("2006-01-02T15:04:05.999999999")), nil
+		case "date-local":
+			return Datetime(v.Format("2006-01-02")), nil
+		case "time-local":
+			return Datetime(v.Format("15:04:05.999999999")), nil
+		default:
+			return Datetime(v.Format(time.RFC3339Nano)), nil
+		}
+
+	case string, bool:
+		return v, nil
+
+	default:
+		return nil, fmt.Errorf("unknown type %T", v)
+	}
+}
+
+type tomlWriter struct {
+	buf bytes.Buffer
+}
+
+// writeTable writes a table with its header. The header is left out if the
+// table only contains other tables.
+func (w *tomlWriter) writeTable(m map[string]interface{}, order *keyOrder, path []string) error {
+	hasValues := false
+	for _, v := range m {
+		if !isTOMLTable(v) && !isTOMLArrayOfTables(v) {
+			hasValues = true
+			break
+		}
+	}
+
+	if len(path) > 0 && (hasValues || len(m) == 0) {
+		w.writeHeader("[", path, "]")
+	}
+	return w.writeTableBody(m, order, path)
+}
+
+// writeTableBody writes the values of a table first and its tables and arrays
+// of tables after that.
+func (w *tomlWriter) writeTableBody(m map[string]interface{}, order *keyOrder, path []string) error {
+	keys := order.sortKeys(m)
+	for _, key := range keys {
+		if isTOMLTable(m[key]) || isTOMLArrayOfTables(m[key]) {
+			continue
+		}
+
+		w.buf.WriteString(tomlKey(key))
+		w.buf.WriteString(" = ")
+		err := w.writeValue(m[key])
+		if err != nil {
+			return fmt.Errorf("%s: %s", strings.Join(childPath(path, key), "."), err.Error())
+		}
+		w.buf.WriteByte('\n')
+	}
+
+	for _, key := range keys {
+		switch v := m[key].(type) {
+		case map[string]interface{}:
+			err := w.writeTable(v, order.child(key), childPath(path, key))
+			if err != nil {
+				return err
+			}
+
+		case []interface{}:
+			if !isTOMLArrayOfTables(v) {
+				continue
+			}
+
+			tablePath := childPath(path, key)
+			for _, item := range v {
+				w.writeHeader("[[", tablePath, "]]")
+				err := w.writeTableBody(item.(map[string]interface{}), order.child(key), tablePath)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (w *tomlWriter) writeHeader(open string, path []string, close string) {
+	if w.buf.Len() > 0 {
+		w.buf.WriteByte('\n')
+	}
+
+	keys := make([]string, len(path))
+	for idx, key := range path {
+		keys[idx] = tomlKey(key)
+	}
+
+	w.buf.WriteString(open)
+	w.buf.WriteString(strings.Join(keys, "."))
+	w.buf.WriteString(close)
+	w.buf.WriteByte('\n')
+}
+
+// writeValue writes a value inline.
+func (w *tomlWriter) writeValue(v interface{}) error {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		w.buf.WriteByte('{')
+		for idx, key := range sortedKeys(v) {
+			if idx > 0 {
+				w.buf.WriteString(", ")
+			}
+
+			w.buf.WriteString(tomlKey(key))
+			w.buf.WriteString(" = ")
+			err := w.writeValue(v[key])
+			if err != nil {
+				return err
+			}
+		}
+		w.buf.WriteByte('}')
+		return nil
+
+	case []interface{}:
+		w.buf.WriteByte('[')
+		for idx, item := range v {
+			if idx > 0 {
+				w.buf.WriteString(", ")
+			}
+
+			err := w.writeValue(item)
+			if err != nil {
+				return err
+			}
+		}
+		w.buf.WriteByte(']')
+		return nil
+
+	case string:
+		w.buf.WriteString(tomlString(v))
+		return nil
+
+	case Datetime:
+		w.buf.WriteString(string(v))
+		return nil
+
+	case json.Number:
+		if !strings.ContainsAny(string(v), ".eE") {
+			_, err := strconv.ParseInt(string(v), 10, 64)
+			if err != nil {
+				return fmt.Errorf("integer out of range: %s", v)
+			}
+		}
+		w.buf.WriteString(string(v))
+		return nil
+
+	case float64:
+		s, err := tomlFloat(v)
+		if err != nil {
+			return err
+		}
+		w.buf.WriteString(s)
+		return nil
+
+	case bool:
+		w.buf.WriteString(strconv.FormatBool(v))
+		return nil
+
+	case nil:
+		return fmt.Errorf("toml doesn't support null values")
+
+	default:
+		return fmt.Errorf("unknown type %T", v)
+	}
+}
+
+func isTOMLTable(v interface{}) bool {
+	_, ok := v.(map[string]interface{})
+	return ok
+}
+
+func isTOMLArrayOfTables(v interface{}) bool {
+	a, ok := v.([]interface{})
+	if !ok || len(a) == 0 {
+		return false
+	}
+
+	for _, item := range a {
+		if !isTOMLTable(item) {
+			return false
+		}
+	}
+	return true
+}
+
+// tomlFloat formats f the way encoding/json does. Floats without a fraction
+// get one so that they are read as floats again.
+func tomlFloat(f float64) (string, error) {
+	switch {
+	case math.IsNaN(f):
+		return "nan", nil
+	case math.IsInf(f, 1):
+		return "inf", nil
+	case math.IsInf(f, -1):
+		return "-inf", nil
+	}
+
+	bites, err := json.Marshal(f)
+	if err != nil {
+		return "", err
+	}
+
+	s := string(bites)
+	if !strings.ContainsAny(s, ".e") {
+		s += ".0"
+	}
+	return s, nil
+}
+
+func tomlKey(key string) string {
+	if bareTOMLKey.MatchString(key) {
+		return key
+	}
+	return tomlString(key)
+}
+
+// tomlString quotes s as a basic string.
+func tomlString(s string) string {
+	var sb strings.Builder
+	sb.WriteByte('"')
+	for _, r := range s {
+		switch r {
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		case '\b':
+			sb.WriteString(`\b`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\f':
+			sb.WriteString(`\f`)
+		case '\r':
+			sb.WriteString(`\r`)
+		default:
+			if r < 0x20 || r == 0x7f {
+				fmt.Fprintf(&sb, `\u%04X`, r)
+			} else {
+				sb.WriteRune(r)
+			}
+		}
+	}
+	sb.WriteByte('"')
+	return sb.String()
+}
+
+// errTOMLNotEditable is returned for changes that can't be made to the text of
+// a document, e.g. new tables inside of a table of an array of tables that
+// isn't the last one.
+var errTOMLNotEditable = errors.New("toml: document can't be edited in place")
+
+var tomlDate = regexp.MustCompile(`^[0-9]{4}-[0-9]{2}-[0-9]{2}$`)
+
+// tomlStatement is a table header or a key/value pair of a document.
+type tomlStatement struct {
+	// start is the offset of the line the statement starts in and end the
+	// offset behind the line break of the line it ends in.
+	start int
+	end   int
+	// header is set for table headers, array for headers of arrays of tables.
+	header bool
+	array  bool
+	// path is the path of the table or value. The tables of an array of
+	// tables are addressed by their index.
+	path []string
+	// table is the index of the header a key/value pair belongs to or -1 for
+	// pairs of the root table.
+	table int
+	// keys are the keys of a value relative to its table.
+	keys       []string
+	valueStart int
+	valueEnd   int
+	indent     string
+}
+
+// tomlArray is an array of tables.
+type tomlArray struct {
+	path []string
+	// last is the index of the last table
+	last int
+}
+
+// scanTOML locates the headers and key/value pairs of a valid document. It
+// also returns the arrays of tables by their path.
+func scanTOML(src []byte) ([]*tomlStatement, map[string]*tomlArray, error) {
+	sc := &tomlScanner{src: src}
+	var statements []*tomlStatement
+	arrays := make(map[string]*tomlArray)
+	var table []string
+	current := -1
+	for sc.pos < len(src) {
+		start := sc.pos
+		sc.skipSpace()
+		st := &tomlStatement{start: start, table: current, indent: string(src[start:sc.pos])}
+		switch {
+		case sc.lineEnds():
+			sc.skipLine()
+			continue
+
+		case src[sc.pos] == '[':
+			st.header = true
+			sc.pos++
+			if sc.peek("[") {
+				st.array = true
+				sc.pos++
+			}
+
+			keys, err := sc.keys()
+			if err != nil {
+				return nil, nil, err
+			}
+
+			closing := "]"
+			if st.array {
+				closing = "]]"
+			}
+			err = sc.expect(closing)
+			if err != nil {
+				return nil, nil, err
+			}
+
+			for idx, key := range keys {
+				st.path = append(st.path, key)
+				a, ok := arrays[pathKey(st.path)]
+				if idx == len(keys)-1 && st.array {
+					if ok {
+						a.last++
+					} else {
+						a = &tomlArray{path: append([]string{}, st.path...)}
+						arrays[pathKey(st.path)] = a
+					}
+				} else if !ok {
+					continue
+				}
+				st.path = append(st.path, strconv.Itoa(a.last))
+			}
+			st.table = len(statements)
+			table = st.path
+			current = st.table
+
+		default:
+			keys, err := sc.keys()
+			if err != nil {
+				return nil, nil, err
+			}
+
+			err = sc.expect("=")
+			if err != nil {
+				return nil, nil, err
+			}
+
+			sc.skipSpace()
+			st.valueStart = sc.pos
+			err = sc.value()
+			if err != nil {
+				return nil, nil, err
+			}
+			st.valueEnd = sc.pos
+			st.keys = keys
+			st.path = append(append([]string{}, table...), keys...)
+		}
+
+		err := sc.endLine()
+		if err != nil {
+			return nil, nil, err
+		}
+		st.end = sc.pos
+		statements = append(statements, st)
+	}
+	return statements, arrays, nil
+}
+
+type tomlScanner struct {
+	src []byte
+	pos int
+}
+
+func (sc *tomlScanner) peek(s string) bool {
+	return bytes.HasPrefix(sc.src[sc.pos:], []byte(s))
+}
+
+func (sc *tomlScanner) expect(s string) error {
+	sc.skipSpace()
+	if !sc.peek(s) {
+		return sc.unexpected()
+	}
+	sc.pos += len(s)
+	return nil
+}
+
+func (sc *tomlScanner) unexpected() error {
+	if sc.pos >= len(sc.src) {
+		return fmt.Errorf("toml: unexpected end of document")
+	}
+	return fmt.Errorf("toml: unexpected %q at offset %d", sc.src[sc.pos], sc.pos)
+}
+
+func (sc *tomlScanner) skipSpace() {
+	for sc.pos < len(sc.src) && (sc.src[sc.pos] == ' ' || sc.src[sc.pos] == '\t') {
+		sc.pos++
+	}
+}
+
+// skipBlank skips whitespace, line breaks and comments.
+func (sc *tomlScanner) skipBlank() {
+	for {
+		sc.skipSpace()
+		switch {
+		case sc.peek("#"):
+			sc.skipLine()
+		case sc.peek("\n") || sc.peek("\r\n"):
+			sc.skipLine()
+		default:
+			return
+		}
+	}
+}
+
+func (sc *tomlScanner) lineEnds() bool {
+	return sc.pos >= len(sc.src) || sc.peek("\n") || sc.peek("\r\n") || sc.peek("#")
+}
+
+func (sc *tomlScanner) skipLine() {
+	idx := bytes.IndexByte(sc.src[sc.pos:], '\n')
+	if idx < 0 {
+		sc.pos = len(sc.src)
+	} else {
+		sc.pos += idx + 1
+	}
+}
+
+// endLine skips the comment behind a statement and the line break.
+func (sc *tomlScanner) endLine() error {
+	sc.skipSpace()
+	if !sc.lineEnds() {
+		return sc.unexpected()
+	}
+	sc.skipLine()
+	return nil
+}
+
+// keys reads a dotted key.
+func (sc *tomlScanner) keys() ([]string, error) {
+	var keys []string
+	for {
+		sc.skipSpace()
+		key, err := sc.key()
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, key)
+
+		sc.skipSpace()
+		if !sc.peek(".") {
+			return keys, nil
+		}
+		sc.pos++
+	}
+}
+
+func (sc *tomlScanner) key() (string, error) {
+	start := sc.pos
+	switch {
+	case sc.peek(`"`) || sc.peek("'"):
+		err := sc.value()
+		if err != nil {
+			return "", err
+		}
+
+		// let the parser take care of escape sequences
+		var m map[string]string
+		_, err = toml.Decode("k = "+string(sc.src[start:sc.pos]), &m)
+		if err != nil {
+			return "", err
+		}
+		return m["k"], nil
+
+	default:
+		for sc.pos < len(sc.src) && bareTOMLKey.Match(sc.src[sc.pos:sc.pos+1]) {
+			sc.pos++
+		}
+		if start == sc.pos {
+			return "", sc.unexpected()
+		}
+		return string(sc.src[start:sc.pos]), nil
+	}
+}
+
+// value skips a value. Arrays may span several lines.
+func (sc *tomlScanner) value() error {
+	switch {
+	case sc.peek(`"""`):
+		return sc.multilineString(`"""`, true)
+
+	case sc.peek("'''"):
+		return sc.multilineString("'''", false)
+
+	case sc.peek(`"`):
+		sc.pos++
+		for sc.pos < len(sc.src) && sc.src[sc.pos] != '\n' {
+			switch sc.src[sc.pos] {
+			case '\\':
+				sc.pos += 2
+			case '"':
+				sc.pos++
+				return nil
+			default:
+				sc.pos++
+			}
+		}
+		return sc.unexpected()
+
+	case sc.peek("'"):
+		idx := bytes.IndexAny(sc.src[sc.pos+1:], "'\n")
+		if idx < 0 || sc.src[sc.pos+1+idx] != '\'' {
+			return fmt.Errorf("toml: unterminated string at offset %d", sc.pos)
+		}
+		sc.pos += idx + 2
+		return nil
+
+	case sc.peek("["):
+		sc.pos++
+		for {
+			sc.skipBlank()
+			if sc.peek("]") {
+				sc.pos++
+				return nil
+			}
+
+			err := sc.value()
+			if err != nil {
+				return err
+			}
+
+			sc.skipBlank()
+			if sc.peek(",") {
+				sc.pos++
+			} else if !sc.peek("]") {
+				return sc.unexpected()
+			}
+		}
+
+	case sc.peek("{"):
+		sc.pos++
+		for {
+			sc.skipSpace()
+			if sc.peek("}") {
+				sc.pos++
+				return nil
+			}
+
+			_, err := sc.keys()
+			if err != nil {
+				return err
+			}
+
+			err = sc.expect("=")
+			if err != nil {
+				return err
+			}
+
+			sc.skipSpace()
+			err = sc.value()
+			if err != nil {
+				return err
+			}
+
+			sc.skipSpace()
+			if sc.peek(",") {
+				sc.pos++
+			} else if !sc.peek("}") {
+				return sc.unexpected()
+			}
+		}
+
+	default:
+		start := sc.pos
+		for sc.pos < len(sc.src) && !strings.ContainsRune(" \t\r\n,]}#", rune(sc.src[sc.pos])) {
+			sc.pos++
+			// dates and times may be separated by a space
+			if tomlDate.Match(sc.src[start:sc.pos]) && sc.peek(" ") && sc.pos+3 < len(sc.src) &&
+				isDigit(sc.src[sc.pos+1]) && isDigit(sc.src[sc.pos+2]) && sc.src[sc.pos+3] == ':' {
+				sc.pos++
+			}
+		}
+		if start == sc.pos {
+			return sc.unexpected()
+		}
+		return nil
+	}
+}
+
+// multilineString skips a multi-line string. Up to two quotes right in front
+// of the closing delimiter belong to the string.
+func (sc *tomlScanner) multilineString(delim string, escapes bool) error {
+	sc.pos += len(delim)
+	for sc.pos < len(sc.src) {
+		switch {
+		case escapes && sc.src[sc.pos] == '\\':
+			sc.pos += 2
+		case sc.peek(delim):
+			sc.pos += len(delim)
+			for extra := 0; extra < 2 && sc.peek(delim[:1]); extra++ {
+				sc.pos++
+			}
+			return nil
+		default:
+			sc.pos++
+		}
+	}
+	return sc.unexpected()
+}
+
+func isDigit(b byte) bool {
+	return b >= '0' && b <= '9'
+}
+
+// tomlEditor collects the edits that turn the text of a document into the
+// current contents of the store. Values that didn't change keep their text,
+// removed tables and values are deleted together with the comments in front
+// of them and new values are added to the table they belong to.
+type tomlEditor struct {
+	src        []byte
+	statements []*tomlStatement
+	arrays     map[string]*tomlArray
+	orig       map[string]interface{}
+	root       map[string]interface{}
+	newline    string
+	// headers and values map paths to the statements that define them
+	headers map[string]int
+	values  map[string]int
+	// last is the index of the last table of every array of tables that is
+	// kept, at the end of the document.
+	last     map[string]int
+	edits    []textEdit
+	appended []string
+}
+
+func newTOMLEditor(src []byte, statements []*tomlStatement, arrays map[string]*tomlArray, orig map[string]interface{}, root map[string]interface{}) *tomlEditor {
+	e := &tomlEditor{
+		src:        src,
+		statements: statements,
+		arrays:     arrays,
+		orig:       orig,
+		root:       root,
+		newline:    "\n",
+		headers:    make(map[string]int),
+		values:     make(map[string]int),
+		last:       make(map[string]int),
+	}
+
+	if idx := bytes.IndexByte(src, '\n'); idx > 0 && src[idx-1] == '\r' {
+		e.newline = "\r\n"
+	}
+
+	for idx, st := range statements {
+		if st.header {
+			e.headers[pathKey(st.path)] = idx
+		} else {
+			e.values[pathKey(st.path)] = idx
+		}
+	}
+	return e
+}
+
+func (e *tomlEditor) apply() []byte {
+	edits := e.edits
+	for _, text := range e.appended {
+		edits = append(edits, textEdit{start: len(e.src), end: len(e.src), text: text})
+	}
+
+	// insertions go in front of deletions that start at the same offset
+	sort.SliceStable(edits, func(i, j int) bool {
+		if edits[i].start != edits[j].start {
+			return edits[i].start < edits[j].start
+		}
+		return edits[i].start == edits[i].end && edits[j].start != edits[j].end
+	})
+	return applyEdits(e.src, edits)
+}
+
+// edit adds the edits that turn the text into the current contents.
+func (e *tomlEditor) edit() error {
+	kept := make(map[int]bool)
+	for idx, st := range e.statements {
+		if st.header {
+			_, kept[idx] = tomlTable(e.root, st.path)
+		}
+	}
+
+	for key, array := range e.arrays {
+		a, ok := tomlArrayOfTables(e.root, array.path)
+		if !ok {
+			continue
+		}
+
+		e.last[key] = array.last
+		if array.last >= len(a) {
+			e.last[key] = len(a) - 1
+		}
+	}
+
+	e.deleteTables(kept)
+	for _, st := range e.statements {
+		if st.header || (st.table >= 0 && !kept[st.table]) {
+			continue
+		}
+
+		err := e.editValue(st)
+		if err != nil {
+			return err
+		}
+	}
+
+	return e.walk(nil, e.orig, e.root)
+}
+
+// deleteTables deletes the headers of removed tables together with their
+// values and the comments in front of them.
+func (e *tomlEditor) deleteTables(kept map[int]bool) {
+	start := -1
+	for idx, st := range e.statements {
+		if !st.header {
+			continue
+		}
+
+		if kept[idx] {
+			if start >= 0 {
+				e.edits = append(e.edits, textEdit{start: start, end: e.leadingComments(st.start)})
+				start = -1
+			}
+		} else if start < 0 {
+			start = e.leadingComments(st.start)
+		}
+	}
+
+	if start >= 0 {
+		// the blank lines in front of the last table go with it
+		for start > 0 && e.blankLine(e.previousLine(start)) {
+			start = e.previousLine(start)
+		}
+		e.edits = append(e.edits, textEdit{start: start, end: len(e.src)})
+	}
+}
+
+// editValue rewrites the value of a key/value pair if it changed and deletes
+// the pair if its value was removed.
+func (e *tomlEditor) editValue(st *tomlStatement) error {
+	v, ok := tomlValue(e.root, st.path, len(st.path)-len(st.keys))
+	if !ok {
+		start := e.leadingComments(st.start)
+		if start > 0 && e.blankLine(e.previousLine(start)) && (st.end == len(e.src) || e.blankLine(st.end)) {
+			// don't leave two blank lines behind
+			start = e.previousLine(start)
+		}
+		e.edits = append(e.edits, textEdit{start: start, end: st.end})
+		return nil
+	}
+
+	text, err := tomlInlineValue(v)
+	if err != nil {
+		return fmt.Errorf("%s: %s", strings.Join(st.path, "."), err.Error())
+	}
+
+	orig, _ := tomlValue(e.orig, st.path, len(st.path)-len(st.keys))
+	if origText, err := tomlInlineValue(orig); err == nil && origText == text {
+		return nil
+	}
+
+	e.edits = append(e.edits, textEdit{start: st.valueStart, end: st.valueEnd, text: text})
+	return nil
+}
+
+// walk finds the values that were added to the table at path and inserts them.
+func (e *tomlEditor) walk(path []string, orig map[string]interface{}, m map[string]interface{}) error {
+	added := make(map[string]interface{})
+	for _, key := range sortedKeys(m) {
+		child := childPath(path, key)
+		if _, ok := e.values[pathKey(child)]; ok {
+			// key/value pairs are rewritten by editValue
+			continue
+		}
+
+		switch ov := orig[key].(type) {
+		case map[string]interface{}:
+			if nv, ok := m[key].(map[string]interface{}); ok {
+				err := e.walk(child, ov, nv)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+		case []interface{}:
+			nv, ok := m[key].([]interface{})
+			if _, isArray := e.arrays[pathKey(child)]; !isArray || !ok || !isTOMLArrayOfTables(nv) {
+				break
+			}
+
+			for idx, item := range nv {
+				if idx < len(ov) {
+					err := e.walk(childPath(child, strconv.Itoa(idx)), ov[idx].(map[string]interface{}), item.(map[string]interface{}))
+					if err != nil {
+						return err
+					}
+					continue
+				}
+
+				err := e.appendTable(child, idx, item.(map[string]interface{}))
+				if err != nil {
+					return err
+				}
+			}
+			continue
+		}
+
+		added[key] = m[key]
+	}
+
+	if len(added) == 0 {
+		return nil
+	}
+	return e.insert(path, added)
+}
+
+// insert adds new values to the table at path. Values of tables with a header
+// are added behind their last value, new tables follow them. Values of tables
+// that are defined by dotted keys are added as dotted keys. Tables that are
+// only defined by their sub-tables get a header at the end of the document.
+func (e *tomlEditor) insert(path []string, added map[string]interface{}) error {
+	header, hasHeader := e.headers[pathKey(path)]
+	if len(path) == 0 || hasHeader {
+		table := -1
+		pos := 0
+		indent := ""
+		if hasHeader {
+			table = header
+			pos = e.statements[header].end
+			indent = e.statements[header].indent
+		} else if first := e.firstHeader(); first >= 0 {
+			pos = e.leadingComments(e.statements[first].start)
+		} else {
+			pos = len(e.src)
+		}
+
+		hasValues := false
+		for _, st := range e.statements {
+			if !st.header && st.table == table {
+				pos = st.end
+				indent = st.indent
+				hasValues = true
+			}
+		}
+
+		var lines []string
+		tables := make(map[string]interface{})
+		for _, key := range sortedKeys(added) {
+			v := added[key]
+			if isTOMLTable(v) || isTOMLArrayOfTables(v) {
+				tables[key] = v
+				continue
+			}
+
+			text, err := tomlInlineValue(v)
+			if err != nil {
+				return fmt.Errorf("%s: %s", strings.Join(childPath(path, key), "."), err.Error())
+			}
+			lines = append(lines, indent+tomlKey(key)+" = "+text)
+		}
+
+		var text string
+		if len(lines) > 0 {
+			text = strings.Join(lines, "\n") + "\n"
+			if len(path) == 0 && !hasValues && pos < len(e.src) {
+				// the values of the root table are followed by a table
+				text += "\n"
+			}
+		}
+
+		if len(tables) > 0 && len(path) == 0 {
+			err := e.appendTables(nil, tables)
+			if err != nil {
+				return err
+			}
+		} else if len(tables) > 0 {
+			keys, err := e.headerKeys(path, false)
+			if err != nil {
+				return err
+			}
+
+			w := &tomlWriter{}
+			err = w.writeTableBody(tables, nil, keys)
+			if err != nil {
+				return err
+			}
+			text += "\n" + w.buf.String()
+		}
+
+		if text != "" {
+			e.insertText(pos, text)
+		}
+		return nil
+	}
+
+	// tables defined by dotted keys
+	for idx := len(e.statements) - 1; idx >= 0; idx-- {
+		st := e.statements[idx]
+		tableLen := len(st.path) - len(st.keys)
+		if st.header || tableLen >= len(path) || len(st.path) <= len(path) || pathKey(st.path[:len(path)]) != pathKey(path) {
+			continue
+		}
+
+		var lines []string
+		for _, key := range sortedKeys(added) {
+			text, err := tomlInlineValue(added[key])
+			if err != nil {
+				return fmt.Errorf("%s: %s", strings.Join(childPath(path, key), "."), err.Error())
+			}
+
+			var keys []string
+			for _, k := range childPath(path[tableLen:], key) {
+				keys = append(keys, tomlKey(k))
+			}
+			lines = append(lines, st.indent+strings.Join(keys, ".")+" = "+text)
+		}
+		e.insertText(st.end, strings.Join(lines, "\n")+"\n")
+		return nil
+	}
+
+	return e.appendTables(path, added)
+}
+
+// appendTables writes the values of the table at path at the end of the document.
+func (e *tomlEditor) appendTables(path []string, m map[string]interface{}) error {
+	keys, err := e.headerKeys(path, true)
+	if err != nil {
+		return err
+	}
+
+	w := &tomlWriter{}
+	if len(path) == 0 {
+		err = w.writeTableBody(m, nil, keys)
+	} else {
+		err = w.writeTable(m, nil, keys)
+	}
+	if err != nil {
+		return err
+	}
+	e.appendText(w.buf.String())
+	return nil
+}
+
+// appendTable writes a new table of the array of tables at path at the end of
+// the document.
+func (e *tomlEditor) appendTable(path []string, idx int, m map[string]interface{}) error {
+	keys, err := e.headerKeys(path, true)
+	if err != nil {
+		return err
+	}
+
+	w := &tomlWriter{}
+	w.writeHeader("[[", keys, "]]")
+	err = w.writeTableBody(m, nil, keys)
+	if err != nil {
+		return err
+	}
+	e.appendText(w.buf.String())
+	e.last[pathKey(path)] = idx
+	return nil
+}
+
+// headerKeys returns the keys of the header of the table at path. Tables of
+// arrays of tables are left out, a header always refers to the last table that
+// was defined before it. At the end of the document that has to be the last
+// table of the array.
+func (e *tomlEditor) headerKeys(path []string, atEnd bool) ([]string, error) {
+	var keys []string
+	for idx := 0; idx < len(path); idx++ {
+		keys = append(keys, path[idx])
+		if _, ok := e.arrays[pathKey(path[:idx+1])]; !ok || idx+1 == len(path) {
+			continue
+		}
+
+		idx++
+		if atEnd && strconv.Itoa(e.last[pathKey(path[:idx])]) != path[idx] {
+			return nil, errTOMLNotEditable
+		}
+	}
+	return keys, nil
+}
+
+func (e *tomlEditor) insertText(pos int, text string) {
+	if pos == len(e.src) && pos > 0 && e.src[pos-1] != '\n' {
+		text = "\n" + text
+	}
+	e.edits = append(e.edits, textEdit{start: pos, end: pos, text: strings.ReplaceAll(text, "\n", e.newline)})
+}
+
+// appendText adds a table to the end of the document behind a blank line.
+func (e *tomlEditor) appendText(text string) {
+	if len(e.src) > 0 || len(e.appended) > 0 || len(e.edits) > 0 {
+		text = "\n" + text
+	}
+	if len(e.appended) == 0 && len(e.src) > 0 && e.src[len(e.src)-1] != '\n' {
+		text = "\n" + text
+	}
+	e.appended = append(e.appended, strings.ReplaceAll(text, "\n", e.newline))
+}
+
+func (e *tomlEditor) firstHeader() int {
+	for idx, st := range e.statements {
+		if st.header {
+			return idx
+		}
+	}
+	return -1
+}
+
+// leadingComments returns the start of the comment lines right in front of
+// the line that starts at offset.
+func (e *tomlEditor) leadingComments(offset int) int {
+	for offset > 0 {
+		prev := e.previousLine(offset)
+		if !strings.HasPrefix(strings.TrimSpace(string(e.src[prev:offset])), "#") {
+			break
+		}
+		offset = prev
+	}
+	return offset
+}
+
+func (e *tomlEditor) previousLine(offset int) int {
+	return bytes.LastIndexByte(e.src[:offset-1], '\n') + 1
+}
+
+func (e *tomlEditor) blankLine(offset int) bool {
+	end := bytes.IndexByte(e.src[offset:], '\n')
+	if end < 0 {
+		end = len(e.src) - offset
+	}
+	return strings.TrimSpace(string(e.src[offset:offset+end])) == ""
+}
+
+// tomlTable returns the table at path. Arrays on the way have to be arrays of
+// tables since only those can be addressed by headers.
+func tomlTable(root map[string]interface{}, path []string) (map[string]interface{}, bool) {
+	var v interface{} = root
+	for _, key := range path {
+		switch t := v.(type) {
+		case map[string]interface{}:
+			v = t[key]
+
+		case []interface{}:
+			idx, err := strconv.Atoi(key)
+			if err != nil || idx < 0 || idx >= len(t) || !isTOMLArrayOfTables(t) {
+				return nil, false
+			}
+			v = t[idx]
+
+		default:
+			return nil, false
+		}
+	}
+
+	m, ok := v.(map[string]interface{})
+	return m, ok
+}
+
+func tomlArrayOfTables(root map[string]interface{}, path []string) ([]interface{}, bool) {
+	if len(path) == 0 {
+		return nil, false
+	}
+
+	table, ok := tomlTable(root, path[:len(path)-1])
+	if !ok {
+		return nil, false
+	}
+
+	a, ok := table[path[len(path)-1]].([]interface{})
+	return a, ok && isTOMLArrayOfTables(a)
+}
+
+// tomlValue returns the value of a key/value pair whose table is the first
+// tableLen keys of path.
+func tomlValue(root map[string]interface{}, path []string, tableLen int) (interface{}, bool) {
+	table, ok := tomlTable(root, path[:tableLen])
+	if !ok {
+		return nil, false
+	}
+
+	for _, key := range path[tableLen : len(path)-1] {
+		table, ok = table[key].(map[string]interface{})
+		if !ok {
+			return nil, false
+		}
+	}
+
+	v, ok := table[path[len(path)-1]]
+	return v, ok
+}
+
+func tomlInlineValue(v interface{}) (string, error) {
+	w := &tomlWriter{}
+	err := w.writeValue(v)
+	if err != nil {
+		return "", err
+	}
+	return w.buf.String(), nil
+}
@@ -0,0 +1,277 @@
+package keycloak
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"math"
+	"testing"
+
+	"filippo.io/age"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTOMLBasic(t *testing.T) {
+	bites, err := ioutil.ReadFile("testdata/config.toml")
+	assert.Nil(t, err)
+	store, err := newTOMLStore(bites)
+	assert.Nil(t, err)
+
+	// the document is written the way it was read
+	written, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, string(bites), string(written))
+
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	recipient := ageIdentity.Recipient().String()
+
+	err = store.EncryptSubtree(recipient, "database")
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(recipient, "servers", "1")
+	assert.Nil(t, err)
+
+	encrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.NotContains(t, string(encrypted), "super-secret-password1")
+	assert.NotContains(t, string(encrypted), "super-secret-token2")
+	assert.Contains(t, string(encrypted), `token = "super-secret-token1"`)
+
+	// the encrypted document can be read again
+	store, err = newTOMLStore(encrypted)
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(ageIdentity.String(), "database")
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(ageIdentity.String(), "servers", "1")
+	assert.Nil(t, err)
+
+	// dates, integers and floats survive
+	database, err := store.Subtree("database")
+	assert.Nil(t, err)
+	assert.Equal(t, json.Number("5432"), database["port"])
+	assert.Equal(t, json.Number("1.0"), database["ratio"])
+	assert.Equal(t, Datetime("2021-11-02"), database["rotated"])
+	assert.Equal(t, Datetime("03:30:00"), database["backup-window"])
+	assert.Equal(t, Datetime("2021-11-02T08:15:00.5"), database["last-login"])
+
+	decrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, string(bites), string(decrypted))
+}
+
+func TestTOMLNewValues(t *testing.T) {
+	store, err := newTOMLStore([]byte("b = 1\n"))
+	assert.Nil(t, err)
+
+	err = store.Set(map[string]interface{}{"u": map[string]interface{}{"x y": "a\"b\n", "list": []interface{}{1, "c", map[string]interface{}{"d": true}}}}, "t")
+	assert.Nil(t, err)
+	err = store.Set(2.5, "a")
+	assert.Nil(t, err)
+
+	bites, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, "b = 1\na = 2.5\n\n[t.u]\nlist = [1, \"c\", {d = true}]\n\"x y\" = \"a\\\"b\\n\"\n", string(bites))
+
+	_, err = newTOMLStore(bites)
+	assert.Nil(t, err)
+
+	err = store.Set(nil, "a")
+	assert.Nil(t, err)
+	_, err = store.bytes()
+	assert.NotNil(t, err)
+}
+
+func TestMarshalTOML(t *testing.T) {
+	bites, err := MarshalTOML(map[string]interface{}{
+		"when": Datetime("2021-11-02"),
+		"port": json.Number("5432"),
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "port = 5432\nwhen = 2021-11-02\n", string(bites))
+}
+
+func TestTOMLArrayOfTables(t *testing.T) {
+	bites, err := ioutil.ReadFile("testdata/config.toml")
+	assert.Nil(t, err)
+	store, err := newTOMLStore(bites)
+	assert.Nil(t, err)
+
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	// the tables of an array have to be encrypted one by one
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "servers")
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "servers is an array")
+
+	for _, idx := range []string{"0", "1"} {
+		err = store.EncryptSubtree(ageIdentity.Recipient().String(), "servers", idx)
+		assert.Nil(t, err)
+	}
+	encrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.NotContains(t, string(encrypted), "super-secret-token")
+
+	store, err = newTOMLStore(encrypted)
+	assert.Nil(t, err)
+	for _, idx := range []string{"0", "1"} {
+		err = store.DecryptSubtree(ageIdentity.String(), "servers", idx)
+		assert.Nil(t, err)
+	}
+	decrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, string(bites), string(decrypted))
+}
+
+func TestTOMLSpecialFloats(t *testing.T) {
+	doc := "[limits]\nmax = inf\nmin = -inf\nunset = nan\n"
+	store, err := newTOMLStore([]byte(doc))
+	assert.Nil(t, err)
+
+	v, err := store.Get("limits", "max")
+	assert.Nil(t, err)
+	assert.True(t, math.IsInf(v.(float64), 1))
+
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "limits")
+	assert.Nil(t, err)
+	encrypted, err := store.bytes()
+	assert.Nil(t, err)
+
+	store, err = newTOMLStore(encrypted)
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(ageIdentity.String(), "limits")
+	assert.Nil(t, err)
+	decrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, doc, string(decrypted))
+}
+
+func TestTOMLRotateAndUpdateRecipients(t *testing.T) {
+	doc := "when = 2021-01-01\nmax = inf\n\n[limits]\nunset = nan\nmin = -inf\nrotated = 2021-11-02T08:15:00Z\n"
+	store, err := newTOMLStore([]byte(doc))
+	assert.Nil(t, err)
+
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	otherIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "limits")
+	assert.Nil(t, err)
+	encrypted, err := store.bytes()
+	assert.Nil(t, err)
+
+	// failed operations leave the document as it was
+	store, err = newTOMLStore(encrypted)
+	assert.Nil(t, err)
+	err = store.Rotate(otherIdentity.String())
+	assert.NotNil(t, err)
+	_, _, err = store.UpdateRecipients(otherIdentity.String(), []string{otherIdentity.Recipient().String()})
+	assert.NotNil(t, err)
+	bites, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, string(encrypted), string(bites))
+
+	err = store.Rotate(ageIdentity.String())
+	assert.Nil(t, err)
+	_, _, err = store.UpdateRecipients(ageIdentity.String(), []string{otherIdentity.Recipient().String()})
+	assert.Nil(t, err)
+	bites, err = store.bytes()
+	assert.Nil(t, err)
+
+	store, err = newTOMLStore(bites)
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(otherIdentity.String(), "limits")
+	assert.Nil(t, err)
+	decrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, doc, string(decrypted))
+
+	// dates and special floats can be set as well
+	err = store.Set(Datetime("2022-02-02"), "when")
+	assert.Nil(t, err)
+	err = store.Set(math.NaN(), "max")
+	assert.Nil(t, err)
+	bites, err = store.bytes()
+	assert.Nil(t, err)
+	assert.Contains(t, string(bites), "when = 2022-02-02\nmax = nan\n")
+}
+
+func TestTOMLPreservesComments(t *testing.T) {
+	bites, err := ioutil.ReadFile("testdata/service.toml")
+	assert.Nil(t, err)
+	store, err := newTOMLStore(bites)
+	assert.Nil(t, err)
+
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	recipient := ageIdentity.Recipient().String()
+	paths := [][]string{{"database"}, {"owner"}, {"servers", "beta", "auth"}}
+	for _, path := range paths {
+		err = store.EncryptSubtree(recipient, path...)
+		assert.Nil(t, err)
+	}
+
+	encrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.NotContains(t, string(encrypted), "super-secret")
+	assert.Contains(t, string(encrypted), "# Configuration of some-service.\n# Secrets are encrypted with keycloak.\n\ntitle = 'some-service' # shown in the UI\n")
+	assert.Contains(t, string(encrypted), "[database]\n# the primary database\nhost = \"")
+	assert.Contains(t, string(encrypted), "\"   # rotated monthly\n")
+	assert.Contains(t, string(encrypted), "\n\n# replicas are read only\n[[database.replicas]]\n")
+	assert.Contains(t, string(encrypted), "ports = [\n  8000, # http\n  8001, # https\n]\nbooted = 2021-11-02 08:15:00\n")
+	assert.Contains(t, string(encrypted), "\" # expires soon\n")
+
+	store, err = newTOMLStore(encrypted)
+	assert.Nil(t, err)
+	for _, path := range paths {
+		err = store.DecryptSubtree(ageIdentity.String(), path...)
+		assert.Nil(t, err)
+	}
+
+	decrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, string(bites), string(decrypted))
+}
+
+func TestTOMLEdits(t *testing.T) {
+	doc := "# top\na = 1\n\n# about t\n[t]\nb = 2 # two\n\n# about c\nc = 3\n\n[u]\nd = 4\n\n[[s]]\nn = 1\n\n[[s]]\nn = 2\n"
+	store, err := newTOMLStore([]byte(doc))
+	assert.Nil(t, err)
+
+	err = store.Set(5, "t", "b")
+	assert.Nil(t, err)
+	err = store.Delete("t", "c")
+	assert.Nil(t, err)
+	err = store.Set("new", "t", "e")
+	assert.Nil(t, err)
+	err = store.Set(map[string]interface{}{"g": true}, "t", "f")
+	assert.Nil(t, err)
+	err = store.Delete("u")
+	assert.Nil(t, err)
+	err = store.Set([]interface{}{
+		map[string]interface{}{"n": 1},
+		map[string]interface{}{"n": 2},
+		map[string]interface{}{"n": 3},
+	}, "s")
+	assert.Nil(t, err)
+	err = store.Set("x", "z")
+	assert.Nil(t, err)
+
+	bites, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, "# top\na = 1\nz = \"x\"\n\n# about t\n[t]\nb = 5 # two\ne = \"new\"\n\n[t.f]\ng = true\n\n[[s]]\nn = 1\n\n[[s]]\nn = 2\n\n[[s]]\nn = 3\n", string(bites))
+}
+
+func TestTOMLPathBelowDate(t *testing.T) {
+	store, err := newTOMLStore([]byte("[database]\nrotated = 2021-11-02\n"))
+	assert.Nil(t, err)
+
+	v, err := store.Get("database", "rotated")
+	assert.Nil(t, err)
+	assert.Equal(t, Datetime("2021-11-02"), v)
+
+	_, err = store.Get("database", "rotated", "day")
+	assert.NotNil(t, err)
+	assert.Equal(t, "invalid path", err.Error())
+}
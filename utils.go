@@ -1,22 +1,71 @@
 package keycloak
 
-import "hash"
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Logger receives warnings, e.g. about files written in outdated formats.
+var Logger = log.New(os.Stderr, "keycloak: ", 0)
 
 type encryptionFunc func([]byte) ([]byte, error)
 
 type decryptionFunc func([]byte) ([]byte, error)
 
-type hashingFunc func([]byte) error
+// hashingFunc is called for every node in a subtree. Leaves pass their type
+// byte and plaintext, objects and arrays pass a marker and their length.
+type hashingFunc func(path []string, kind byte, data []byte) error
 
 type hasher struct {
 	hash.Hash
+	version macVersion
 }
 
-func (h *hasher) write(bites []byte) error {
-	_, err := h.Write(bites)
+func (h *hasher) write(path []string, kind byte, data []byte) error {
+	if h.version < macVersionStructural {
+		// older MACs only cover the plaintext of leaves
+		if kind == objectMarker || kind == arrayMarker || kind == metadataMarker {
+			return nil
+		}
+
+		_, err := h.Write(data)
+		return err
+	}
+
+	// every field is length-prefixed to make the encoding unambiguous
+	_, err := h.Write(encodeLength(len(path)))
+	if err != nil {
+		return err
+	}
+
+	for _, p := range path {
+		_, err = h.Write(joinSize(8+len(p), encodeLength(len(p)), []byte(p)))
+		if err != nil {
+			return err
+		}
+	}
+
+	_, err = h.Write(joinSize(9+len(data), []byte{kind}, encodeLength(len(data)), data))
 	return err
 }
 
+func encodeLength(l int) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], uint64(l))
+	return buf[:]
+}
+
 func joinSize(size int, s ...[]byte) []byte {
 	i := 0
 	b := make([]byte, size)
@@ -25,3 +74,197 @@ func joinSize(size int, s ...[]byte) []byte {
 	}
 	return b
 }
+
+// writeFile atomically replaces the file at path. The data is written into a
+// temporary file next to it first which is then renamed. If path is a symlink,
+// the file it points to is replaced. An existing file keeps its permissions,
+// new files are only readable by the current user.
+func writeFile(path string, bites []byte) error {
+	mode := os.FileMode(0600)
+	resolved, err := filepath.EvalSymlinks(path)
+	if err == nil {
+		path = resolved
+		info, err := os.Stat(path)
+		if err != nil {
+			return err
+		}
+		mode = info.Mode().Perm()
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	fd, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".tmp-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fd.Name())
+
+	_, err = fd.Write(bites)
+	if err != nil {
+		fd.Close()
+		return err
+	}
+
+	err = fd.Sync()
+	if err != nil {
+		fd.Close()
+		return err
+	}
+
+	err = fd.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(fd.Name(), mode)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(fd.Name(), path)
+}
+
+// parallelize calls fn for every index in [0, n) using at most workers
+// goroutines or runtime.GOMAXPROCS if workers isn't positive. It returns the
+// first error fn returned. Once fn failed, the remaining indexes are skipped.
+func parallelize(workers int, n int, fn func(idx int) error) error {
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	if workers > n {
+		workers = n
+	}
+
+	if workers <= 1 {
+		for idx := 0; idx < n; idx++ {
+			err := fn(idx)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+
+	var mu sync.Mutex
+	var firstErr error
+	failed := func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return firstErr != nil
+	}
+
+	idxs := make(chan int)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for w := 0; w < workers; w++ {
+		go func() {
+			defer wg.Done()
+			for idx := range idxs {
+				if failed() {
+					continue
+				}
+
+				err := fn(idx)
+				if err != nil {
+					mu.Lock()
+					if firstErr == nil {
+						firstErr = err
+					}
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+
+	for idx := 0; idx < n; idx++ {
+		idxs <- idx
+	}
+	close(idxs)
+	wg.Wait()
+	return firstErr
+}
+
+// flatValue converts a value into the string stored in formats that only
+// know strings, e.g. dotenv files. The metadata of an encrypted subtree is
+// stored as json.
+func flatValue(key string, v interface{}) (string, error) {
+	switch v := v.(type) {
+	case string:
+		return v, nil
+	case Datetime:
+		return string(v), nil
+	case json.Number:
+		return v.String(), nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case bool:
+		return strconv.FormatBool(v), nil
+	case nil:
+		return "", nil
+	}
+
+	if key != "__keycloak__" {
+		return "", fmt.Errorf("%s: nested values aren't supported by this format", key)
+	}
+
+	bites, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	return string(bites), nil
+}
+
+// parseFlatValue reverses flatValue.
+func parseFlatValue(key string, value string) (interface{}, error) {
+	if key != "__keycloak__" {
+		return value, nil
+	}
+
+	var meta interface{}
+	err := unmarshalJSON([]byte(value), &meta)
+	if err != nil {
+		return nil, fmt.Errorf("invalid metadata: %s", err.Error())
+	}
+	return meta, nil
+}
+
+// splitLines splits a file into its lines and reports whether the last line
+// ended with a newline.
+func splitLines(bites []byte) ([]string, bool) {
+	content := string(bites)
+	trailingNewline := strings.HasSuffix(content, "\n")
+	content = strings.TrimSuffix(content, "\n")
+	if content == "" {
+		return nil, trailingNewline
+	}
+	return strings.Split(content, "\n"), trailingNewline
+}
+
+// joinLines reverses splitLines.
+func joinLines(lines []string, trailingNewline bool) []byte {
+	content := strings.Join(lines, "\n")
+	if len(lines) > 0 && trailingNewline {
+		content += "\n"
+	}
+	return []byte(content)
+}
+
+// textEdit replaces the text between start and end.
+type textEdit struct {
+	start int
+	end   int
+	text  string
+}
+
+// applyEdits applies edits that are sorted by their start and don't overlap.
+func applyEdits(src []byte, edits []textEdit) []byte {
+	var buf bytes.Buffer
+	last := 0
+	for _, edit := range edits {
+		buf.Write(src[last:edit.start])
+		buf.WriteString(edit.text)
+		last = edit.end
+	}
+	buf.Write(src[last:])
+	return buf.Bytes()
+}
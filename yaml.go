@@ -1,53 +1,1184 @@
 package keycloak
 
 import (
-	"io/ioutil"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
 
-	k8syaml "sigs.k8s.io/yaml"
+	"gopkg.in/yaml.v3"
 )
 
+// defaultYAMLIndent is used for documents without nested block mappings.
+const defaultYAMLIndent = 2
+
+// newYAMLStore parses the document into a yaml node tree and hands its
+// contents to a json store. The text and the node tree are kept around so that
+// ToFile only has to rewrite the nodes that changed.
 func newYAMLStore(bites []byte) (*yamlStore, error) {
-	jsonBites, err := k8syaml.YAMLToJSONStrict(bites)
+	var doc yaml.Node
+	err := yaml.Unmarshal(bites, &doc)
 	if err != nil {
 		return nil, err
 	}
 
-	js, err := newJSONStore(jsonBites)
-	if err != nil {
-		return nil, err
+	root := make(map[string]interface{})
+	if doc.Kind == yaml.DocumentNode {
+		v, err := nodeToValue(doc.Content[0])
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := v.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid document")
+		}
+		root = m
 	}
 
 	return &yamlStore{
-		js: js,
+		js: &jsonStore{
+			root:     root,
+			subtrees: make(map[string]*subtreeState),
+		},
+		doc:    &doc,
+		src:    bites,
+		indent: detectYAMLIndent(&doc),
 	}, nil
 }
 
 type yamlStore struct {
 	js *jsonStore
+	// doc is the document as it was read and src its text
+	doc    *yaml.Node
+	src    []byte
+	indent int
 }
 
 func (s *yamlStore) EncryptSubtree(recipient string, path ...string) error {
+	err := s.checkAliases(path)
+	if err != nil {
+		return err
+	}
 	return s.js.EncryptSubtree(recipient, path...)
 }
 
+func (s *yamlStore) EncryptSubtreeForRecipients(recipients []string, path ...string) error {
+	err := s.checkAliases(path)
+	if err != nil {
+		return err
+	}
+	return s.js.EncryptSubtreeForRecipients(recipients, path...)
+}
+
+func (s *yamlStore) EncryptSubtreeWithPassphrase(passphrase string, path ...string) error {
+	err := s.checkAliases(path)
+	if err != nil {
+		return err
+	}
+	return s.js.EncryptSubtreeWithPassphrase(passphrase, path...)
+}
+
+// checkAliases rejects subtrees whose values are shared with the rest of the
+// document. Aliases and merge keys are expanded when a document is read, so
+// an alias outside of an encrypted subtree would keep a plaintext copy of its
+// values and an alias inside of it would lose the connection to its anchor.
+func (s *yamlStore) checkAliases(path []string) error {
+	if s.doc.Kind != yaml.DocumentNode {
+		return nil
+	}
+
+	st, err := yamlNodeAt(s.doc.Content[0], path)
+	if err != nil || st == nil {
+		return err
+	}
+
+	inside := yamlNodes(st)
+	var check func(n *yaml.Node, in bool) error
+	check = func(n *yaml.Node, in bool) error {
+		in = in || n == st
+		if n.Kind == yaml.AliasNode {
+			switch {
+			case !in && (inside[n.Alias] || yamlNodes(n.Alias)[st]):
+				return fmt.Errorf("yaml: line %d: alias *%s refers to values of the subtree [%s] which would be stored unencrypted", n.Line, n.Value, strings.Join(path, "."))
+			case in && !inside[n.Alias]:
+				return fmt.Errorf("yaml: line %d: alias *%s in the subtree [%s] refers to values outside of it", n.Line, n.Value, strings.Join(path, "."))
+			}
+			return nil
+		}
+
+		for _, child := range n.Content {
+			err := check(child, in)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	return check(s.doc, false)
+}
+
+// yamlNodeAt returns the node at path or nil if there is none. Nodes that
+// are defined by aliases or merge keys can't be addressed.
+func yamlNodeAt(n *yaml.Node, path []string) (*yaml.Node, error) {
+	for idx, key := range path {
+		if n.Kind == yaml.AliasNode {
+			return nil, fmt.Errorf("yaml: subtree [%s] is defined by the alias *%s", strings.Join(path, "."), n.Value)
+		}
+
+		var child *yaml.Node
+		switch n.Kind {
+		case yaml.MappingNode:
+			for i := 0; i+1 < len(n.Content); i += 2 {
+				if n.Content[i].Tag != "!!merge" && n.Content[i].Value == key {
+					child = n.Content[i+1]
+				}
+			}
+			if child == nil && hasMergeKeys(n) {
+				v, err := nodeToRawValue(n)
+				if err != nil {
+					return nil, err
+				}
+				if _, ok := v.(map[string]interface{})[key]; ok {
+					return nil, fmt.Errorf("yaml: subtree [%s] is defined by a merge key", strings.Join(path[:idx+1], "."))
+				}
+			}
+
+		case yaml.SequenceNode:
+			i, err := strconv.Atoi(key)
+			if err == nil && i >= 0 && i < len(n.Content) {
+				child = n.Content[i]
+			}
+		}
+
+		if child == nil {
+			return nil, nil
+		}
+		n = child
+	}
+
+	if n.Kind == yaml.AliasNode {
+		return nil, fmt.Errorf("yaml: subtree [%s] is defined by the alias *%s", strings.Join(path, "."), n.Value)
+	}
+	return n, nil
+}
+
+// yamlNodes returns the nodes of the tree below n without following aliases.
+func yamlNodes(n *yaml.Node) map[*yaml.Node]bool {
+	nodes := make(map[*yaml.Node]bool)
+	var walk func(n *yaml.Node)
+	walk = func(n *yaml.Node) {
+		nodes[n] = true
+		for _, child := range n.Content {
+			walk(child)
+		}
+	}
+	walk(n)
+	return nodes
+}
+
+func (s *yamlStore) UpdateSubtree(recipients []string, path ...string) error {
+	return s.js.UpdateSubtree(recipients, path...)
+}
+
 func (s *yamlStore) DecryptSubtree(identity string, path ...string) error {
 	return s.js.DecryptSubtree(identity, path...)
 }
 
+func (s *yamlStore) DecryptSubtreeWithPassphrase(passphrase string, path ...string) error {
+	return s.js.DecryptSubtreeWithPassphrase(passphrase, path...)
+}
+
+func (s *yamlStore) Rotate(identity string) error {
+	return s.js.Rotate(identity)
+}
+
+func (s *yamlStore) RotateWithPassphrase(passphrase string) error {
+	return s.js.RotateWithPassphrase(passphrase)
+}
+
+func (s *yamlStore) UpdateRecipients(identity string, recipients []string) ([]string, []string, error) {
+	return s.js.UpdateRecipients(identity, recipients)
+}
+
+func (s *yamlStore) UpdateRecipientsWithPassphrase(passphrase string, recipients []string) ([]string, []string, error) {
+	return s.js.UpdateRecipientsWithPassphrase(passphrase, recipients)
+}
+
 func (s *yamlStore) Subtree(path ...string) (map[string]interface{}, error) {
 	return s.js.Subtree(path...)
 }
 
+func (s *yamlStore) Get(path ...string) (interface{}, error) {
+	return s.js.Get(path...)
+}
+
+func (s *yamlStore) Set(value interface{}, path ...string) error {
+	return s.js.Set(value, path...)
+}
+
+func (s *yamlStore) Delete(path ...string) error {
+	return s.js.Delete(path...)
+}
+
+func (s *yamlStore) backingStore() *jsonStore {
+	return s.js
+}
+
 func (s *yamlStore) ToFile(path string) error {
-	bites, err := s.js.bytes()
+	bites, err := s.bytes()
 	if err != nil {
 		return err
 	}
 
-	yamlBites, err := k8syaml.JSONToYAML(bites)
+	return writeFile(path, bites)
+}
+
+// bytes writes the current contents of the store. Only the text of nodes
+// whose values changed is rewritten, everything else is written as it was
+// read. Documents that can't be edited in place are encoded as a whole.
+func (s *yamlStore) bytes() ([]byte, error) {
+	if s.doc.Kind == yaml.DocumentNode {
+		e := &yamlEditor{src: s.src, lines: lineOffsets(s.src), indent: s.indent}
+		err := e.edit(s.doc.Content[0], nil, s.js.root)
+		if err == nil {
+			return s.reset(e.apply())
+		}
+		if err != errYAMLNotEditable {
+			return nil, err
+		}
+	} else {
+		s.doc = &yaml.Node{
+			Kind:    yaml.DocumentNode,
+			Content: []*yaml.Node{{}},
+		}
+	}
+
+	err := mergeValueIntoNode(s.doc.Content[0], s.js.root)
+	if err != nil {
+		return nil, err
+	}
+
+	bites, err := encodeYAMLNode(s.doc, s.indent)
+	if err != nil {
+		return nil, err
+	}
+	return s.reset(bites)
+}
+
+// reset makes the written text the base of the next edits.
+func (s *yamlStore) reset(bites []byte) ([]byte, error) {
+	var doc yaml.Node
+	err := yaml.Unmarshal(bites, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	s.doc = &doc
+	s.src = bites
+	return bites, nil
+}
+
+// MarshalYAML encodes a document as returned by Store.Subtree as YAML.
+// Dates read from YAML or TOML files are written as such.
+func MarshalYAML(v interface{}) ([]byte, error) {
+	n, err := valueToNode(v)
+	if err != nil {
+		return nil, err
+	}
+	return encodeYAMLNode(n, defaultYAMLIndent)
+}
+
+func encodeYAMLNode(n *yaml.Node, indent int) ([]byte, error) {
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(indent)
+	err := enc.Encode(n)
+	if err != nil {
+		return nil, err
+	}
+
+	err = enc.Close()
+	if err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// errYAMLNotEditable is returned for changes that can't be made to the text
+// of a document, e.g. changes to anchored nodes that aliases refer to.
+var errYAMLNotEditable = errors.New("yaml: document can't be edited in place")
+
+// yamlEditor collects the edits that turn the text of a document into the
+// current contents of the store. Nodes are located by the line and column
+// the parser recorded for them.
+type yamlEditor struct {
+	src    []byte
+	lines  []int
+	indent int
+	edits  []textEdit
+}
+
+func (e *yamlEditor) apply() []byte {
+	sort.SliceStable(e.edits, func(i, j int) bool {
+		return e.edits[i].start < e.edits[j].start
+	})
+	return applyEdits(e.src, e.edits)
+}
+
+// edit adds the edits that turn n into v. key is the key of n if n is the
+// value of a mapping.
+func (e *yamlEditor) edit(n *yaml.Node, key *yaml.Node, v interface{}) error {
+	current, err := nodeToValue(n)
+	if err == nil && reflect.DeepEqual(current, v) {
+		return nil
+	}
+
+	if n.Anchor != "" {
+		return errYAMLNotEditable
+	}
+
+	block := n.Style&yaml.FlowStyle == 0 && len(n.Content) > 0
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if n.Kind == yaml.MappingNode && block && len(v) > 0 && !hasMergeKeys(n) {
+			return e.editMapping(n, key, v)
+		}
+
+	case []interface{}:
+		if n.Kind == yaml.SequenceNode && block && len(v) > 0 {
+			return e.editSequence(n, key, v)
+		}
+	}
+	return e.replace(n, key, v)
+}
+
+// editMapping edits the entries of a block mapping. Removed entries are
+// deleted together with the comments in front of them and new entries are
+// added after the last one in sorted order.
+func (e *yamlEditor) editMapping(n *yaml.Node, parent *yaml.Node, m map[string]interface{}) error {
+	var kept int
+	for idx := 0; idx+1 < len(n.Content); idx += 2 {
+		key := n.Content[idx]
+		if _, ok := m[key.Value]; ok {
+			kept++
+			continue
+		}
+
+		if !e.startsLine(key) {
+			// e.g. the first key of a mapping in a sequence item
+			return e.replace(n, parent, m)
+		}
+	}
+	if kept == 0 {
+		return e.replace(n, parent, m)
+	}
+
+	// editing the values moves them
+	end, err := e.end(n.Content[len(n.Content)-1])
+	if err != nil {
+		return err
+	}
+	indent := strings.Repeat(" ", n.Content[0].Column-1)
+
+	seen := make(map[string]bool, len(m))
+	for idx := 0; idx+1 < len(n.Content); idx += 2 {
+		key, value := n.Content[idx], n.Content[idx+1]
+		if key.Kind != yaml.ScalarNode {
+			return errYAMLNotEditable
+		}
+
+		child, ok := m[key.Value]
+		if !ok {
+			err := e.deleteEntry(key, value)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := e.edit(value, key, child)
+		if err != nil {
+			return err
+		}
+		seen[key.Value] = true
+	}
+
+	var entries []string
+	for _, key := range sortedKeys(m) {
+		if seen[key] {
+			continue
+		}
+
+		value, err := valueToNode(m[key])
+		if err != nil {
+			return err
+		}
+
+		keyNode := &yaml.Node{}
+		keyNode.SetString(key)
+		entry, err := e.encode(&yaml.Node{Kind: yaml.MappingNode, Content: []*yaml.Node{keyNode, value}})
+		if err != nil {
+			return err
+		}
+		entries = append(entries, entry)
+	}
+
+	if len(entries) > 0 {
+		e.insert(e.lineEnd(end), "\n"+indentLines(strings.Join(entries, "\n"), indent, true))
+	}
+	return nil
+}
+
+// editSequence edits the items of a block sequence. Items that are left over
+// are deleted and new items are added after the last one.
+func (e *yamlEditor) editSequence(n *yaml.Node, parent *yaml.Node, a []interface{}) error {
+	for idx := len(a); idx < len(n.Content); idx++ {
+		if _, err := e.dash(n.Content[idx]); err != nil {
+			return e.replace(n, parent, a)
+		}
+	}
+
+	// editing the items moves them
+	last := n.Content[len(n.Content)-1]
+	end, err := e.end(last)
+	if err != nil {
+		return err
+	}
+
+	dash, err := e.dash(last)
+	if err != nil && len(a) > len(n.Content) {
+		return e.replace(n, parent, a)
+	}
+
+	for idx, item := range n.Content {
+		if idx < len(a) {
+			err := e.edit(item, nil, a[idx])
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err := e.deleteEntry(item, item)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(a) <= len(n.Content) {
+		return nil
+	}
+
+	items, err := valueToNode(a[len(n.Content):])
+	if err != nil {
+		return err
+	}
+
+	text, err := e.encode(items)
+	if err != nil {
+		return err
+	}
+	e.insert(e.lineEnd(end), "\n"+indentLines(text, strings.Repeat(" ", dash.Column-1), true))
+	return nil
+}
+
+// deleteEntry deletes the lines from first to the end of last as well as the
+// comment lines right in front of them.
+func (e *yamlEditor) deleteEntry(first *yaml.Node, last *yaml.Node) error {
+	end, err := e.end(last)
 	if err != nil {
 		return err
 	}
 
-	return ioutil.WriteFile(path, yamlBites, 0600)
+	line := first.Line
+	if dash, err := e.dash(first); err == nil {
+		line = dash.Line
+	}
+
+	text := e.line(line)
+	indent := text[:len(text)-len(strings.TrimLeft(text, " \t"))]
+	for line > 1 {
+		if !strings.HasPrefix(e.line(line-1), indent+"#") {
+			break
+		}
+		line--
+	}
+
+	start := e.lines[line-1]
+	end = e.lineEnd(end)
+	if start > 0 {
+		// the line break in front of the entry goes with it and so does a
+		// blank line if the entry was surrounded by blank lines
+		start--
+		if start > 0 && e.src[start-1] == '\n' && (end == len(e.src) || end+1 == len(e.src) || e.src[end+1] == '\n') {
+			start--
+		}
+	} else if end < len(e.src) {
+		end++
+	}
+	e.edits = append(e.edits, textEdit{start: start, end: end})
+	return nil
+}
+
+// replace rewrites the text of n. New block collections start on a line of
+// their own, everything else takes the place of the old text.
+func (e *yamlEditor) replace(n *yaml.Node, key *yaml.Node, v interface{}) error {
+	start := e.offset(n.Line, n.Column)
+	end, err := e.end(n)
+	if err != nil {
+		return err
+	}
+
+	column := n.Column
+	line := n.Line
+	empty := start == end
+	err = mergeValueIntoNode(n, v)
+	if err != nil {
+		return err
+	}
+
+	// the comments of n are kept in the text around it
+	replacement := *n
+	replacement.HeadComment = ""
+	replacement.LineComment = ""
+	replacement.FootComment = ""
+	text, err := e.encode(&replacement)
+	if err != nil {
+		return err
+	}
+
+	block := (n.Kind == yaml.MappingNode || n.Kind == yaml.SequenceNode) && n.Style&yaml.FlowStyle == 0 && len(n.Content) > 0
+	if key == nil {
+		if empty {
+			// an empty item follows its dash after a space
+			text = " " + text
+			column++
+		}
+		e.edits = append(e.edits, textEdit{start: start, end: end, text: indentLines(text, strings.Repeat(" ", column-1), false)})
+		return nil
+	}
+
+	keyIndent := strings.Repeat(" ", key.Column-1)
+	colon, err := e.colon(key)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case block:
+		if line == key.Line || empty {
+			start = colon
+		} else {
+			start = e.lineEnd(colon)
+		}
+		text = "\n" + indentLines(text, keyIndent+strings.Repeat(" ", e.indent), true)
+
+	case empty || (line > key.Line && strings.TrimSpace(string(e.src[colon:e.lineEnd(colon)])) == ""):
+		start = colon
+		text = " " + indentLines(text, keyIndent, false)
+
+	case line > key.Line:
+		// keep the comment behind the key
+		start = e.lineEnd(colon)
+		indent := keyIndent + strings.Repeat(" ", e.indent)
+		text = "\n" + indentLines(text, indent, true)
+
+	default:
+		text = indentLines(text, keyIndent, false)
+	}
+	e.edits = append(e.edits, textEdit{start: start, end: end, text: text})
+	return nil
+}
+
+func (e *yamlEditor) insert(offset int, text string) {
+	e.edits = append(e.edits, textEdit{start: offset, end: offset, text: text})
+}
+
+func (e *yamlEditor) encode(n *yaml.Node) (string, error) {
+	bites, err := encodeYAMLNode(n, e.indent)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimSuffix(string(bites), "\n"), nil
+}
+
+// indentLines indents all lines but the first unless first is set. Empty
+// lines aren't indented.
+func indentLines(text string, indent string, first bool) string {
+	lines := strings.Split(text, "\n")
+	for idx, line := range lines {
+		if line != "" && (first || idx > 0) {
+			lines[idx] = indent + line
+		}
+	}
+	return strings.Join(lines, "\n")
+}
+
+// lineOffsets returns the offsets at which the lines of src start.
+func lineOffsets(src []byte) []int {
+	lines := []int{0}
+	for idx, b := range src {
+		if b == '\n' {
+			lines = append(lines, idx+1)
+		}
+	}
+	return lines
+}
+
+// offset converts the line and column of a node into an offset into the text.
+// Columns count characters, not bytes.
+func (e *yamlEditor) offset(line int, column int) int {
+	idx := e.lines[line-1]
+	for c := 1; c < column && idx < len(e.src) && e.src[idx] != '\n'; c++ {
+		_, size := utf8.DecodeRune(e.src[idx:])
+		idx += size
+	}
+	return idx
+}
+
+func (e *yamlEditor) lineEnd(offset int) int {
+	idx := bytes.IndexByte(e.src[offset:], '\n')
+	if idx < 0 {
+		return len(e.src)
+	}
+	return offset + idx
+}
+
+func (e *yamlEditor) line(line int) string {
+	start := e.lines[line-1]
+	return string(e.src[start:e.lineEnd(start)])
+}
+
+func (e *yamlEditor) startsLine(n *yaml.Node) bool {
+	start := e.lines[n.Line-1]
+	return strings.TrimSpace(string(e.src[start:e.offset(n.Line, n.Column)])) == ""
+}
+
+// dash returns a node for the dash of a sequence item if it starts a line.
+func (e *yamlEditor) dash(item *yaml.Node) (*yaml.Node, error) {
+	idx := e.offset(item.Line, item.Column) - 1
+	for idx >= 0 && (e.src[idx] == ' ' || e.src[idx] == '\t') {
+		idx--
+	}
+	if idx < 0 || e.src[idx] != '-' {
+		return nil, errYAMLNotEditable
+	}
+
+	line := bytes.Count(e.src[:idx], []byte("\n")) + 1
+	if strings.TrimSpace(string(e.src[e.lines[line-1]:idx])) != "" {
+		return nil, errYAMLNotEditable
+	}
+	return &yaml.Node{Line: line, Column: utf8.RuneCount(e.src[e.lines[line-1]:idx]) + 1}, nil
+}
+
+// colon returns the offset behind the colon that follows a key.
+func (e *yamlEditor) colon(key *yaml.Node) (int, error) {
+	idx, err := e.end(key)
+	if err != nil {
+		return 0, err
+	}
+
+	for idx < len(e.src) && (e.src[idx] == ' ' || e.src[idx] == '\t') {
+		idx++
+	}
+	if idx == len(e.src) || e.src[idx] != ':' {
+		return 0, errYAMLNotEditable
+	}
+	return idx + 1, nil
+}
+
+// end returns the offset behind the text of a node.
+func (e *yamlEditor) end(n *yaml.Node) (int, error) {
+	if (n.Kind == yaml.MappingNode || n.Kind == yaml.SequenceNode) && n.Style&yaml.FlowStyle == 0 {
+		if len(n.Content) == 0 {
+			return 0, errYAMLNotEditable
+		}
+		return e.end(n.Content[len(n.Content)-1])
+	}
+
+	start := e.offset(n.Line, n.Column)
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!null" && n.Value == "" {
+		return start, nil
+	}
+
+	// skip anchors and tags
+	idx := start
+	for idx < len(e.src) && (e.src[idx] == '&' || e.src[idx] == '!') {
+		for idx < len(e.src) && !isYAMLSpace(e.src[idx]) {
+			idx++
+		}
+		for idx < len(e.src) && (e.src[idx] == ' ' || e.src[idx] == '\t') {
+			idx++
+		}
+	}
+
+	switch {
+	case n.Kind == yaml.MappingNode || n.Kind == yaml.SequenceNode:
+		return e.flowEnd(idx)
+	case n.Kind == yaml.AliasNode:
+		for idx < len(e.src) && !isYAMLSpace(e.src[idx]) && !strings.ContainsRune(",[]{}", rune(e.src[idx])) {
+			idx++
+		}
+		return idx, nil
+	case n.Kind != yaml.ScalarNode:
+		return 0, errYAMLNotEditable
+	case n.Style&yaml.DoubleQuotedStyle != 0:
+		return e.quotedEnd(idx, '"')
+	case n.Style&yaml.SingleQuotedStyle != 0:
+		return e.quotedEnd(idx, '\'')
+	case n.Style&(yaml.LiteralStyle|yaml.FoldedStyle) != 0:
+		return e.blockScalarEnd(idx), nil
+	default:
+		return e.plainEnd(idx, n.Value), nil
+	}
+}
+
+func isYAMLSpace(b byte) bool {
+	return b == ' ' || b == '\t' || b == '\r' || b == '\n'
+}
+
+func (e *yamlEditor) quotedEnd(idx int, quote byte) (int, error) {
+	for idx++; idx < len(e.src); idx++ {
+		switch {
+		case quote == '"' && e.src[idx] == '\\':
+			idx++
+		case e.src[idx] == quote && quote == '\'' && idx+1 < len(e.src) && e.src[idx+1] == '\'':
+			idx++
+		case e.src[idx] == quote:
+			return idx + 1, nil
+		}
+	}
+	return 0, errYAMLNotEditable
+}
+
+// flowEnd returns the offset behind the bracket that closes a flow collection.
+func (e *yamlEditor) flowEnd(idx int) (int, error) {
+	depth := 0
+	for ; idx < len(e.src); idx++ {
+		switch c := e.src[idx]; {
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+			if depth == 0 {
+				return idx + 1, nil
+			}
+		case c == '"' || c == '\'':
+			end, err := e.quotedEnd(idx, c)
+			if err != nil {
+				return 0, err
+			}
+			idx = end - 1
+		case c == '#' && idx > 0 && isYAMLSpace(e.src[idx-1]):
+			idx = e.lineEnd(idx)
+		}
+	}
+	return 0, errYAMLNotEditable
+}
+
+// blockScalarEnd returns the offset behind the last line of a literal or
+// folded scalar that isn't blank. Trailing blank lines are kept.
+func (e *yamlEditor) blockScalarEnd(idx int) int {
+	end := e.lineEnd(idx)
+	contentIndent := -1
+	for line := end + 1; line < len(e.src); line = e.lineEnd(line) + 1 {
+		text := string(e.src[line:e.lineEnd(line)])
+		if strings.TrimSpace(text) == "" {
+			continue
+		}
+
+		indent := len(text) - len(strings.TrimLeft(text, " "))
+		if contentIndent < 0 {
+			contentIndent = indent
+		}
+		if indent < contentIndent || indent == 0 {
+			break
+		}
+		end = e.lineEnd(line)
+	}
+	return end
+}
+
+// plainEnd returns the offset behind a plain scalar. Multi-line scalars are
+// followed until their folded lines add up to the value.
+func (e *yamlEditor) plainEnd(idx int, value string) int {
+	end := e.plainLineEnd(idx)
+	folded := strings.TrimSpace(string(e.src[idx:end]))
+	breaks := 0
+	for line := e.lineEnd(end) + 1; folded != value && len(folded) < len(value) && line < len(e.src); line = e.lineEnd(line) + 1 {
+		start := line
+		for start < len(e.src) && (e.src[start] == ' ' || e.src[start] == '\t') {
+			start++
+		}
+
+		lineEnd := e.plainLineEnd(start)
+		text := strings.TrimSpace(string(e.src[start:lineEnd]))
+		if text == "" {
+			breaks++
+			continue
+		}
+
+		if breaks == 0 {
+			folded += " "
+		}
+		folded += strings.Repeat("\n", breaks) + text
+		breaks = 0
+		end = lineEnd
+	}
+	return end
+}
+
+// plainLineEnd returns the end of the part of a line in front of a comment
+// or a mapping value without trailing whitespace.
+func (e *yamlEditor) plainLineEnd(idx int) int {
+	end := e.lineEnd(idx)
+	for i := idx; i < end; i++ {
+		if e.src[i] == '#' && i > idx && (e.src[i-1] == ' ' || e.src[i-1] == '\t') {
+			end = i
+			break
+		}
+		if e.src[i] == ':' && (i+1 == len(e.src) || isYAMLSpace(e.src[i+1])) {
+			end = i
+			break
+		}
+	}
+	for end > idx && isYAMLSpace(e.src[end-1]) {
+		end--
+	}
+	return end
+}
+
+// nodeToValue converts a yaml node into the generic representation used by
+// the json store.
+func nodeToValue(n *yaml.Node) (interface{}, error) {
+	v, err := nodeToRawValue(n)
+	if err != nil {
+		return nil, err
+	}
+	return normalizeValue(v)
+}
+
+func nodeToRawValue(n *yaml.Node) (interface{}, error) {
+	switch n.Kind {
+	case yaml.DocumentNode:
+		if len(n.Content) == 0 {
+			return nil, nil
+		}
+		return nodeToRawValue(n.Content[0])
+
+	case yaml.AliasNode:
+		return nodeToRawValue(n.Alias)
+
+	case yaml.MappingNode:
+		m := make(map[string]interface{})
+		lines := make(map[string]int)
+		// explicit keys take precedence over merged ones
+		var merged []*yaml.Node
+		for idx := 0; idx+1 < len(n.Content); idx += 2 {
+			key, value := n.Content[idx], n.Content[idx+1]
+			if key.Tag == "!!merge" {
+				merged = append(merged, value)
+				continue
+			}
+
+			if line, ok := lines[key.Value]; ok {
+				return nil, fmt.Errorf("yaml: line %d: mapping key %q already defined at line %d", key.Line, key.Value, line)
+			}
+			lines[key.Value] = key.Line
+
+			v, err := nodeToRawValue(value)
+			if err != nil {
+				return nil, err
+			}
+			m[key.Value] = v
+		}
+
+		for _, value := range merged {
+			if value.Kind == yaml.AliasNode {
+				value = value.Alias
+			}
+
+			sources := []*yaml.Node{value}
+			if value.Kind == yaml.SequenceNode {
+				sources = value.Content
+			}
+
+			for _, source := range sources {
+				v, err := nodeToRawValue(source)
+				if err != nil {
+					return nil, err
+				}
+
+				sm, ok := v.(map[string]interface{})
+				if !ok {
+					return nil, fmt.Errorf("yaml: line %d: invalid merge", value.Line)
+				}
+
+				for key, v := range sm {
+					if _, ok := m[key]; !ok {
+						m[key] = v
+					}
+				}
+			}
+		}
+		return m, nil
+
+	case yaml.SequenceNode:
+		a := make([]interface{}, len(n.Content))
+		for idx, item := range n.Content {
+			v, err := nodeToRawValue(item)
+			if err != nil {
+				return nil, err
+			}
+			a[idx] = v
+		}
+		return a, nil
+
+	default:
+		var v interface{}
+		err := n.Decode(&v)
+		if err != nil {
+			return nil, err
+		}
+
+		// keep dates as they were written
+		if _, ok := v.(time.Time); ok {
+			return Datetime(n.Value), nil
+		}
+		return v, nil
+	}
+}
+
+// mergeValueIntoNode updates the node tree to represent v. Mappings keep the
+// order of their keys and new keys are appended in sorted order. Nodes that
+// already represent their value aren't touched.
+func mergeValueIntoNode(n *yaml.Node, v interface{}) error {
+	if n.Kind == yaml.AliasNode || n.Kind == yaml.ScalarNode {
+		current, err := nodeToValue(n)
+		if err == nil && reflect.DeepEqual(current, v) {
+			return nil
+		}
+	}
+
+	switch v := v.(type) {
+	case map[string]interface{}:
+		if n.Kind != yaml.MappingNode || hasMergeKeys(n) {
+			return replaceNode(n, v)
+		}
+
+		var content []*yaml.Node
+		seen := make(map[string]bool, len(v))
+		for idx := 0; idx+1 < len(n.Content); idx += 2 {
+			key, value := n.Content[idx], n.Content[idx+1]
+			child, ok := v[key.Value]
+			if !ok {
+				continue
+			}
+
+			err := mergeValueIntoNode(value, child)
+			if err != nil {
+				return err
+			}
+			content = append(content, key, value)
+			seen[key.Value] = true
+		}
+
+		for _, key := range sortedKeys(v) {
+			if seen[key] {
+				continue
+			}
+
+			value, err := valueToNode(v[key])
+			if err != nil {
+				return err
+			}
+
+			keyNode := &yaml.Node{}
+			keyNode.SetString(key)
+			content = append(content, keyNode, value)
+		}
+		n.Content = content
+		return nil
+
+	case []interface{}:
+		if n.Kind != yaml.SequenceNode {
+			return replaceNode(n, v)
+		}
+
+		if len(n.Content) > len(v) {
+			n.Content = n.Content[:len(v)]
+		}
+
+		for idx, item := range v {
+			if idx < len(n.Content) {
+				err := mergeValueIntoNode(n.Content[idx], item)
+				if err != nil {
+					return err
+				}
+				continue
+			}
+
+			itemNode, err := valueToNode(item)
+			if err != nil {
+				return err
+			}
+			n.Content = append(n.Content, itemNode)
+		}
+		return nil
+
+	default:
+		return replaceNode(n, v)
+	}
+}
+
+// replaceNode replaces n with a node for v and keeps the comments of n.
+// Strings keep their quoting style.
+func replaceNode(n *yaml.Node, v interface{}) error {
+	replacement, err := valueToNode(v)
+	if err != nil {
+		return err
+	}
+
+	if n.Kind == yaml.ScalarNode && n.Tag == "!!str" && replacement.Tag == "!!str" {
+		switch n.Style {
+		case yaml.DoubleQuotedStyle, yaml.SingleQuotedStyle:
+			replacement.Style = n.Style
+		case yaml.LiteralStyle, yaml.FoldedStyle:
+			if strings.Contains(replacement.Value, "\n") {
+				replacement.Style = n.Style
+			}
+		}
+	}
+
+	replacement.HeadComment = n.HeadComment
+	replacement.LineComment = n.LineComment
+	replacement.FootComment = n.FootComment
+	*n = *replacement
+	return nil
+}
+
+func valueToNode(v interface{}) (*yaml.Node, error) {
+	switch v := v.(type) {
+	case map[string]interface{}:
+		n := &yaml.Node{Kind: yaml.MappingNode, Tag: "!!map"}
+		for _, key := range sortedKeys(v) {
+			value, err := valueToNode(v[key])
+			if err != nil {
+				return nil, err
+			}
+
+			keyNode := &yaml.Node{}
+			keyNode.SetString(key)
+			n.Content = append(n.Content, keyNode, value)
+		}
+		return n, nil
+
+	case []interface{}:
+		n := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+		for _, item := range v {
+			itemNode, err := valueToNode(item)
+			if err != nil {
+				return nil, err
+			}
+			n.Content = append(n.Content, itemNode)
+		}
+		return n, nil
+
+	case string:
+		n := &yaml.Node{}
+		n.SetString(v)
+		return n, nil
+
+	case Datetime:
+		// dates that yaml doesn't know, e.g. times of day from toml files,
+		// are written as strings
+		n := &yaml.Node{Kind: yaml.ScalarNode, Value: string(v)}
+		if n.ShortTag() != "!!timestamp" {
+			return valueToNode(string(v))
+		}
+		n.Tag = "!!timestamp"
+		return n, nil
+
+	case json.Number:
+		tag := "!!int"
+		if strings.ContainsAny(string(v), ".eE") {
+			tag = "!!float"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: tag, Value: string(v)}, nil
+
+	case float64:
+		switch {
+		case math.IsNaN(v):
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: ".nan"}, nil
+		case math.IsInf(v, 1):
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: ".inf"}, nil
+		case math.IsInf(v, -1):
+			return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!float", Value: "-.inf"}, nil
+		}
+
+		bites, err := json.Marshal(v)
+		if err != nil {
+			return nil, err
+		}
+		return valueToNode(json.Number(bites))
+
+	case bool:
+		value := "false"
+		if v {
+			value = "true"
+		}
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!bool", Value: value}, nil
+
+	case nil:
+		return &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!null", Value: "null"}, nil
+
+	default:
+		return nil, fmt.Errorf("unsupported value type %T", v)
+	}
+}
+
+func hasMergeKeys(n *yaml.Node) bool {
+	for idx := 0; idx < len(n.Content); idx += 2 {
+		if n.Content[idx].Tag == "!!merge" {
+			return true
+		}
+	}
+	return false
+}
+
+// detectYAMLIndent returns the indentation of the first nested block mapping.
+func detectYAMLIndent(n *yaml.Node) int {
+	indent, ok := findYAMLIndent(n)
+	if !ok {
+		return defaultYAMLIndent
+	}
+	return indent
+}
+
+func findYAMLIndent(n *yaml.Node) (int, bool) {
+	if n.Kind == yaml.MappingNode {
+		for idx := 0; idx+1 < len(n.Content); idx += 2 {
+			key, value := n.Content[idx], n.Content[idx+1]
+			if value.Kind == yaml.MappingNode && value.Style&yaml.FlowStyle == 0 && value.Line > key.Line {
+				if indent := value.Column - key.Column; indent >= 2 {
+					return indent, true
+				}
+			}
+		}
+	}
+
+	for _, child := range n.Content {
+		if indent, ok := findYAMLIndent(child); ok {
+			return indent, true
+		}
+	}
+	return 0, false
 }
@@ -1,7 +1,9 @@
 package keycloak
 
 import (
+	"encoding/json"
 	"io/ioutil"
+	"strings"
 	"testing"
 
 	"filippo.io/age"
@@ -19,6 +21,10 @@ func TestYAMLBasic(t *testing.T) {
 			file: "testdata/creds1.yaml",
 			path: []string{"secrets"},
 		},
+		{
+			file: "testdata/creds3.yaml",
+			path: []string{"secrets"},
+		},
 	}
 
 	for _, test := range yamls {
@@ -58,3 +64,281 @@ func runTestYAMLBasic(t *testing.T, file string, path []string) {
 	diff, _ := jsondiff.Compare(jsonBites, jsonBites2, &opts)
 	assert.Equal(t, jsondiff.FullMatch, diff)
 }
+
+func TestYAMLPreservesFormatting(t *testing.T) {
+	bites, err := ioutil.ReadFile("testdata/values.yaml")
+	assert.Nil(t, err)
+	yStore, err := newYAMLStore(bites)
+	assert.Nil(t, err)
+
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+
+	err = yStore.EncryptSubtree(ageIdentity.Recipient().String(), "secrets")
+	assert.Nil(t, err)
+
+	encrypted, err := yStore.bytes()
+	assert.Nil(t, err)
+	lines := strings.Split(string(bites), "\n")
+	encryptedLines := strings.Split(string(encrypted), "\n")
+	// everything in front of the secrets is untouched
+	assert.Equal(t, lines[:8], encryptedLines[:8])
+	// and so is everything after them
+	assert.Equal(t, lines[len(lines)-5:], encryptedLines[len(encryptedLines)-5:])
+	assert.Contains(t, string(encrypted), "  # password of the application user\n  db-password: '")
+	assert.Contains(t, string(encrypted), "  db-port: ")
+	assert.Contains(t, string(encrypted), " # not really a secret\n")
+	assert.NotContains(t, string(encrypted), "super-secret-password1")
+
+	err = yStore.DecryptSubtree(ageIdentity.String(), "secrets")
+	assert.Nil(t, err)
+	decrypted, err := yStore.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, string(bites), string(decrypted))
+}
+
+func TestYAMLSetAndDelete(t *testing.T) {
+	bites, err := ioutil.ReadFile("testdata/values.yaml")
+	assert.Nil(t, err)
+	yStore, err := newYAMLStore(bites)
+	assert.Nil(t, err)
+
+	err = yStore.Set("debug", "image", "pullPolicy")
+	assert.Nil(t, err)
+	err = yStore.Set(map[string]interface{}{"enabled": true}, "ingress")
+	assert.Nil(t, err)
+	err = yStore.Delete("resources")
+	assert.Nil(t, err)
+
+	updated, err := yStore.bytes()
+	assert.Nil(t, err)
+	expected := strings.Replace(string(bites), "pullPolicy: IfNotPresent", "pullPolicy: debug", 1)
+	expected = expected[:strings.Index(expected, "resources:")] + "ingress:\n  enabled: true\n"
+	assert.Equal(t, expected, string(updated))
+}
+
+func TestYAMLIndent(t *testing.T) {
+	yStore, err := newYAMLStore([]byte("a:\n    b: c # comment\nd:\n    - e\n"))
+	assert.Nil(t, err)
+	bites, err := yStore.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, "a:\n    b: c # comment\nd:\n    - e\n", string(bites))
+}
+
+func TestYAMLDuplicateKeys(t *testing.T) {
+	_, err := newYAMLStore([]byte("a: 1\nb:\n  c: 2\n  c: 3\n"))
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "line 4")
+
+	// merged keys may be overridden
+	_, err = newYAMLStore([]byte("base: &base\n  c: 2\nb:\n  <<: *base\n  c: 3\n"))
+	assert.Nil(t, err)
+}
+
+func TestYAMLPreservesLayout(t *testing.T) {
+	bites, err := ioutil.ReadFile("testdata/chart-values.yaml")
+	assert.Nil(t, err)
+	yStore, err := newYAMLStore(bites)
+	assert.Nil(t, err)
+
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	err = yStore.EncryptSubtree(ageIdentity.Recipient().String(), "secrets")
+	assert.Nil(t, err)
+
+	encrypted, err := yStore.bytes()
+	assert.Nil(t, err)
+	assert.NotContains(t, string(encrypted), "super-secret")
+	// everything around the secrets is untouched
+	secrets := strings.Index(string(bites), "secrets:")
+	tolerations := strings.Index(string(bites), "\ntolerations:")
+	assert.True(t, strings.HasPrefix(string(encrypted), string(bites[:secrets])))
+	assert.True(t, strings.HasSuffix(string(encrypted), string(bites[tolerations:])))
+	assert.Contains(t, string(encrypted), "\n  apiKeys:\n  - ")
+	assert.Contains(t, string(encrypted), "      # not really a secret\n  __keycloak__:\n")
+	assert.Contains(t, string(encrypted), "\n\n  replicas: ")
+
+	// the encrypted file decrypts to the original text
+	yStore, err = newYAMLStore(encrypted)
+	assert.Nil(t, err)
+	err = yStore.DecryptSubtree(ageIdentity.String(), "secrets")
+	assert.Nil(t, err)
+	decrypted, err := yStore.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, string(bites), string(decrypted))
+
+	// only changed lines are rewritten
+	err = yStore.Set("Always", "image", "pullPolicy")
+	assert.Nil(t, err)
+	err = yStore.Delete("service")
+	assert.Nil(t, err)
+	err = yStore.Set("spot", "tolerations", "0", "value")
+	assert.Nil(t, err)
+	updated, err := yStore.bytes()
+	assert.Nil(t, err)
+	expected := strings.Replace(string(bites), "pullPolicy: IfNotPresent   #", "pullPolicy: Always   #", 1)
+	expected = strings.Replace(expected, "\nservice:\n  type: ClusterIP\n  port: 80\n", "", 1)
+	expected = strings.Replace(expected, "value: keycloak", "value: spot", 1)
+	assert.Equal(t, expected, string(updated))
+}
+
+func TestYAMLEdits(t *testing.T) {
+	doc := "a:\nb:\n- x\n-\n- k: 1\n  l: 2\nc: [1, 2] # flow\n"
+	tests := []struct {
+		edit     func(s *yamlStore) error
+		expected string
+	}{
+		{
+			edit:     func(s *yamlStore) error { return s.Set("y", "b", "1") },
+			expected: "a:\nb:\n- x\n- y\n- k: 1\n  l: 2\nc: [1, 2] # flow\n",
+		},
+		{
+			edit:     func(s *yamlStore) error { return s.Set(map[string]interface{}{"z": true}, "a") },
+			expected: "a:\n  z: true\nb:\n- x\n-\n- k: 1\n  l: 2\nc: [1, 2] # flow\n",
+		},
+		{
+			edit:     func(s *yamlStore) error { return s.Set(json.Number("3"), "c", "1") },
+			expected: "a:\nb:\n- x\n-\n- k: 1\n  l: 2\nc: [1, 3] # flow\n",
+		},
+		{
+			edit:     func(s *yamlStore) error { return s.Set("m", "b", "2", "n") },
+			expected: "a:\nb:\n- x\n-\n- k: 1\n  l: 2\n  n: m\nc: [1, 2] # flow\n",
+		},
+		{
+			edit:     func(s *yamlStore) error { return s.Delete("b", "2", "k") },
+			expected: "a:\nb:\n- x\n-\n- l: 2\nc: [1, 2] # flow\n",
+		},
+		{
+			edit:     func(s *yamlStore) error { return s.Delete("b", "2") },
+			expected: "a:\nb:\n- x\n-\nc: [1, 2] # flow\n",
+		},
+	}
+
+	for _, test := range tests {
+		yStore, err := newYAMLStore([]byte(doc))
+		assert.Nil(t, err)
+		assert.Nil(t, test.edit(yStore))
+		bites, err := yStore.bytes()
+		assert.Nil(t, err)
+		assert.Equal(t, test.expected, string(bites))
+	}
+}
+
+func TestYAMLTimestamps(t *testing.T) {
+	doc := "name: some-service\nsecrets:\n  rotated: 2021-01-01\n  expires: 2022-01-01T08:15:00Z\n  quoted: \"2021-01-01\"\n"
+	store, err := newYAMLStore([]byte(doc))
+	assert.Nil(t, err)
+
+	v, err := store.Get("secrets", "rotated")
+	assert.Nil(t, err)
+	assert.Equal(t, Datetime("2021-01-01"), v)
+	v, err = store.Get("secrets", "quoted")
+	assert.Nil(t, err)
+	assert.Equal(t, "2021-01-01", v)
+
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(ageIdentity.Recipient().String(), "secrets")
+	assert.Nil(t, err)
+	encrypted, err := store.bytes()
+	assert.Nil(t, err)
+
+	store, err = newYAMLStore(encrypted)
+	assert.Nil(t, err)
+	err = store.DecryptSubtree(ageIdentity.String(), "secrets")
+	assert.Nil(t, err)
+	decrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Equal(t, doc, string(decrypted))
+
+	// new dates aren't quoted either
+	err = store.Set(Datetime("2023-03-03"), "created")
+	assert.Nil(t, err)
+	err = store.Set(Datetime("03:30:00"), "window")
+	assert.Nil(t, err)
+	bites, err := store.bytes()
+	assert.Nil(t, err)
+	assert.Contains(t, string(bites), "\ncreated: 2023-03-03\n")
+
+	// times of day aren't yaml timestamps
+	store, err = newYAMLStore(bites)
+	assert.Nil(t, err)
+	v, err = store.Get("window")
+	assert.Nil(t, err)
+	assert.Equal(t, "03:30:00", v)
+}
+
+func TestYAMLAliasesAcrossSubtrees(t *testing.T) {
+	ageIdentity, err := age.GenerateX25519Identity()
+	assert.Nil(t, err)
+	recipient := ageIdentity.Recipient().String()
+
+	tests := []struct {
+		doc  string
+		path []string
+		err  string
+	}{
+		{
+			// the alias would keep a plaintext copy of the password
+			doc:  "secrets:\n  password: &pw hunter2\nbackup:\n  password: *pw\n",
+			path: []string{"secrets"},
+			err:  "line 4: alias *pw refers to values of the subtree [secrets]",
+		},
+		{
+			doc:  "all: &all\n  secrets:\n    password: hunter2\ncopy: *all\n",
+			path: []string{"all", "secrets"},
+			err:  "line 4: alias *all refers to values of the subtree [all.secrets]",
+		},
+		{
+			doc:  "base: &base\n  password: hunter2\nprod:\n  <<: *base\n  user: admin\n",
+			path: []string{"base"},
+			err:  "alias *base refers to values of the subtree [base]",
+		},
+		{
+			doc:  "defaults: &defaults\n  user: admin\nsecrets:\n  <<: *defaults\n  password: hunter2\n",
+			path: []string{"secrets"},
+			err:  "alias *defaults in the subtree [secrets] refers to values outside of it",
+		},
+		{
+			doc:  "base: &base\n  password: hunter2\nprod: *base\n",
+			path: []string{"prod"},
+			err:  "subtree [prod] is defined by the alias *base",
+		},
+		{
+			doc:  "base: &base\n  secrets:\n    password: hunter2\nprod:\n  <<: *base\n",
+			path: []string{"prod", "secrets"},
+			err:  "subtree [prod.secrets] is defined by a merge key",
+		},
+	}
+
+	for _, test := range tests {
+		store, err := newYAMLStore([]byte(test.doc))
+		assert.Nil(t, err)
+		err = store.EncryptSubtree(recipient, test.path...)
+		assert.NotNil(t, err)
+		if err != nil {
+			assert.Contains(t, err.Error(), test.err)
+		}
+		err = store.EncryptSubtreeWithPassphrase("correct horse battery staple", test.path...)
+		assert.NotNil(t, err)
+	}
+
+	// aliases that stay inside of the subtree are fine
+	store, err := newYAMLStore([]byte("secrets:\n  password: &pw hunter2\n  backup: *pw\nname: some-service\n"))
+	assert.Nil(t, err)
+	err = store.EncryptSubtree(recipient, "secrets")
+	assert.Nil(t, err)
+	encrypted, err := store.bytes()
+	assert.Nil(t, err)
+	assert.NotContains(t, string(encrypted), "hunter2")
+}
+
+func TestMarshalYAML(t *testing.T) {
+	bites, err := MarshalYAML(map[string]interface{}{
+		"when": Datetime("2021-11-02"),
+		"port": json.Number("5432"),
+		"list": []interface{}{"a", true},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, "list:\n  - a\n  - true\nport: 5432\nwhen: 2021-11-02\n", string(bites))
+}